@@ -4,6 +4,7 @@ import (
 	"context"
 	"net"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/libs4go/errors"
@@ -62,6 +63,58 @@ func (conn *wrapConn) SetReadDeadline(t time.Time) error {
 func (conn *wrapConn) SetWriteDeadline(t time.Time) error {
 	return conn.conn.SetWriteDeadline(t)
 }
+func (conn *wrapConn) CloseWrite() error {
+	return CloseWrite(conn.conn)
+}
+func (conn *wrapConn) CloseRead() error {
+	return CloseRead(conn.conn)
+}
+func (conn *wrapConn) SyscallConn() (syscall.RawConn, error) {
+	return SyscallConn(conn.conn)
+}
+
+// HalfCloser optional Conn interface to shut down one direction of the connection,
+// tunnel conns implement it by signaling EOF in their own framing and forwarding to the underlying conn
+type HalfCloser interface {
+	// CloseWrite shuts down the writing side, the peer reads io.EOF once the pending data is read
+	CloseWrite() error
+	// CloseRead shuts down the reading side
+	CloseRead() error
+}
+
+// CloseWrite shut down the writing side of conn, returns ErrResource if conn does not support half-close
+func CloseWrite(conn Conn) error {
+	halfCloser, ok := conn.(HalfCloser)
+
+	if !ok {
+		return errors.Wrap(ErrResource, "conn %s not support half-close", conn.LocalAddr().String())
+	}
+
+	return halfCloser.CloseWrite()
+}
+
+// SyscallConn walk the Underlying chain down to the native conn and return its raw socket,
+// native conns expose the socket by implementing syscall.Conn
+func SyscallConn(conn Conn) (syscall.RawConn, error) {
+	for current := conn; current != nil; current = current.Underlying() {
+		if sc, ok := current.(syscall.Conn); ok {
+			return sc.SyscallConn()
+		}
+	}
+
+	return nil, errors.Wrap(ErrResource, "conn %s has no raw socket", conn.LocalAddr().String())
+}
+
+// CloseRead shut down the reading side of conn, returns ErrResource if conn does not support half-close
+func CloseRead(conn Conn) error {
+	halfCloser, ok := conn.(HalfCloser)
+
+	if !ok {
+		return errors.Wrap(ErrResource, "conn %s not support half-close", conn.LocalAddr().String())
+	}
+
+	return halfCloser.CloseRead()
+}
 
 // Dial .
 func Dial(ctx context.Context, raddr multiaddr.Multiaddr, options ...Option) (Conn, error) {
@@ -102,11 +155,14 @@ func Dial(ctx context.Context, raddr multiaddr.Multiaddr, options ...Option) (Co
 
 	for i, tunnel := range tunnelTransports {
 		log.D("wrap tunnel client with addr {@addr}", addrs[i+1].String())
-		conn, err = tunnel.Client(conn, addrs[i+1], configWriter)
+		wrapped, err := tunnel.Client(conn, addrs[i+1], configWriter)
 
 		if err != nil {
+			conn.Close()
 			return nil, errors.Wrap(err, "call tunnel transport %s Client error", tunnel)
 		}
+
+		conn = wrapped
 	}
 
 	return conn, nil
@@ -3,6 +3,7 @@ module github.com/libs4go/stf4go
 go 1.14
 
 require (
+	github.com/klauspost/compress v1.11.0
 	github.com/klauspost/reedsolomon v1.9.9 // indirect
 	github.com/libs4go/bcf4go v0.0.13
 	github.com/libs4go/errors v0.0.3
@@ -18,6 +19,7 @@ require (
 	github.com/tjfoc/gmsm v1.3.2 // indirect
 	github.com/xtaci/kcp-go v5.4.20+incompatible
 	github.com/xtaci/lossyconn v0.0.0-20200209145036-adba10fffc37 // indirect
+	golang.org/x/crypto v0.0.0-20200210222208-86ce3cb69678
 	golang.org/x/sys v0.0.0-20200905004654-be1d3432aa8f
 	gopkg.in/check.v1 v1.0.0-20200902074654-038fdea0a05b // indirect
 )
@@ -1,6 +1,7 @@
 package stf4go
 
 import (
+	stderrors "errors"
 	"net"
 
 	"github.com/libs4go/errors"
@@ -45,6 +46,36 @@ func (wrap *wrapListener) Addr() net.Addr {
 	return addr
 }
 
+// AcceptError native listener Accept failure, tunnel handshake failures are returned as is,
+// they only concern the accepted conn and the listener remains usable
+type AcceptError struct {
+	Err error
+}
+
+func (err *AcceptError) Error() string {
+	return err.Err.Error()
+}
+
+// Unwrap the native accept failure, the root cause of Err, the wrapping of this package is not
+// walked by the standard errors functions
+func (err *AcceptError) Unwrap() error {
+	return errors.Unwrap(err.Err)
+}
+
+// Timeout implement net.Error
+func (err *AcceptError) Timeout() bool {
+	var netErr net.Error
+
+	return stderrors.As(err.Unwrap(), &netErr) && netErr.Timeout()
+}
+
+// Temporary implement net.Error
+func (err *AcceptError) Temporary() bool {
+	var netErr net.Error
+
+	return stderrors.As(err.Unwrap(), &netErr) && netErr.Temporary()
+}
+
 type chainListener struct {
 	laddr            multiaddr.Multiaddr
 	config           *Options
@@ -92,22 +123,27 @@ func Listen(laddr multiaddr.Multiaddr, options ...Option) (Listener, error) {
 }
 
 func (listener *chainListener) Close() error {
-	return nil
+	return listener.nativeListener.Close()
 }
 
 func (listener *chainListener) Accept() (Conn, error) {
 	conn, err := listener.nativeListener.Accept()
 
 	if err != nil {
-		return nil, errors.Wrap(err, "call native transport %s listener#Accept error", listener.nativeTransport)
+		return nil, &AcceptError{
+			Err: errors.Wrap(err, "call native transport %s listener#Accept error", listener.nativeTransport),
+		}
 	}
 
 	for i, tunnel := range listener.tunnelTransports {
-		conn, err = tunnel.Server(conn, listener.tunnelAddrs[i], listener.config)
+		wrapped, err := tunnel.Server(conn, listener.tunnelAddrs[i], listener.config)
 
 		if err != nil {
+			conn.Close()
 			return nil, errors.Wrap(err, "call tunnel transport %s Server error", tunnel)
 		}
+
+		conn = wrapped
 	}
 
 	return conn, nil
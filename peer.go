@@ -0,0 +1,123 @@
+package stf4go
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/libs4go/bcf4go/key"
+	"github.com/libs4go/errors"
+)
+
+// Peer the identity key of one side of a secure tunnel conn
+type Peer struct {
+	Provider string // key provider name
+	PubKey   []byte // public key bytes
+	ID       string // peer id derived from the public key
+}
+
+// NewPeer create peer with the provider address of pubKey as peer id
+func NewPeer(provider string, pubKey []byte) *Peer {
+	return &Peer{
+		Provider: provider,
+		PubKey:   pubKey,
+		ID:       peerID(provider, pubKey),
+	}
+}
+
+func peerID(provider string, pubKey []byte) (id string) {
+	// providers without address support panic, fallback to the key hash
+	defer func() {
+		if recover() != nil {
+			hashed := sha256.Sum256(pubKey)
+			id = hex.EncodeToString(hashed[:])
+		}
+	}()
+
+	return key.PubKeyToAddress(provider, pubKey)
+}
+
+// PeerVerifier authorize the remote identity key during the handshake,
+// a non nil error rejects the peer before any application data flows
+type PeerVerifier func(provider string, pubKey []byte) error
+
+// AllowList create PeerVerifier only accept the listed public keys
+func AllowList(pubKeys ...[]byte) PeerVerifier {
+	allowed := make(map[string]bool)
+
+	for _, pubKey := range pubKeys {
+		allowed[hex.EncodeToString(pubKey)] = true
+	}
+
+	return func(provider string, pubKey []byte) error {
+		if !allowed[hex.EncodeToString(pubKey)] {
+			return errors.New("key not in allow list")
+		}
+
+		return nil
+	}
+}
+
+// DenyList create PeerVerifier reject the listed public keys
+func DenyList(pubKeys ...[]byte) PeerVerifier {
+	denied := make(map[string]bool)
+
+	for _, pubKey := range pubKeys {
+		denied[hex.EncodeToString(pubKey)] = true
+	}
+
+	return func(provider string, pubKey []byte) error {
+		if denied[hex.EncodeToString(pubKey)] {
+			return errors.New("key in deny list")
+		}
+
+		return nil
+	}
+}
+
+// AuthorizePeer run verifiers against peer, all of them must accept the peer or ErrUnauthorized is returned
+func AuthorizePeer(verifiers []PeerVerifier, peer *Peer) error {
+	for _, verifier := range verifiers {
+		if err := verifier(peer.Provider, peer.PubKey); err != nil {
+			return errors.Wrap(ErrUnauthorized, "peer %s rejected: %s", hex.EncodeToString(peer.PubKey), err)
+		}
+	}
+
+	return nil
+}
+
+// VerifyPeer check signature is made by pubKey over hashed and return the signer peer, or ErrSign.
+// the did and eth providers verify against the key recovered from the signature and ignore the pubkey
+// argument, so for recoverable providers the recovered key must also be the claimed one
+func VerifyPeer(provider string, pubKey []byte, signature []byte, hashed []byte) (peer *Peer, err error) {
+	// key.Verify panics on unknown provider name, which is remote controlled for the callers
+	defer func() {
+		if recover() != nil {
+			peer = nil
+			err = errors.Wrap(ErrSign, "unknown key provider %s", provider)
+		}
+	}()
+
+	if !key.Verify(provider, pubKey, signature, hashed) {
+		return nil, errors.Wrap(ErrSign, "")
+	}
+
+	if !recoversTo(provider, pubKey, signature, hashed) {
+		return nil, errors.Wrap(ErrSign, "signature not made by the claimed key")
+	}
+
+	return NewPeer(provider, pubKey), nil
+}
+
+func recoversTo(provider string, pubKey []byte, signature []byte, hashed []byte) (ok bool) {
+	// key.Recover panics on providers without key recovery, key.Verify checked those
+	defer func() {
+		if recover() != nil {
+			ok = true
+		}
+	}()
+
+	recovered, err := key.Recover(provider, signature, hashed)
+
+	return err == nil && bytes.Equal(recovered, pubKey)
+}
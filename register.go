@@ -10,20 +10,29 @@ import (
 type transportRegister struct {
 	sync.RWMutex
 	transports map[string]Transport
+	parameters map[string]multiaddr.Protocol
 }
 
 func newTransportRegister() *transportRegister {
 	return &transportRegister{
 		transports: make(map[string]Transport),
+		parameters: make(map[string]multiaddr.Protocol),
 	}
 }
 
 func (register *transportRegister) add(transport Transport) error {
+	register.Lock()
+	defer register.Unlock()
+
 	for _, protocol := range transport.Protocols() {
 		if _, ok := register.transports[protocol.Name]; ok {
 			return errors.Wrap(ErrTransport, "transport %s protocol %s already register", transport, protocol.Name)
 		}
 
+		if _, ok := register.parameters[protocol.Name]; ok {
+			return errors.Wrap(ErrTransport, "transport %s protocol %s already register as parameter", transport, protocol.Name)
+		}
+
 		register.transports[protocol.Name] = transport
 
 		if multiaddr.ProtocolWithName(protocol.Name).Code == 0 {
@@ -36,6 +45,38 @@ func (register *transportRegister) add(transport Transport) error {
 	return nil
 }
 
+func (register *transportRegister) addParameter(protocol multiaddr.Protocol) error {
+	register.Lock()
+	defer register.Unlock()
+
+	if _, ok := register.parameters[protocol.Name]; ok {
+		return errors.Wrap(ErrTransport, "parameter %s already register", protocol.Name)
+	}
+
+	if _, ok := register.transports[protocol.Name]; ok {
+		return errors.Wrap(ErrTransport, "parameter %s already register as transport protocol", protocol.Name)
+	}
+
+	register.parameters[protocol.Name] = protocol
+
+	if multiaddr.ProtocolWithName(protocol.Name).Code == 0 {
+		if err := multiaddr.AddProtocol(protocol); err != nil {
+			return errors.Wrap(err, "add protocol %s error", protocol.Name)
+		}
+	}
+
+	return nil
+}
+
+func (register *transportRegister) isParameter(name string) bool {
+	register.RLock()
+	defer register.RUnlock()
+
+	_, ok := register.parameters[name]
+
+	return ok
+}
+
 func (register *transportRegister) get(name string) (Transport, bool) {
 
 	register.RLock()
@@ -54,3 +95,11 @@ func RegisterTransport(transport Transport) {
 		panic(err)
 	}
 }
+
+// RegisterParameter register a multiaddr protocol as the parameter of the transport preceding it,
+// e.g. /tls/sni/example.com pass /tls/sni/example.com as the tls tunnel addr
+func RegisterParameter(protocol multiaddr.Protocol) {
+	if err := globalRegister.addParameter(protocol); err != nil {
+		panic(err)
+	}
+}
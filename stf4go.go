@@ -15,11 +15,12 @@ const errVendor = "stf4go"
 
 // errors
 var (
-	ErrTransport = errors.New("transport load error", errors.WithVendor(errVendor), errors.WithCode(-1))
-	ErrMultiAddr = errors.New("multiaddr error", errors.WithVendor(errVendor), errors.WithCode(-2))
-	ErrPassword  = errors.New("password error", errors.WithVendor(errVendor), errors.WithCode(-3))
-	ErrSign      = errors.New("signature invalid", errors.WithVendor(errVendor), errors.WithCode(-4))
-	ErrResource  = errors.New("resource not found", errors.WithVendor(errVendor), errors.WithCode(-5))
+	ErrTransport    = errors.New("transport load error", errors.WithVendor(errVendor), errors.WithCode(-1))
+	ErrMultiAddr    = errors.New("multiaddr error", errors.WithVendor(errVendor), errors.WithCode(-2))
+	ErrPassword     = errors.New("password error", errors.WithVendor(errVendor), errors.WithCode(-3))
+	ErrSign         = errors.New("signature invalid", errors.WithVendor(errVendor), errors.WithCode(-4))
+	ErrResource     = errors.New("resource not found", errors.WithVendor(errVendor), errors.WithCode(-5))
+	ErrUnauthorized = errors.New("peer unauthorized", errors.WithVendor(errVendor), errors.WithCode(-6))
 )
 
 var log = slf4go.Get("stf4go")
@@ -121,37 +122,52 @@ func lookupTransports(addr multiaddr.Multiaddr) ([]multiaddr.Multiaddr, NativeTr
 	count := len(addrs)
 
 	var tunnels []TunnelTransport
+	var tunnelAddrs []multiaddr.Multiaddr
+	var parameters []multiaddr.Multiaddr
 
 	for i := 1; i < count; i++ {
 		current := addrs[count-i]
 
-		transport, ok := globalRegister.get(current.Protocols()[0].Name)
+		name := current.Protocols()[0].Name
+
+		if globalRegister.isParameter(name) {
+			parameters = append([]multiaddr.Multiaddr{current}, parameters...)
+			continue
+		}
+
+		transport, ok := globalRegister.get(name)
 
 		if !ok {
-			return nil, nil, nil, errors.Wrap(ErrTransport, "protocol %s not found", current.Protocols()[0].Name)
+			return nil, nil, nil, errors.Wrap(ErrTransport, "protocol %s not found", name)
 		}
 
 		nativeTransport, ok := transport.(NativeTransport)
 
 		if ok {
-			addrs = append([]multiaddr.Multiaddr{
-				multiaddr.Join(addrs[0 : count-i+1]...),
-			}, addrs[count-i+1:]...)
+			result := []multiaddr.Multiaddr{
+				multiaddr.Join(append(append([]multiaddr.Multiaddr{}, addrs[0:count-i+1]...), parameters...)...),
+			}
+
+			for j := len(tunnelAddrs) - 1; j >= 0; j-- {
+				result = append(result, tunnelAddrs[j])
+			}
 
 			for i, j := 0, len(tunnels)-1; i < j; i, j = i+1, j-1 {
 				tunnels[i], tunnels[j] = tunnels[j], tunnels[i]
 			}
 
-			return addrs, nativeTransport, tunnels, nil
+			return result, nativeTransport, tunnels, nil
 		}
 
 		tunnelTransport, ok := transport.(TunnelTransport)
 
 		if !ok {
-			return nil, nil, nil, errors.Wrap(ErrTransport, "protocol %s must be tunnel transport", current.Protocols()[0].Name)
+			return nil, nil, nil, errors.Wrap(ErrTransport, "protocol %s must be tunnel transport", name)
 		}
 
 		tunnels = append(tunnels, tunnelTransport)
+		tunnelAddrs = append(tunnelAddrs, multiaddr.Join(append([]multiaddr.Multiaddr{current}, parameters...)...))
+		parameters = nil
 	}
 
 	return nil, nil, nil, errors.Wrap(ErrTransport, "expect native transport")
@@ -2,8 +2,12 @@ package stf4go
 
 import (
 	"context"
+	stderrors "errors"
+	"net"
+	"os"
 	"testing"
 
+	"github.com/libs4go/errors"
 	"github.com/multiformats/go-multiaddr"
 	"github.com/stretchr/testify/require"
 )
@@ -42,6 +46,16 @@ var protoP2P = multiaddr.Protocol{
 	Size:       multiaddr.LengthPrefixedVarSize,
 }
 
+const protocolTagID = 499
+
+var protoTag = multiaddr.Protocol{
+	Name:       "tag",
+	Code:       protocolTagID,
+	VCode:      multiaddr.CodeToVarint(protocolTagID),
+	Transcoder: TranscoderKCP,
+	Size:       multiaddr.LengthPrefixedVarSize,
+}
+
 type testKCPTransport struct {
 }
 
@@ -91,6 +105,7 @@ func init() {
 
 	RegisterTransport(&testKCPTransport{})
 	RegisterTransport(&testP2PTransport{})
+	RegisterParameter(protoTag)
 }
 
 func TestLookupTransports(t *testing.T) {
@@ -110,11 +125,11 @@ func TestLookupTransports(t *testing.T) {
 		println(addr.String())
 	}
 
-	require.Equal(t, native, "kcp")
+	require.Equal(t, native.String(), "kcp")
 
 	require.Equal(t, len(tunnels), 1)
 
-	require.Equal(t, tunnels[0], "p2p2")
+	require.Equal(t, tunnels[0].String(), "p2p2")
 
 }
 
@@ -133,3 +148,56 @@ func TestLookupTransportException(t *testing.T) {
 
 	require.Error(t, err, "")
 }
+
+func TestLookupTransportParameters(t *testing.T) {
+	addr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/udp/1812/kcp/tag/native/p2p2/xxxxxxxxxxx/tag/tunnel")
+
+	require.NoError(t, err)
+
+	addrs, native, tunnels, err := lookupTransports(addr)
+
+	require.NoError(t, err)
+
+	require.Equal(t, len(addrs), 2)
+
+	require.Equal(t, native.String(), "kcp")
+
+	require.Equal(t, len(tunnels), 1)
+
+	require.Equal(t, addrs[0].String(), "/ip4/127.0.0.1/udp/1812/kcp/tag/native")
+
+	require.Equal(t, addrs[1].String(), "/p2p2/xxxxxxxxxxx/tag/tunnel")
+
+	value, err := addrs[1].ValueForProtocol(protocolTagID)
+
+	require.NoError(t, err)
+
+	require.Equal(t, value, "tunnel")
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestAcceptError(t *testing.T) {
+	native := &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", timeoutError{})}
+
+	err := &AcceptError{Err: errors.Wrap(native, "call native transport listener#Accept error")}
+
+	require.True(t, err.Timeout())
+	require.True(t, err.Temporary())
+
+	require.True(t, stderrors.Is(err, native))
+
+	var opErr *net.OpError
+
+	require.True(t, stderrors.As(err, &opErr))
+
+	require.Equal(t, "accept", opErr.Op)
+
+	err = &AcceptError{Err: errors.Wrap(ErrTransport, "closed")}
+
+	require.False(t, err.Temporary())
+}
@@ -0,0 +1,366 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/binary"
+	"io"
+
+	"github.com/libs4go/bcf4go/key"
+	_ "github.com/libs4go/bcf4go/key/encoding" //
+	_ "github.com/libs4go/bcf4go/key/provider" //
+	"github.com/libs4go/errors"
+	"github.com/libs4go/slf4go"
+	"github.com/libs4go/stf4go"
+	"github.com/multiformats/go-multiaddr"
+)
+
+const protocolAuthID = 489
+
+var protoAuth = multiaddr.Protocol{
+	Name:  "auth",
+	Code:  protocolAuthID,
+	VCode: multiaddr.CodeToVarint(protocolAuthID),
+}
+
+var authMultiAddr multiaddr.Multiaddr
+
+func init() {
+
+	if err := multiaddr.AddProtocol(protoAuth); err != nil {
+		panic(err)
+	}
+
+	var err error
+	authMultiAddr, err = multiaddr.NewMultiaddr("/auth")
+	if err != nil {
+		panic(err)
+	}
+}
+
+const challengePrefix = "stf4go-transport-auth:"
+const nonceLen = 32
+
+// maxMessageLen bounds the handshake messages read from the unauthenticated peer
+const maxMessageLen = 4096
+
+// handshake result the server sends after checking the client proof
+const (
+	resultOK byte = iota
+	resultSign
+	resultUnauthorized
+)
+
+type proof struct {
+	Nonce     []byte
+	Provider  string
+	PubKey    []byte
+	Signature []byte
+}
+
+// challengeHash the signed message, it binds both nonces and the signer role, so a proof can
+// neither be replayed on another conn nor reflected back to its signer
+func challengeHash(role string, clientNonce, serverNonce []byte) []byte {
+	hasher := sha256.New()
+
+	hasher.Write([]byte(challengePrefix + role))
+	hasher.Write(clientNonce)
+	hasher.Write(serverNonce)
+
+	return hasher.Sum(nil)
+}
+
+func newNonce() ([]byte, error) {
+	nonce := make([]byte, nonceLen)
+
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.Wrap(err, "generate auth nonce error")
+	}
+
+	return nonce, nil
+}
+
+func sign(k key.Key, nonce []byte, hashed []byte) ([]byte, error) {
+	signature, err := key.SignWithKey(k, hashed)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "sign auth challenge error")
+	}
+
+	return asn1.Marshal(proof{
+		Nonce:     nonce,
+		Provider:  k.Provider().Name(),
+		PubKey:    k.PubKey(),
+		Signature: signature,
+	})
+}
+
+func unmarshalProof(message []byte) (*proof, error) {
+	var p proof
+
+	if _, err := asn1.Unmarshal(message, &p); err != nil {
+		return nil, errors.Wrap(err, "unmarshal auth proof error")
+	}
+
+	return &p, nil
+}
+
+func verify(p *proof, hashed []byte) (*stf4go.Peer, error) {
+	return stf4go.VerifyPeer(p.Provider, p.PubKey, p.Signature, hashed)
+}
+
+func readMessage(conn stf4go.Conn) ([]byte, error) {
+	var header [2]byte
+
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint16(header[:])
+
+	if length > maxMessageLen {
+		return nil, errors.New("auth message too large")
+	}
+
+	message := make([]byte, length)
+
+	if _, err := io.ReadFull(conn, message); err != nil {
+		return nil, err
+	}
+
+	return message, nil
+}
+
+func writeMessage(conn stf4go.Conn, message []byte) error {
+	if len(message) > maxMessageLen {
+		return errors.New("auth message too large")
+	}
+
+	buff := make([]byte, 2+len(message))
+
+	binary.BigEndian.PutUint16(buff, uint16(len(message)))
+
+	copy(buff[2:], message)
+
+	_, err := conn.Write(buff)
+
+	return err
+}
+
+type authTransport struct {
+	slf4go.Logger
+}
+
+func newAuthTransport() *authTransport {
+	return &authTransport{
+		Logger: slf4go.Get("stf4go-transport-auth"),
+	}
+}
+
+func (transport *authTransport) String() string {
+	return "stf4go-transport-auth"
+}
+
+func (transport *authTransport) Protocols() []multiaddr.Protocol {
+	return []multiaddr.Protocol{
+		protoAuth,
+	}
+}
+
+// Client send the client nonce, verify the server proof over both nonces, send the client proof
+// and wait for the server result, the conn data is not protected afterwards
+func (transport *authTransport) Client(conn stf4go.Conn, raddr multiaddr.Multiaddr, options *stf4go.Options) (stf4go.Conn, error) {
+
+	k, err := getKey(options)
+
+	if err != nil {
+		return nil, err
+	}
+
+	clientNonce, err := newNonce()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeMessage(conn, clientNonce); err != nil {
+		return nil, errors.Wrap(err, "auth handshake write challenge error")
+	}
+
+	message, err := readMessage(conn)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "auth handshake read server proof error")
+	}
+
+	serverProof, err := unmarshalProof(message)
+
+	if err != nil {
+		return nil, err
+	}
+
+	remotePeer, err := verify(serverProof, challengeHash("server", clientNonce, serverProof.Nonce))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := stf4go.AuthorizePeer(getPeerVerifiers(options), remotePeer); err != nil {
+		return nil, err
+	}
+
+	message, err = sign(k, nil, challengeHash("client", clientNonce, serverProof.Nonce))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeMessage(conn, message); err != nil {
+		return nil, errors.Wrap(err, "auth handshake write client proof error")
+	}
+
+	var result [1]byte
+
+	if _, err := io.ReadFull(conn, result[:]); err != nil {
+		return nil, errors.Wrap(err, "auth handshake read result error")
+	}
+
+	switch result[0] {
+	case resultOK:
+	case resultSign:
+		return nil, errors.Wrap(stf4go.ErrSign, "client proof rejected by %s", raddr.String())
+	default:
+		return nil, errors.Wrap(stf4go.ErrUnauthorized, "client key rejected by %s", raddr.String())
+	}
+
+	return newAuthConn(conn, stf4go.NewPeer(k.Provider().Name(), k.PubKey()), remotePeer), nil
+}
+
+func (transport *authTransport) Server(conn stf4go.Conn, laddr multiaddr.Multiaddr, options *stf4go.Options) (stf4go.Conn, error) {
+
+	k, err := getKey(options)
+
+	if err != nil {
+		return nil, err
+	}
+
+	clientNonce, err := readMessage(conn)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "auth handshake read challenge error")
+	}
+
+	if len(clientNonce) != nonceLen {
+		return nil, errors.Wrap(stf4go.ErrSign, "invalid auth challenge length %d", len(clientNonce))
+	}
+
+	serverNonce, err := newNonce()
+
+	if err != nil {
+		return nil, err
+	}
+
+	message, err := sign(k, serverNonce, challengeHash("server", clientNonce, serverNonce))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeMessage(conn, message); err != nil {
+		return nil, errors.Wrap(err, "auth handshake write server proof error")
+	}
+
+	message, err = readMessage(conn)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "auth handshake read client proof error")
+	}
+
+	result := resultOK
+
+	clientProof, err := unmarshalProof(message)
+
+	var remotePeer *stf4go.Peer
+
+	if err == nil {
+		remotePeer, err = verify(clientProof, challengeHash("client", clientNonce, serverNonce))
+	}
+
+	if err != nil {
+		result = resultSign
+	} else if err = stf4go.AuthorizePeer(getPeerVerifiers(options), remotePeer); err != nil {
+		result = resultUnauthorized
+	}
+
+	if _, writeErr := conn.Write([]byte{result}); writeErr != nil && err == nil {
+		err = errors.Wrap(writeErr, "auth handshake write result error")
+	}
+
+	if err != nil {
+		transport.W("auth handshake with {@raddr} failed {@err}", conn.RemoteAddr().String(), err)
+		return nil, err
+	}
+
+	return newAuthConn(conn, stf4go.NewPeer(k.Provider().Name(), k.PubKey()), remotePeer), nil
+}
+
+// authConn the authenticated conn, reads and writes pass through to the underlying conn unchanged
+type authConn struct {
+	stf4go.Conn
+	laddr      multiaddr.Multiaddr
+	raddr      multiaddr.Multiaddr
+	localPeer  *stf4go.Peer
+	remotePeer *stf4go.Peer
+}
+
+func newAuthConn(underlying stf4go.Conn, localPeer *stf4go.Peer, remotePeer *stf4go.Peer) *authConn {
+	return &authConn{
+		Conn:       underlying,
+		laddr:      underlying.LocalAddr().Encapsulate(authMultiAddr),
+		raddr:      underlying.RemoteAddr().Encapsulate(authMultiAddr),
+		localPeer:  localPeer,
+		remotePeer: remotePeer,
+	}
+}
+
+func (conn *authConn) LocalAddr() multiaddr.Multiaddr {
+	return conn.laddr
+}
+
+func (conn *authConn) RemoteAddr() multiaddr.Multiaddr {
+	return conn.raddr
+}
+
+func (conn *authConn) Underlying() stf4go.Conn {
+	return conn.Conn
+}
+
+func (conn *authConn) CloseWrite() error {
+	return stf4go.CloseWrite(conn.Conn)
+}
+
+func (conn *authConn) CloseRead() error {
+	return stf4go.CloseRead(conn.Conn)
+}
+
+func (conn *authConn) RemotePeer() *stf4go.Peer {
+	return conn.remotePeer
+}
+
+func (conn *authConn) LocalPeer() *stf4go.Peer {
+	return conn.localPeer
+}
+
+func init() {
+	stf4go.RegisterTransport(newAuthTransport())
+}
+
+// Conn .
+type Conn interface {
+	stf4go.Conn
+	// RemotePeer the verified remote identity
+	RemotePeer() *stf4go.Peer
+	// LocalPeer the local identity
+	LocalPeer() *stf4go.Peer
+}
@@ -0,0 +1,198 @@
+package auth
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/libs4go/bcf4go/key"
+	"github.com/libs4go/errors"
+	"github.com/libs4go/scf4go"
+	"github.com/libs4go/scf4go/reader/memory"
+	"github.com/libs4go/slf4go"
+	_ "github.com/libs4go/slf4go/backend/console" //
+	"github.com/libs4go/stf4go"
+	_ "github.com/libs4go/stf4go/transports/tcp" //
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+var loggerjson = `
+{
+	"default":{
+		"backend":"console",
+		"level":"debug"
+	},
+	"backend":{
+		"console":{
+			"formatter":{
+				"output": "@t @l @s @m"
+			}
+		}
+	}
+}
+`
+
+func init() {
+	config := scf4go.New()
+
+	err := config.Load(memory.New(memory.Data(loggerjson, "json")))
+
+	if err != nil {
+		panic(err)
+	}
+
+	err = slf4go.Config(config)
+
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestListenConnect(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1843/auth")
+
+	require.NoError(t, err)
+
+	serverKey, err := key.RandomKey("did")
+
+	require.NoError(t, err)
+
+	clientKey, err := key.RandomKey("did")
+
+	require.NoError(t, err)
+
+	listener, err := stf4go.Listen(laddr, WithKey(serverKey))
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	go func() {
+
+		conn, err := stf4go.Dial(context.Background(), laddr, WithKey(clientKey))
+
+		require.NoError(t, err)
+
+		require.Equal(t, serverKey.PubKey(), conn.(Conn).RemotePeer().PubKey)
+
+		_, err = conn.Write([]byte("hello world"))
+
+		require.NoError(t, err)
+	}()
+
+	conn, err := listener.Accept()
+
+	require.NoError(t, err)
+
+	require.Equal(t, clientKey.PubKey(), conn.(Conn).RemotePeer().PubKey)
+
+	require.Equal(t, serverKey.PubKey(), conn.(Conn).LocalPeer().PubKey)
+
+	var buff [11]byte
+
+	_, err = io.ReadFull(conn, buff[:])
+
+	require.NoError(t, err)
+
+	require.Equal(t, "hello world", string(buff[:]))
+}
+
+func TestUnauthorized(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1844/auth")
+
+	require.NoError(t, err)
+
+	serverKey, err := key.RandomKey("did")
+
+	require.NoError(t, err)
+
+	clientKey, err := key.RandomKey("did")
+
+	require.NoError(t, err)
+
+	listener, err := stf4go.Listen(laddr, WithKey(serverKey), WithPeerVerifier(func(provider string, pubKey []byte) error {
+		return errors.New("nobody allowed")
+	}))
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	accepted := make(chan error, 1)
+
+	go func() {
+		_, err := listener.Accept()
+
+		accepted <- err
+	}()
+
+	_, err = stf4go.Dial(context.Background(), laddr, WithKey(clientKey))
+
+	require.True(t, errors.Is(err, stf4go.ErrUnauthorized))
+
+	require.True(t, errors.Is(<-accepted, stf4go.ErrUnauthorized))
+}
+
+func TestProof(t *testing.T) {
+	k, err := key.RandomKey("did")
+
+	require.NoError(t, err)
+
+	clientNonce, err := newNonce()
+
+	require.NoError(t, err)
+
+	serverNonce, err := newNonce()
+
+	require.NoError(t, err)
+
+	message, err := sign(k, serverNonce, challengeHash("server", clientNonce, serverNonce))
+
+	require.NoError(t, err)
+
+	p, err := unmarshalProof(message)
+
+	require.NoError(t, err)
+
+	peer, err := verify(p, challengeHash("server", clientNonce, serverNonce))
+
+	require.NoError(t, err)
+
+	require.Equal(t, k.PubKey(), peer.PubKey)
+
+	// another key claimed with the valid signature
+	other, err := key.RandomKey("did")
+
+	require.NoError(t, err)
+
+	claimed := *p
+
+	claimed.PubKey = other.PubKey()
+
+	_, err = verify(&claimed, challengeHash("server", clientNonce, serverNonce))
+
+	require.True(t, errors.Is(err, stf4go.ErrSign))
+
+	// reflected as the client proof
+	_, err = verify(p, challengeHash("client", clientNonce, serverNonce))
+
+	require.True(t, errors.Is(err, stf4go.ErrSign))
+
+	// replayed to another client nonce
+	otherNonce, err := newNonce()
+
+	require.NoError(t, err)
+
+	_, err = verify(p, challengeHash("server", otherNonce, serverNonce))
+
+	require.True(t, errors.Is(err, stf4go.ErrSign))
+
+	p.Provider = "unknown"
+
+	_, err = verify(p, challengeHash("server", clientNonce, serverNonce))
+
+	require.True(t, errors.Is(err, stf4go.ErrSign))
+}
@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"github.com/libs4go/bcf4go/key"
+	"github.com/libs4go/errors"
+	"github.com/libs4go/stf4go"
+)
+
+func getKey(options *stf4go.Options) (key.Key, error) {
+	obj, ok := options.GetObj("auth", "key")
+
+	if !ok {
+		return nil, errors.Wrap(stf4go.ErrResource, "expect key")
+	}
+
+	k, ok := obj.(key.Key)
+
+	if !ok {
+		return nil, errors.Wrap(stf4go.ErrResource, "expect key")
+	}
+
+	return k, nil
+}
+
+// WithKey set the identity key used to sign the auth challenge
+func WithKey(k key.Key) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetObject(k, "auth", "key")
+
+		return nil
+	}
+}
+
+func getPeerVerifiers(options *stf4go.Options) []stf4go.PeerVerifier {
+	obj, ok := options.GetObj("auth", "verifiers")
+
+	if !ok {
+		return nil
+	}
+
+	verifiers, ok := obj.([]stf4go.PeerVerifier)
+
+	if !ok {
+		return nil
+	}
+
+	return verifiers
+}
+
+// WithPeerVerifier add peer authorization hook, all added verifiers must accept the peer
+func WithPeerVerifier(verifier stf4go.PeerVerifier) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetObject(append(getPeerVerifiers(options), verifier), "auth", "verifiers")
+
+		return nil
+	}
+}
@@ -0,0 +1,427 @@
+package capture
+
+import (
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libs4go/slf4go"
+	"github.com/libs4go/stf4go"
+	"github.com/multiformats/go-multiaddr"
+)
+
+const protocolCaptureID = 496
+
+var protoCapture = multiaddr.Protocol{
+	Name:  "capture",
+	Code:  protocolCaptureID,
+	VCode: multiaddr.CodeToVarint(protocolCaptureID),
+}
+
+var captureMultiAddr multiaddr.Multiaddr
+
+func init() {
+
+	if err := multiaddr.AddProtocol(protoCapture); err != nil {
+		panic(err)
+	}
+
+	var err error
+	captureMultiAddr, err = multiaddr.NewMultiaddr("/capture")
+	if err != nil {
+		panic(err)
+	}
+}
+
+// tcp flags
+const (
+	flagFIN = 0x01
+	flagSYN = 0x02
+	flagPSH = 0x08
+	flagACK = 0x10
+)
+
+// maxSegment max payload of one synthetic ipv4 packet
+const maxSegment = 65535 - 40
+
+// flowID numbers the synthetic endpoints of the conns without ipv4 address
+var flowID uint32
+
+type endpoint struct {
+	ip   [4]byte
+	port uint16
+}
+
+// flow the synthetic tcp flow of a conn, the sequence numbers follow the recorded data
+type flow struct {
+	sync.Mutex
+	local     endpoint
+	remote    endpoint
+	localSeq  uint32
+	remoteSeq uint32
+	localFIN  bool
+	remoteFIN bool
+}
+
+// newFlow the endpoints are the ipv4 addresses of the conn if it has them, otherwise synthetic
+// 10.0.0.1 to 10.0.0.2 ones with a port pair per conn
+func newFlow(conn stf4go.Conn, client bool) *flow {
+	f := &flow{
+		localSeq:  rand.Uint32(),
+		remoteSeq: rand.Uint32(),
+	}
+
+	local, lok := toEndpoint(conn.LocalAddr())
+	remote, rok := toEndpoint(conn.RemoteAddr())
+
+	if lok && rok {
+		f.local, f.remote = local, remote
+		return f
+	}
+
+	id := atomic.AddUint32(&flowID, 1)
+
+	clientEnd := endpoint{ip: [4]byte{10, 0, 0, 1}, port: uint16(32768 + id%28232)}
+	serverEnd := endpoint{ip: [4]byte{10, 0, 0, 2}, port: 443}
+
+	if client {
+		f.local, f.remote = clientEnd, serverEnd
+	} else {
+		f.local, f.remote = serverEnd, clientEnd
+	}
+
+	return f
+}
+
+func toEndpoint(addr multiaddr.Multiaddr) (endpoint, bool) {
+	netAddr, err := stf4go.ToNetAddr(addr)
+
+	if err != nil {
+		return endpoint{}, false
+	}
+
+	var ip net.IP
+	var port int
+
+	switch a := netAddr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	default:
+		return endpoint{}, false
+	}
+
+	ip4 := ip.To4()
+
+	if ip4 == nil {
+		return endpoint{}, false
+	}
+
+	var e endpoint
+
+	copy(e.ip[:], ip4)
+	e.port = uint16(port)
+
+	return e, true
+}
+
+// segment the ipv4 packet of a tcp segment, outbound from local to remote
+func (f *flow) segment(outbound bool, flags byte, payload []byte) []byte {
+	src, dst := f.local, f.remote
+	seq, ack := f.localSeq, f.remoteSeq
+
+	if !outbound {
+		src, dst = f.remote, f.local
+		seq, ack = f.remoteSeq, f.localSeq
+	}
+
+	packet := make([]byte, 40+len(payload))
+
+	ip := packet[:20]
+
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(packet)))
+	// don't fragment
+	binary.BigEndian.PutUint16(ip[6:], 0x4000)
+	ip[8] = 64
+	ip[9] = 6
+	copy(ip[12:], src.ip[:])
+	copy(ip[16:], dst.ip[:])
+	binary.BigEndian.PutUint16(ip[10:], checksum(0, ip))
+
+	tcp := packet[20:]
+
+	binary.BigEndian.PutUint16(tcp[0:], src.port)
+	binary.BigEndian.PutUint16(tcp[2:], dst.port)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+
+	if flags&flagACK != 0 {
+		binary.BigEndian.PutUint32(tcp[8:], ack)
+	}
+
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 0xffff)
+	copy(tcp[20:], payload)
+
+	// pseudo header
+	var pseudo [12]byte
+
+	copy(pseudo[0:], src.ip[:])
+	copy(pseudo[4:], dst.ip[:])
+	pseudo[9] = 6
+	binary.BigEndian.PutUint16(pseudo[10:], uint16(len(tcp)))
+
+	binary.BigEndian.PutUint16(tcp[16:], checksum(sum(0, pseudo[:]), tcp))
+
+	advance := uint32(len(payload))
+
+	if flags&(flagSYN|flagFIN) != 0 {
+		advance++
+	}
+
+	if outbound {
+		f.localSeq += advance
+	} else {
+		f.remoteSeq += advance
+	}
+
+	return packet
+}
+
+// handshake the three way handshake, the client sends the syn
+func (f *flow) handshake(client bool) [][]byte {
+	f.Lock()
+	defer f.Unlock()
+
+	return [][]byte{
+		f.segment(client, flagSYN, nil),
+		f.segment(!client, flagSYN|flagACK, nil),
+		f.segment(client, flagACK, nil),
+	}
+}
+
+func (f *flow) data(outbound bool, payload []byte) [][]byte {
+	f.Lock()
+	defer f.Unlock()
+
+	var packets [][]byte
+
+	for len(payload) > 0 {
+		chunk := payload
+
+		if len(chunk) > maxSegment {
+			chunk = chunk[:maxSegment]
+		}
+
+		packets = append(packets, f.segment(outbound, flagPSH|flagACK, chunk))
+
+		payload = payload[len(chunk):]
+	}
+
+	return packets
+}
+
+// fin the fin of one direction, once
+func (f *flow) fin(outbound bool) [][]byte {
+	f.Lock()
+	defer f.Unlock()
+
+	sent := &f.remoteFIN
+
+	if outbound {
+		sent = &f.localFIN
+	}
+
+	if *sent {
+		return nil
+	}
+
+	*sent = true
+
+	return [][]byte{f.segment(outbound, flagFIN|flagACK, nil)}
+}
+
+func sum(s uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+
+	return s
+}
+
+func checksum(s uint32, b []byte) uint16 {
+	s = sum(s, b)
+
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+
+	return ^uint16(s)
+}
+
+type captureTransport struct {
+	slf4go.Logger
+}
+
+func newCaptureTransport() *captureTransport {
+	return &captureTransport{
+		Logger: slf4go.Get("stf4go-transport-capture"),
+	}
+}
+
+func (transport *captureTransport) String() string {
+	return "stf4go-transport-capture"
+}
+
+func (transport *captureTransport) Protocols() []multiaddr.Protocol {
+	return []multiaddr.Protocol{
+		protoCapture,
+	}
+}
+
+func (transport *captureTransport) Client(conn stf4go.Conn, raddr multiaddr.Multiaddr, options *stf4go.Options) (stf4go.Conn, error) {
+	return transport.newConn(conn, true, options)
+}
+
+func (transport *captureTransport) Server(conn stf4go.Conn, laddr multiaddr.Multiaddr, options *stf4go.Options) (stf4go.Conn, error) {
+	return transport.newConn(conn, false, options)
+}
+
+func (transport *captureTransport) newConn(conn stf4go.Conn, client bool, options *stf4go.Options) (stf4go.Conn, error) {
+	path, err := getFile(options)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := openSink(path, options.Config.Get("capture", "maxsize").Int(0), options.Config.Get("capture", "maxfiles").Int(0))
+
+	if err != nil {
+		return nil, err
+	}
+
+	cc := &captureConn{
+		logger:     transport.Logger,
+		underlying: conn,
+		laddr:      conn.LocalAddr().Encapsulate(captureMultiAddr),
+		raddr:      conn.RemoteAddr().Encapsulate(captureMultiAddr),
+		sink:       s,
+		flow:       newFlow(conn, client),
+	}
+
+	cc.record(cc.flow.handshake(client))
+
+	return cc, nil
+}
+
+// captureConn records the data passing the conn as a synthetic tcp flow, a failed record is logged
+// and the conn goes on
+type captureConn struct {
+	logger     slf4go.Logger
+	underlying stf4go.Conn
+	laddr      multiaddr.Multiaddr
+	raddr      multiaddr.Multiaddr
+	sink       *sink
+	flow       *flow
+	once       sync.Once
+	failed     int32
+}
+
+func (conn *captureConn) record(packets [][]byte) {
+	ts := time.Now()
+
+	for _, packet := range packets {
+		if err := conn.sink.writePacket(ts, packet); err != nil {
+			if atomic.CompareAndSwapInt32(&conn.failed, 0, 1) {
+				conn.logger.W("capture {@raddr} to {@file} error {@err}", conn.raddr.String(), conn.sink.path, err)
+			}
+
+			return
+		}
+	}
+}
+
+func (conn *captureConn) Read(b []byte) (int, error) {
+	n, err := conn.underlying.Read(b)
+
+	if n > 0 {
+		conn.record(conn.flow.data(false, b[:n]))
+	}
+
+	if err == io.EOF {
+		conn.record(conn.flow.fin(false))
+	}
+
+	return n, err
+}
+
+func (conn *captureConn) Write(b []byte) (int, error) {
+	n, err := conn.underlying.Write(b)
+
+	if n > 0 {
+		conn.record(conn.flow.data(true, b[:n]))
+	}
+
+	return n, err
+}
+
+func (conn *captureConn) Close() error {
+	conn.once.Do(func() {
+		conn.record(conn.flow.fin(true))
+		conn.sink.release()
+	})
+
+	return conn.underlying.Close()
+}
+
+func (conn *captureConn) LocalAddr() multiaddr.Multiaddr {
+	return conn.laddr
+}
+
+func (conn *captureConn) RemoteAddr() multiaddr.Multiaddr {
+	return conn.raddr
+}
+
+func (conn *captureConn) SetDeadline(t time.Time) error {
+	return conn.underlying.SetDeadline(t)
+}
+
+func (conn *captureConn) SetReadDeadline(t time.Time) error {
+	return conn.underlying.SetReadDeadline(t)
+}
+
+func (conn *captureConn) SetWriteDeadline(t time.Time) error {
+	return conn.underlying.SetWriteDeadline(t)
+}
+
+func (conn *captureConn) Underlying() stf4go.Conn {
+	return conn.underlying
+}
+
+func (conn *captureConn) CloseWrite() error {
+	err := stf4go.CloseWrite(conn.underlying)
+
+	if err == nil {
+		conn.record(conn.flow.fin(true))
+	}
+
+	return err
+}
+
+func (conn *captureConn) CloseRead() error {
+	return stf4go.CloseRead(conn.underlying)
+}
+
+func init() {
+	stf4go.RegisterTransport(newCaptureTransport())
+}
@@ -0,0 +1,315 @@
+package capture
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/libs4go/bcf4go/key"
+	"github.com/libs4go/scf4go"
+	"github.com/libs4go/scf4go/reader/memory"
+	"github.com/libs4go/slf4go"
+	_ "github.com/libs4go/slf4go/backend/console" //
+	"github.com/libs4go/stf4go"
+	_ "github.com/libs4go/stf4go/transports/tcp" //
+	"github.com/libs4go/stf4go/transports/tls"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+var loggerjson = `
+{
+	"default":{
+		"backend":"console",
+		"level":"debug"
+	},
+	"backend":{
+		"console":{
+			"formatter":{
+				"output": "@t @l @s @m"
+			}
+		}
+	}
+}
+`
+
+func init() {
+	config := scf4go.New()
+
+	err := config.Load(memory.New(memory.Data(loggerjson, "json")))
+
+	if err != nil {
+		panic(err)
+	}
+
+	err = slf4go.Config(config)
+
+	if err != nil {
+		panic(err)
+	}
+}
+
+type segment struct {
+	srcPort uint16
+	seq     uint32
+	flags   byte
+	payload []byte
+}
+
+// readCapture parse the pcapng file and the tcp segments in it, checking the block and packet checksums
+func readCapture(t *testing.T, path string) []segment {
+	buff, err := ioutil.ReadFile(path)
+
+	require.NoError(t, err)
+
+	require.True(t, len(buff) >= headerLen)
+	require.Equal(t, blockSHB, binary.LittleEndian.Uint32(buff))
+	require.Equal(t, uint32(byteOrderMagic), binary.LittleEndian.Uint32(buff[8:]))
+	require.Equal(t, blockIDB, binary.LittleEndian.Uint32(buff[28:]))
+	require.Equal(t, uint16(linkTypeRaw), binary.LittleEndian.Uint16(buff[36:]))
+
+	var segments []segment
+
+	for buff = buff[headerLen:]; len(buff) > 0; {
+		require.Equal(t, blockEPB, binary.LittleEndian.Uint32(buff))
+
+		length := binary.LittleEndian.Uint32(buff[4:])
+
+		require.Equal(t, length, binary.LittleEndian.Uint32(buff[length-4:]))
+
+		packet := buff[28 : 28+binary.LittleEndian.Uint32(buff[20:])]
+
+		require.Equal(t, uint16(0), checksum(0, packet[:20]))
+
+		var pseudo [12]byte
+
+		copy(pseudo[:], packet[12:20])
+		pseudo[9] = 6
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(len(packet)-20))
+
+		require.Equal(t, uint16(0), checksum(sum(0, pseudo[:]), packet[20:]))
+
+		tcp := packet[20:]
+
+		segments = append(segments, segment{
+			srcPort: binary.BigEndian.Uint16(tcp),
+			seq:     binary.BigEndian.Uint32(tcp[4:]),
+			flags:   tcp[13],
+			payload: tcp[20:],
+		})
+
+		buff = buff[length:]
+	}
+
+	return segments
+}
+
+func TestCapture(t *testing.T) {
+
+	k, err := key.RandomKey("did")
+
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "capture")
+
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	for i, addr := range []string{"/ip4/127.0.0.1/tcp/1867/capture", "/ip4/127.0.0.1/tcp/1868/tls/capture"} {
+		laddr, err := multiaddr.NewMultiaddr(addr)
+
+		require.NoError(t, err)
+
+		serverFile := filepath.Join(dir, fmt.Sprintf("server%d.pcapng", i))
+		clientFile := filepath.Join(dir, fmt.Sprintf("client%d.pcapng", i))
+
+		listener, err := stf4go.Listen(laddr, tls.WithKey(k), WithFile(serverFile))
+
+		require.NoError(t, err)
+
+		go func() {
+			conn, err := listener.Accept()
+
+			require.NoError(t, err)
+
+			defer conn.Close()
+
+			request, err := ioutil.ReadAll(conn)
+
+			require.NoError(t, err)
+
+			conn.Write([]byte(strings.ToUpper(string(request))))
+		}()
+
+		conn, err := stf4go.Dial(context.Background(), laddr, tls.WithKey(k), WithFile(clientFile))
+
+		require.NoError(t, err)
+
+		_, err = conn.Write([]byte("hello"))
+
+		require.NoError(t, err)
+
+		require.NoError(t, stf4go.CloseWrite(conn))
+
+		response, err := ioutil.ReadAll(conn)
+
+		require.NoError(t, err)
+
+		require.Equal(t, "HELLO", string(response))
+
+		conn.Close()
+		listener.Close()
+
+		segments := readCapture(t, clientFile)
+
+		// handshake, request, fin, response, peer fin
+		require.Len(t, segments, 7)
+
+		require.Equal(t, byte(flagSYN), segments[0].flags)
+		require.Equal(t, byte(flagSYN|flagACK), segments[1].flags)
+		require.Equal(t, byte(flagACK), segments[2].flags)
+
+		clientPort := segments[0].srcPort
+
+		require.Equal(t, clientPort, segments[3].srcPort)
+		require.Equal(t, segments[0].seq+1, segments[3].seq)
+		require.Equal(t, "hello", string(segments[3].payload))
+
+		require.Equal(t, byte(flagFIN|flagACK), segments[4].flags)
+		require.Equal(t, segments[3].seq+5, segments[4].seq)
+
+		require.NotEqual(t, clientPort, segments[5].srcPort)
+		require.Equal(t, segments[1].seq+1, segments[5].seq)
+		require.Equal(t, "HELLO", string(segments[5].payload))
+
+		require.Equal(t, byte(flagFIN|flagACK), segments[6].flags)
+
+		// the server records the same flow from its side
+		segments = readCapture(t, serverFile)
+
+		require.Len(t, segments, 7)
+		require.Equal(t, clientPort, segments[0].srcPort)
+	}
+}
+
+func TestRotation(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "capture")
+
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1869/capture")
+
+	require.NoError(t, err)
+
+	listener, err := stf4go.Listen(laddr, WithFile(filepath.Join(dir, "server.pcapng")))
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+
+		require.NoError(t, err)
+
+		defer conn.Close()
+
+		io.Copy(ioutil.Discard, conn)
+	}()
+
+	file := filepath.Join(dir, "client.pcapng")
+
+	conn, err := stf4go.Dial(context.Background(), laddr, WithFile(file), WithMaxSize(2048), WithMaxFiles(3))
+
+	require.NoError(t, err)
+
+	for i := 0; i < 50; i++ {
+		_, err := conn.Write(make([]byte, 200))
+
+		require.NoError(t, err)
+	}
+
+	conn.Close()
+
+	for _, path := range []string{file, file + ".1", file + ".2"} {
+		info, err := os.Stat(path)
+
+		require.NoError(t, err)
+
+		require.True(t, info.Size() <= 2048)
+
+		readCapture(t, path)
+	}
+
+	_, err = os.Stat(file + ".3")
+
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestSequentialDials(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "capture")
+
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1884/capture")
+
+	require.NoError(t, err)
+
+	listener, err := stf4go.Listen(laddr, WithFile(filepath.Join(dir, "server.pcapng")))
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+
+			if err != nil {
+				return
+			}
+
+			io.Copy(ioutil.Discard, conn)
+
+			conn.Close()
+		}
+	}()
+
+	file := filepath.Join(dir, "client.pcapng")
+
+	for _, message := range []string{"first", "second"} {
+		conn, err := stf4go.Dial(context.Background(), laddr, WithFile(file))
+
+		require.NoError(t, err)
+
+		_, err = conn.Write([]byte(message))
+
+		require.NoError(t, err)
+
+		conn.Close()
+	}
+
+	// the second dial appended to the capture of the first one, after a single header
+	var payloads []string
+
+	for _, segment := range readCapture(t, file) {
+		if len(segment.payload) > 0 {
+			payloads = append(payloads, string(segment.payload))
+		}
+	}
+
+	require.Equal(t, []string{"first", "second"}, payloads)
+}
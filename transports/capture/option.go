@@ -0,0 +1,55 @@
+package capture
+
+import (
+	"github.com/libs4go/errors"
+	"github.com/libs4go/stf4go"
+)
+
+func getFile(options *stf4go.Options) (string, error) {
+	path := options.Config.Get("capture", "file").String("")
+
+	if path == "" {
+		return "", errors.Wrap(stf4go.ErrResource, "expect capture file")
+	}
+
+	return path, nil
+}
+
+// WithFile set the pcapng file the conns are recorded to, the conns of one process with the same
+// file share it, so record the client and the server sides of a test to different files. an existing
+// file is appended to, remove it first for a fresh capture
+func WithFile(path string) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetConfig(path, "capture", "file")
+
+		return nil
+	}
+}
+
+// WithMaxSize rotate the file before it grows over size bytes, the rotated files get the
+// suffixes .1, .2 and so on, .1 the newest. 0 (default) never rotates
+func WithMaxSize(size int) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		if size < 0 {
+			return errors.Wrap(stf4go.ErrResource, "invalid capture max size %d", size)
+		}
+
+		options.SetConfig(size, "capture", "maxsize")
+
+		return nil
+	}
+}
+
+// WithMaxFiles keep at most n files including the current one, the oldest rotated files are removed,
+// 0 (default) keeps all
+func WithMaxFiles(n int) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		if n < 0 {
+			return errors.Wrap(stf4go.ErrResource, "invalid capture max files %d", n)
+		}
+
+		options.SetConfig(n, "capture", "maxfiles")
+
+		return nil
+	}
+}
@@ -0,0 +1,237 @@
+package capture
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/libs4go/errors"
+)
+
+// pcapng block types
+const (
+	blockSHB uint32 = 0x0A0D0D0A
+	blockIDB uint32 = 0x00000001
+	blockEPB uint32 = 0x00000006
+)
+
+const byteOrderMagic = 0x1A2B3C4D
+
+// linkTypeRaw raw ip packets without link layer header
+const linkTypeRaw = 101
+
+// headerLen the section header and interface description blocks each file starts with
+const headerLen = 28 + 20
+
+// fileHeader the section header and interface description blocks, timestamps in microseconds
+func fileHeader() []byte {
+	buff := make([]byte, headerLen)
+
+	binary.LittleEndian.PutUint32(buff[0:], blockSHB)
+	binary.LittleEndian.PutUint32(buff[4:], 28)
+	binary.LittleEndian.PutUint32(buff[8:], byteOrderMagic)
+	binary.LittleEndian.PutUint16(buff[12:], 1)
+	binary.LittleEndian.PutUint16(buff[14:], 0)
+	// section length unknown
+	binary.LittleEndian.PutUint64(buff[16:], 0xffffffffffffffff)
+	binary.LittleEndian.PutUint32(buff[24:], 28)
+
+	idb := buff[28:]
+
+	binary.LittleEndian.PutUint32(idb[0:], blockIDB)
+	binary.LittleEndian.PutUint32(idb[4:], 20)
+	binary.LittleEndian.PutUint16(idb[8:], linkTypeRaw)
+	binary.LittleEndian.PutUint16(idb[10:], 0)
+	// no snap length limit
+	binary.LittleEndian.PutUint32(idb[12:], 0)
+	binary.LittleEndian.PutUint32(idb[16:], 20)
+
+	return buff
+}
+
+// packetBlock the enhanced packet block of packet captured at ts
+func packetBlock(ts time.Time, packet []byte) []byte {
+	padded := (len(packet) + 3) &^ 3
+
+	length := 32 + padded
+
+	buff := make([]byte, length)
+
+	micros := uint64(ts.UnixNano() / int64(time.Microsecond))
+
+	binary.LittleEndian.PutUint32(buff[0:], blockEPB)
+	binary.LittleEndian.PutUint32(buff[4:], uint32(length))
+	// interface id 0
+	binary.LittleEndian.PutUint32(buff[8:], 0)
+	binary.LittleEndian.PutUint32(buff[12:], uint32(micros>>32))
+	binary.LittleEndian.PutUint32(buff[16:], uint32(micros))
+	binary.LittleEndian.PutUint32(buff[20:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(buff[24:], uint32(len(packet)))
+	copy(buff[28:], packet)
+	binary.LittleEndian.PutUint32(buff[length-4:], uint32(length))
+
+	return buff
+}
+
+// sink one pcapng file shared by the conns recording to it
+type sink struct {
+	sync.Mutex
+	path     string
+	maxSize  int
+	maxFiles int
+	file     *os.File
+	size     int
+	refs     int
+}
+
+var sinks = struct {
+	sync.Mutex
+	byPath map[string]*sink
+}{
+	byPath: make(map[string]*sink),
+}
+
+// openSink get the sink of path, the first conn opens the file, the size limits of later conns are ignored
+func openSink(path string, maxSize int, maxFiles int) (*sink, error) {
+	sinks.Lock()
+	defer sinks.Unlock()
+
+	if s, ok := sinks.byPath[path]; ok {
+		s.refs++
+		return s, nil
+	}
+
+	s := &sink{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+		refs:     1,
+	}
+
+	if err := s.create(); err != nil {
+		return nil, err
+	}
+
+	sinks.byPath[path] = s
+
+	return s, nil
+}
+
+// release close the file after the last conn
+func (s *sink) release() {
+	sinks.Lock()
+	defer sinks.Unlock()
+
+	s.refs--
+
+	if s.refs > 0 {
+		return
+	}
+
+	delete(sinks.byPath, s.path)
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.file.Close()
+}
+
+// create open the file for appending, the header is only written to an empty file, so the conns of
+// sequential dials record to the same capture instead of truncating it
+func (s *sink) create() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+
+	if err != nil {
+		return errors.Wrap(err, "open capture file %s error", s.path)
+	}
+
+	info, err := file.Stat()
+
+	if err != nil {
+		file.Close()
+		return errors.Wrap(err, "stat capture file %s error", s.path)
+	}
+
+	s.file = file
+	s.size = int(info.Size())
+
+	if s.size > 0 {
+		return nil
+	}
+
+	if _, err := file.Write(fileHeader()); err != nil {
+		file.Close()
+		return errors.Wrap(err, "write capture file %s header error", s.path)
+	}
+
+	s.size = headerLen
+
+	return nil
+}
+
+func (s *sink) rotatedPath(i int) string {
+	return fmt.Sprintf("%s.%d", s.path, i)
+}
+
+// rotate move the current file to .1 and shift the older ones, removing the ones over maxFiles
+func (s *sink) rotate() error {
+	s.file.Close()
+
+	last := 0
+
+	for {
+		if _, err := os.Stat(s.rotatedPath(last + 1)); err != nil {
+			break
+		}
+
+		last++
+	}
+
+	// rotated files after this rotation
+	target := last + 1
+
+	if s.maxFiles > 0 && target > s.maxFiles-1 {
+		target = s.maxFiles - 1
+	}
+
+	for i := last; i >= target && i >= 1; i-- {
+		os.Remove(s.rotatedPath(i))
+	}
+
+	for i := target - 1; i >= 1; i-- {
+		if err := os.Rename(s.rotatedPath(i), s.rotatedPath(i+1)); err != nil {
+			return errors.Wrap(err, "rotate capture file %s error", s.rotatedPath(i))
+		}
+	}
+
+	if target > 0 {
+		if err := os.Rename(s.path, s.rotatedPath(1)); err != nil {
+			return errors.Wrap(err, "rotate capture file %s error", s.path)
+		}
+	} else if err := os.Remove(s.path); err != nil {
+		return errors.Wrap(err, "rotate capture file %s error", s.path)
+	}
+
+	return s.create()
+}
+
+func (s *sink) writePacket(ts time.Time, packet []byte) error {
+	block := packetBlock(ts, packet)
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.maxSize > 0 && s.size > headerLen && s.size+len(block) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(block)
+
+	s.size += n
+
+	return err
+}
@@ -0,0 +1,339 @@
+package compress
+
+import (
+	"compress/flate"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/libs4go/errors"
+	"github.com/libs4go/slf4go"
+	"github.com/libs4go/stf4go"
+	"github.com/multiformats/go-multiaddr"
+)
+
+const protocolDeflateID = 486
+const protocolZstdID = 487
+
+var protoDeflate = multiaddr.Protocol{
+	Name:  "deflate",
+	Code:  protocolDeflateID,
+	VCode: multiaddr.CodeToVarint(protocolDeflateID),
+}
+
+var protoZstd = multiaddr.Protocol{
+	Name:  "zstd",
+	Code:  protocolZstdID,
+	VCode: multiaddr.CodeToVarint(protocolZstdID),
+}
+
+func init() {
+
+	if err := multiaddr.AddProtocol(protoDeflate); err != nil {
+		panic(err)
+	}
+
+	if err := multiaddr.AddProtocol(protoZstd); err != nil {
+		panic(err)
+	}
+}
+
+// compressor stream compressor, Flush pushes the buffered data to the peer at once
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// codec create the compressor and decompressor of one direction of the stream
+type codec interface {
+	newWriter(w io.Writer, options *stf4go.Options) (compressor, error)
+	newReader(r io.Reader) (io.ReadCloser, error)
+}
+
+type deflateCodec struct{}
+
+func (deflateCodec) newWriter(w io.Writer, options *stf4go.Options) (compressor, error) {
+	level := options.Config.Get("deflate", "level").Int(flate.DefaultCompression)
+
+	writer, err := flate.NewWriter(w, level)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "create deflate writer with level %d error", level)
+	}
+
+	return writer, nil
+}
+
+func (deflateCodec) newReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
+
+type zstdCodec struct{}
+
+func (zstdCodec) newWriter(w io.Writer, options *stf4go.Options) (compressor, error) {
+	level := options.Config.Get("zstd", "level").Int(defaultZstdLevel)
+
+	writer, err := zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)), zstd.WithEncoderConcurrency(1))
+
+	if err != nil {
+		return nil, errors.Wrap(err, "create zstd writer with level %d error", level)
+	}
+
+	return writer, nil
+}
+
+func (zstdCodec) newReader(r io.Reader) (io.ReadCloser, error) {
+	reader, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+
+	if err != nil {
+		return nil, errors.Wrap(err, "create zstd reader error")
+	}
+
+	return reader.IOReadCloser(), nil
+}
+
+type compressTransport struct {
+	slf4go.Logger
+	proto multiaddr.Protocol
+	maddr multiaddr.Multiaddr
+	codec codec
+}
+
+func newCompressTransport(proto multiaddr.Protocol, codec codec) *compressTransport {
+	maddr, err := multiaddr.NewMultiaddr("/" + proto.Name)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return &compressTransport{
+		Logger: slf4go.Get("stf4go-transport-" + proto.Name),
+		proto:  proto,
+		maddr:  maddr,
+		codec:  codec,
+	}
+}
+
+func (transport *compressTransport) String() string {
+	return "stf4go-transport-" + transport.proto.Name
+}
+
+func (transport *compressTransport) Protocols() []multiaddr.Protocol {
+	return []multiaddr.Protocol{
+		transport.proto,
+	}
+}
+
+func (transport *compressTransport) Client(conn stf4go.Conn, raddr multiaddr.Multiaddr, options *stf4go.Options) (stf4go.Conn, error) {
+	return transport.newConn(conn, options)
+}
+
+func (transport *compressTransport) Server(conn stf4go.Conn, laddr multiaddr.Multiaddr, options *stf4go.Options) (stf4go.Conn, error) {
+	return transport.newConn(conn, options)
+}
+
+func (transport *compressTransport) newConn(conn stf4go.Conn, options *stf4go.Options) (stf4go.Conn, error) {
+	cc := &compressConn{
+		underlying: conn,
+		laddr:      conn.LocalAddr().Encapsulate(transport.maddr),
+		raddr:      conn.RemoteAddr().Encapsulate(transport.maddr),
+	}
+
+	var err error
+
+	cc.writer, err = transport.codec.newWriter(&countWriter{conn: conn, n: &cc.stats.WireOut}, options)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cc.reader, err = transport.codec.newReader(&countReader{conn: conn, n: &cc.stats.WireIn})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cc, nil
+}
+
+// Stats compressed stream counters, the Bytes are the application data and the Wire the compressed data
+type Stats struct {
+	BytesIn  uint64
+	BytesOut uint64
+	WireIn   uint64
+	WireOut  uint64
+}
+
+// Ratio the wire to application bytes ratio of both directions, lower is better, 1 before any data
+func (stats *Stats) Ratio() float64 {
+	if stats.BytesIn+stats.BytesOut == 0 {
+		return 1
+	}
+
+	return float64(stats.WireIn+stats.WireOut) / float64(stats.BytesIn+stats.BytesOut)
+}
+
+type countWriter struct {
+	conn stf4go.Conn
+	n    *uint64
+}
+
+func (w *countWriter) Write(b []byte) (int, error) {
+	n, err := w.conn.Write(b)
+
+	atomic.AddUint64(w.n, uint64(n))
+
+	return n, err
+}
+
+type countReader struct {
+	conn stf4go.Conn
+	n    *uint64
+}
+
+func (r *countReader) Read(b []byte) (int, error) {
+	n, err := r.conn.Read(b)
+
+	atomic.AddUint64(r.n, uint64(n))
+
+	return n, err
+}
+
+// closeTimeout bounds the end of the compressed stream written by Close
+const closeTimeout = 5 * time.Second
+
+// compressConn compressed stream, each Write is flushed to the peer before returning.
+// the compressor state does not survive errors, a read or write timeout breaks the stream
+type compressConn struct {
+	underlying stf4go.Conn
+	laddr      multiaddr.Multiaddr
+	raddr      multiaddr.Multiaddr
+	writer     compressor
+	reader     io.ReadCloser
+	stats      Stats
+	rlock      sync.Mutex
+	wlock      sync.Mutex
+	closed     bool // the compressed stream is ended, guarded by wlock
+}
+
+func (conn *compressConn) Read(b []byte) (int, error) {
+	conn.rlock.Lock()
+	defer conn.rlock.Unlock()
+
+	n, err := conn.reader.Read(b)
+
+	atomic.AddUint64(&conn.stats.BytesIn, uint64(n))
+
+	return n, err
+}
+
+func (conn *compressConn) Write(b []byte) (int, error) {
+	conn.wlock.Lock()
+	defer conn.wlock.Unlock()
+
+	n, err := conn.writer.Write(b)
+
+	if err != nil {
+		return n, err
+	}
+
+	if err := conn.writer.Flush(); err != nil {
+		return n, err
+	}
+
+	atomic.AddUint64(&conn.stats.BytesOut, uint64(n))
+
+	return n, nil
+}
+
+// Close end the compressed stream and release the compressor before closing, like crypto/tls the deadline
+// is set first, so a blocked Write can not hold Close forever
+func (conn *compressConn) Close() error {
+	conn.underlying.SetWriteDeadline(time.Now().Add(closeTimeout))
+
+	conn.wlock.Lock()
+
+	if !conn.closed {
+		conn.closed = true
+		conn.writer.Close()
+	}
+
+	conn.wlock.Unlock()
+
+	err := conn.underlying.Close()
+
+	// the zstd decoder close waits for its pending read, which the closed underlying conn ends
+	conn.reader.Close()
+
+	return err
+}
+
+func (conn *compressConn) LocalAddr() multiaddr.Multiaddr {
+	return conn.laddr
+}
+
+func (conn *compressConn) RemoteAddr() multiaddr.Multiaddr {
+	return conn.raddr
+}
+
+func (conn *compressConn) SetDeadline(t time.Time) error {
+	return conn.underlying.SetDeadline(t)
+}
+
+func (conn *compressConn) SetReadDeadline(t time.Time) error {
+	return conn.underlying.SetReadDeadline(t)
+}
+
+func (conn *compressConn) SetWriteDeadline(t time.Time) error {
+	return conn.underlying.SetWriteDeadline(t)
+}
+
+func (conn *compressConn) Underlying() stf4go.Conn {
+	return conn.underlying
+}
+
+// CloseWrite end the compressed stream, then half-close the underlying conn if it supports half-close
+func (conn *compressConn) CloseWrite() error {
+	conn.wlock.Lock()
+	defer conn.wlock.Unlock()
+
+	if !conn.closed {
+		conn.closed = true
+
+		if err := conn.writer.Close(); err != nil {
+			return errors.Wrap(err, "close compressed stream error")
+		}
+	}
+
+	if _, ok := conn.underlying.(stf4go.HalfCloser); !ok {
+		return nil
+	}
+
+	return stf4go.CloseWrite(conn.underlying)
+}
+
+func (conn *compressConn) CloseRead() error {
+	return stf4go.CloseRead(conn.underlying)
+}
+
+func (conn *compressConn) Stats() *Stats {
+	return &Stats{
+		BytesIn:  atomic.LoadUint64(&conn.stats.BytesIn),
+		BytesOut: atomic.LoadUint64(&conn.stats.BytesOut),
+		WireIn:   atomic.LoadUint64(&conn.stats.WireIn),
+		WireOut:  atomic.LoadUint64(&conn.stats.WireOut),
+	}
+}
+
+func init() {
+	stf4go.RegisterTransport(newCompressTransport(protoDeflate, deflateCodec{}))
+	stf4go.RegisterTransport(newCompressTransport(protoZstd, zstdCodec{}))
+}
+
+// Conn .
+type Conn interface {
+	stf4go.Conn
+	Stats() *Stats
+}
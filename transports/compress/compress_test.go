@@ -0,0 +1,181 @@
+package compress
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/libs4go/bcf4go/key"
+	"github.com/libs4go/scf4go"
+	"github.com/libs4go/scf4go/reader/memory"
+	"github.com/libs4go/slf4go"
+	_ "github.com/libs4go/slf4go/backend/console" //
+	"github.com/libs4go/stf4go"
+	"github.com/libs4go/stf4go/transports/kcp"
+	_ "github.com/libs4go/stf4go/transports/tcp" //
+	"github.com/libs4go/stf4go/transports/tls"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+var loggerjson = `
+{
+	"default":{
+		"backend":"console",
+		"level":"debug"
+	},
+	"backend":{
+		"console":{
+			"formatter":{
+				"output": "@t @l @s @m"
+			}
+		}
+	}
+}
+`
+
+func init() {
+	config := scf4go.New()
+
+	err := config.Load(memory.New(memory.Data(loggerjson, "json")))
+
+	if err != nil {
+		panic(err)
+	}
+
+	err = slf4go.Config(config)
+
+	if err != nil {
+		panic(err)
+	}
+}
+
+func message(i int) []byte {
+	var buff bytes.Buffer
+
+	for j := 0; j < 20; j++ {
+		fmt.Fprintf(&buff, `{"id":%d,"name":"stf4go","tags":["compress","kcp","tls"],"seq":%d}`, i, j)
+	}
+
+	return buff.Bytes()
+}
+
+func TestCompress(t *testing.T) {
+
+	k, err := key.RandomKey("did")
+
+	require.NoError(t, err)
+
+	for _, addr := range []string{
+		"/ip4/127.0.0.1/tcp/1837/deflate",
+		"/ip4/127.0.0.1/tcp/1838/zstd",
+		"/ip4/127.0.0.1/udp/1839/kcp/deflate/tls",
+	} {
+		laddr, err := multiaddr.NewMultiaddr(addr)
+
+		require.NoError(t, err)
+
+		listener, err := stf4go.Listen(laddr, tls.WithKey(k), kcp.WithNoDelay(1, 10, 2, 1), WithDeflateLevel(9), WithZstdLevel(19))
+
+		require.NoError(t, err)
+
+		go func() {
+			conn, err := listener.Accept()
+
+			require.NoError(t, err)
+
+			defer conn.Close()
+
+			// echo until the client half-closed
+			_, err = io.Copy(conn, conn)
+
+			require.NoError(t, err)
+
+			require.NoError(t, stf4go.CloseWrite(conn))
+		}()
+
+		conn, err := stf4go.Dial(context.Background(), laddr, tls.WithKey(k), kcp.WithNoDelay(1, 10, 2, 1))
+
+		require.NoError(t, err)
+
+		// every write is flushed, so each request gets its answer before the next one is sent
+		for i := 0; i < 10; i++ {
+			_, err = conn.Write(message(i))
+
+			require.NoError(t, err)
+
+			buff := make([]byte, len(message(i)))
+
+			_, err = io.ReadFull(conn, buff)
+
+			require.NoError(t, err)
+
+			require.Equal(t, message(i), buff)
+		}
+
+		require.NoError(t, stf4go.CloseWrite(conn))
+
+		rest, err := ioutil.ReadAll(conn)
+
+		require.NoError(t, err)
+
+		require.Empty(t, rest)
+
+		// below tls the stream carries ciphertext and does not compress
+		if compressed, ok := conn.(Conn); ok {
+			stats := compressed.Stats()
+
+			require.Equal(t, stats.BytesIn, stats.BytesOut)
+
+			require.Less(t, stats.Ratio(), 0.5)
+		}
+
+		conn.Close()
+		listener.Close()
+	}
+}
+
+func TestClose(t *testing.T) {
+
+	for _, addr := range []string{
+		"/ip4/127.0.0.1/tcp/1877/deflate",
+		"/ip4/127.0.0.1/tcp/1878/zstd",
+	} {
+		laddr, err := multiaddr.NewMultiaddr(addr)
+
+		require.NoError(t, err)
+
+		listener, err := stf4go.Listen(laddr)
+
+		require.NoError(t, err)
+
+		go func() {
+			conn, err := listener.Accept()
+
+			require.NoError(t, err)
+
+			_, err = conn.Write([]byte("hello"))
+
+			require.NoError(t, err)
+
+			// Close ends the compressed stream, the peer reads a clean io.EOF
+			require.NoError(t, conn.Close())
+		}()
+
+		conn, err := stf4go.Dial(context.Background(), laddr)
+
+		require.NoError(t, err)
+
+		data, err := ioutil.ReadAll(conn)
+
+		require.NoError(t, err)
+
+		require.Equal(t, "hello", string(data))
+
+		conn.Close()
+		listener.Close()
+	}
+}
@@ -0,0 +1,36 @@
+package compress
+
+import (
+	"compress/flate"
+
+	"github.com/libs4go/errors"
+	"github.com/libs4go/stf4go"
+)
+
+const defaultZstdLevel = 3
+
+// WithDeflateLevel set deflate compression level, flate.HuffmanOnly to flate.BestCompression
+func WithDeflateLevel(level int) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		if level < flate.HuffmanOnly || level > flate.BestCompression {
+			return errors.Wrap(stf4go.ErrResource, "invalid deflate level %d", level)
+		}
+
+		options.SetConfig(level, "deflate", "level")
+
+		return nil
+	}
+}
+
+// WithZstdLevel set zstd compression level 1 to 22, it is mapped to the nearest level of the go encoder
+func WithZstdLevel(level int) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		if level < 1 || level > 22 {
+			return errors.Wrap(stf4go.ErrResource, "invalid zstd level %d", level)
+		}
+
+		options.SetConfig(level, "zstd", "level")
+
+		return nil
+	}
+}
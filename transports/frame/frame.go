@@ -0,0 +1,340 @@
+package frame
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/libs4go/errors"
+	"github.com/libs4go/slf4go"
+	"github.com/libs4go/stf4go"
+	"github.com/multiformats/go-multiaddr"
+)
+
+const protocolFrameID = 491
+
+var protoFrame = multiaddr.Protocol{
+	Name:  "frame",
+	Code:  protocolFrameID,
+	VCode: multiaddr.CodeToVarint(protocolFrameID),
+}
+
+var frameMultiAddr multiaddr.Multiaddr
+
+func init() {
+
+	if err := multiaddr.AddProtocol(protoFrame); err != nil {
+		panic(err)
+	}
+
+	var err error
+	frameMultiAddr, err = multiaddr.NewMultiaddr("/frame")
+	if err != nil {
+		panic(err)
+	}
+}
+
+const errVendor = "stf4go-transport-frame"
+
+// errors
+var (
+	ErrTooLarge = errors.New("frame too large", errors.WithVendor(errVendor), errors.WithCode(-1))
+	ErrChecksum = errors.New("frame checksum mismatch", errors.WithVendor(errVendor), errors.WithCode(-2))
+	ErrSettings = errors.New("frame settings mismatch", errors.WithVendor(errVendor), errors.WithCode(-3))
+	ErrLength   = errors.New("frame length out of range", errors.WithVendor(errVendor), errors.WithCode(-4))
+)
+
+const version = 1
+const flagChecksum = 0x1
+
+// checksumSize crc32c appended to the message
+const checksumSize = 4
+
+// maxSkipFactor frames up to this many times the max size are skipped, longer ones break the conn,
+// so a bogus length can not make the reader discard the stream forever
+const maxSkipFactor = 2
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// MessageConn message oriented conn, each WriteMessage is read by exactly one ReadMessage on the peer
+type MessageConn interface {
+	stf4go.Conn
+	// ReadMessage read the next message, a message larger than the max size is skipped and returns ErrTooLarge,
+	// a corrupted one returns ErrChecksum, the conn stays usable after both. a length past twice the max size
+	// returns ErrLength and a read error inside a frame, e.g. a deadline hit part way, returns that error,
+	// the stream is lost after those and every later read returns the same error
+	ReadMessage() ([]byte, error)
+	// WriteMessage write message as one frame, returns ErrTooLarge if it exceeds the max size
+	WriteMessage(message []byte) error
+	// MaxSize the max message size
+	MaxSize() int
+}
+
+type frameTransport struct {
+	slf4go.Logger
+}
+
+func newFrameTransport() *frameTransport {
+	return &frameTransport{
+		Logger: slf4go.Get("stf4go-transport-frame"),
+	}
+}
+
+func (transport *frameTransport) String() string {
+	return "stf4go-transport-frame"
+}
+
+func (transport *frameTransport) Protocols() []multiaddr.Protocol {
+	return []multiaddr.Protocol{
+		protoFrame,
+	}
+}
+
+func (transport *frameTransport) Client(conn stf4go.Conn, raddr multiaddr.Multiaddr, options *stf4go.Options) (stf4go.Conn, error) {
+	return newFrameConn(conn, options)
+}
+
+func (transport *frameTransport) Server(conn stf4go.Conn, laddr multiaddr.Multiaddr, options *stf4go.Options) (stf4go.Conn, error) {
+	return newFrameConn(conn, options)
+}
+
+type frameConn struct {
+	underlying stf4go.Conn
+	reader     *bufio.Reader
+	laddr      multiaddr.Multiaddr
+	raddr      multiaddr.Multiaddr
+	maxSize    int
+	checksum   bool
+	rlock      sync.Mutex
+	wlock      sync.Mutex
+	readBuff   []byte
+	readErr    error // fatal read error, guarded by rlock
+}
+
+// newFrameConn both ends send their settings byte and then check the peer's, so the conn fails at setup
+// instead of misreading frames when only one end enabled checksums
+func newFrameConn(underlying stf4go.Conn, options *stf4go.Options) (*frameConn, error) {
+	conn := &frameConn{
+		underlying: underlying,
+		reader:     bufio.NewReader(underlying),
+		laddr:      underlying.LocalAddr().Encapsulate(frameMultiAddr),
+		raddr:      underlying.RemoteAddr().Encapsulate(frameMultiAddr),
+		maxSize:    options.Config.Get("frame", "maxsize").Int(defaultMaxSize),
+		checksum:   options.Config.Get("frame", "checksum").Bool(false),
+	}
+
+	settings := byte(version << 4)
+
+	if conn.checksum {
+		settings |= flagChecksum
+	}
+
+	if _, err := underlying.Write([]byte{settings}); err != nil {
+		return nil, errors.Wrap(err, "frame write settings error")
+	}
+
+	remote, err := conn.reader.ReadByte()
+
+	if err != nil {
+		return nil, errors.Wrap(err, "frame read settings error")
+	}
+
+	if remote != settings {
+		return nil, errors.Wrap(ErrSettings, "local settings %#x remote %#x", settings, remote)
+	}
+
+	return conn, nil
+}
+
+func (conn *frameConn) ReadMessage() ([]byte, error) {
+	conn.rlock.Lock()
+	defer conn.rlock.Unlock()
+
+	return conn.readMessage()
+}
+
+func (conn *frameConn) readMessage() ([]byte, error) {
+	if conn.readErr != nil {
+		return nil, conn.readErr
+	}
+
+	// wait for the frame start, a read error up to here, such as io.EOF or a deadline hit between two
+	// frames, leaves the stream position intact
+	if _, err := conn.reader.Peek(1); err != nil {
+		return nil, err
+	}
+
+	length, err := binary.ReadUvarint(conn.reader)
+
+	if err != nil {
+		return nil, conn.fail(errors.Wrap(err, "read frame length error"))
+	}
+
+	if length > uint64(conn.maxSize)*maxSkipFactor || length > math.MaxInt64-checksumSize {
+		return nil, conn.fail(errors.Wrap(ErrLength, "read frame of %d bytes, max %d", length, conn.maxSize))
+	}
+
+	size := int64(length)
+
+	if conn.checksum {
+		size += int64(checksumSize)
+	}
+
+	if length > uint64(conn.maxSize) {
+		// skip the frame, so the following frames are still readable
+		if _, err := io.CopyN(ioutil.Discard, conn.reader, size); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+
+			return nil, conn.fail(errors.Wrap(err, "skip frame of %d bytes error", length))
+		}
+
+		return nil, errors.Wrap(ErrTooLarge, "read frame of %d bytes, max %d", length, conn.maxSize)
+	}
+
+	buff := make([]byte, size)
+
+	if _, err := io.ReadFull(conn.reader, buff); err != nil {
+		return nil, conn.fail(errors.Wrap(err, "read frame of %d bytes error", length))
+	}
+
+	message := buff[:length]
+
+	if conn.checksum && crc32.Checksum(message, crc32cTable) != binary.BigEndian.Uint32(buff[length:]) {
+		return nil, errors.Wrap(ErrChecksum, "frame of %d bytes", length)
+	}
+
+	return message, nil
+}
+
+// fail keep err for the later reads, once a frame is partly read the stream position is lost
+func (conn *frameConn) fail(err error) error {
+	conn.readErr = err
+
+	return err
+}
+
+func (conn *frameConn) WriteMessage(message []byte) error {
+	if len(message) > conn.maxSize {
+		return errors.Wrap(ErrTooLarge, "write frame of %d bytes, max %d", len(message), conn.maxSize)
+	}
+
+	buff := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(message)+checksumSize)
+
+	buff = buff[:binary.PutUvarint(buff, uint64(len(message)))]
+
+	buff = append(buff, message...)
+
+	if conn.checksum {
+		var sum [4]byte
+
+		binary.BigEndian.PutUint32(sum[:], crc32.Checksum(message, crc32cTable))
+
+		buff = append(buff, sum[:]...)
+	}
+
+	conn.wlock.Lock()
+	defer conn.wlock.Unlock()
+
+	_, err := conn.underlying.Write(buff)
+
+	return err
+}
+
+func (conn *frameConn) MaxSize() int {
+	return conn.maxSize
+}
+
+// Read read the messages as a stream, a message is split over several Reads if b is shorter
+func (conn *frameConn) Read(b []byte) (int, error) {
+	conn.rlock.Lock()
+	defer conn.rlock.Unlock()
+
+	for len(conn.readBuff) == 0 {
+		message, err := conn.readMessage()
+
+		if err != nil {
+			return 0, err
+		}
+
+		conn.readBuff = message
+	}
+
+	n := copy(b, conn.readBuff)
+
+	conn.readBuff = conn.readBuff[n:]
+
+	return n, nil
+}
+
+// Write write b as messages of at most the max size
+func (conn *frameConn) Write(b []byte) (int, error) {
+	var n int
+
+	for len(b) > 0 {
+		chunk := b
+
+		if len(chunk) > conn.maxSize {
+			chunk = chunk[:conn.maxSize]
+		}
+
+		if err := conn.WriteMessage(chunk); err != nil {
+			return n, err
+		}
+
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+
+	return n, nil
+}
+
+func (conn *frameConn) Close() error {
+	return conn.underlying.Close()
+}
+
+func (conn *frameConn) LocalAddr() multiaddr.Multiaddr {
+	return conn.laddr
+}
+
+func (conn *frameConn) RemoteAddr() multiaddr.Multiaddr {
+	return conn.raddr
+}
+
+func (conn *frameConn) SetDeadline(t time.Time) error {
+	return conn.underlying.SetDeadline(t)
+}
+
+func (conn *frameConn) SetReadDeadline(t time.Time) error {
+	return conn.underlying.SetReadDeadline(t)
+}
+
+func (conn *frameConn) SetWriteDeadline(t time.Time) error {
+	return conn.underlying.SetWriteDeadline(t)
+}
+
+func (conn *frameConn) Underlying() stf4go.Conn {
+	return conn.underlying
+}
+
+// CloseWrite half-close the underlying conn between two frames, the peer reads io.EOF at the frame boundary
+func (conn *frameConn) CloseWrite() error {
+	conn.wlock.Lock()
+	defer conn.wlock.Unlock()
+
+	return stf4go.CloseWrite(conn.underlying)
+}
+
+func (conn *frameConn) CloseRead() error {
+	return stf4go.CloseRead(conn.underlying)
+}
+
+func init() {
+	stf4go.RegisterTransport(newFrameTransport())
+}
@@ -0,0 +1,367 @@
+package frame
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/libs4go/bcf4go/key"
+	"github.com/libs4go/errors"
+	"github.com/libs4go/scf4go"
+	"github.com/libs4go/scf4go/reader/memory"
+	"github.com/libs4go/slf4go"
+	_ "github.com/libs4go/slf4go/backend/console" //
+	"github.com/libs4go/stf4go"
+	_ "github.com/libs4go/stf4go/transports/tcp" //
+	"github.com/libs4go/stf4go/transports/tls"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+var loggerjson = `
+{
+	"default":{
+		"backend":"console",
+		"level":"debug"
+	},
+	"backend":{
+		"console":{
+			"formatter":{
+				"output": "@t @l @s @m"
+			}
+		}
+	}
+}
+`
+
+func init() {
+	config := scf4go.New()
+
+	err := config.Load(memory.New(memory.Data(loggerjson, "json")))
+
+	if err != nil {
+		panic(err)
+	}
+
+	err = slf4go.Config(config)
+
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestMessages(t *testing.T) {
+
+	k, err := key.RandomKey("did")
+
+	require.NoError(t, err)
+
+	messages := [][]byte{
+		[]byte("hello"),
+		{},
+		bytes.Repeat([]byte("x"), 300),
+		bytes.Repeat([]byte("y"), 100000),
+		[]byte("world"),
+	}
+
+	for _, addr := range []string{"/ip4/127.0.0.1/tcp/1847/frame", "/ip4/127.0.0.1/tcp/1848/tls/frame"} {
+		laddr, err := multiaddr.NewMultiaddr(addr)
+
+		require.NoError(t, err)
+
+		listener, err := stf4go.Listen(laddr, tls.WithKey(k), WithChecksum(true))
+
+		require.NoError(t, err)
+
+		go func() {
+			conn, err := stf4go.Dial(context.Background(), laddr, tls.WithKey(k), WithChecksum(true))
+
+			require.NoError(t, err)
+
+			for _, message := range messages {
+				require.NoError(t, conn.(MessageConn).WriteMessage(message))
+			}
+		}()
+
+		conn, err := listener.Accept()
+
+		require.NoError(t, err)
+
+		for _, message := range messages {
+			read, err := conn.(MessageConn).ReadMessage()
+
+			require.NoError(t, err)
+
+			require.Equal(t, message, read)
+		}
+
+		conn.Close()
+		listener.Close()
+	}
+}
+
+func TestTooLarge(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1849/frame")
+
+	require.NoError(t, err)
+
+	listener, err := stf4go.Listen(laddr, WithMaxSize(16))
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	go func() {
+		conn, err := stf4go.Dial(context.Background(), laddr, WithMaxSize(1024))
+
+		require.NoError(t, err)
+
+		require.True(t, errors.Is(conn.(MessageConn).WriteMessage(make([]byte, 1025)), ErrTooLarge))
+
+		require.NoError(t, conn.(MessageConn).WriteMessage(make([]byte, 30)))
+
+		require.NoError(t, conn.(MessageConn).WriteMessage([]byte("small")))
+	}()
+
+	conn, err := listener.Accept()
+
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	_, err = conn.(MessageConn).ReadMessage()
+
+	require.True(t, errors.Is(err, ErrTooLarge))
+
+	// the oversize frame was skipped
+	message, err := conn.(MessageConn).ReadMessage()
+
+	require.NoError(t, err)
+
+	require.Equal(t, "small", string(message))
+}
+
+func rawFrame(message []byte, checksum uint32) []byte {
+	buff := make([]byte, binary.MaxVarintLen64)
+
+	buff = buff[:binary.PutUvarint(buff, uint64(len(message)))]
+
+	buff = append(buff, message...)
+
+	var sum [4]byte
+
+	binary.BigEndian.PutUint32(sum[:], checksum)
+
+	return append(buff, sum[:]...)
+}
+
+func TestChecksum(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1850")
+
+	require.NoError(t, err)
+
+	// raw tcp listener playing the peer
+	listener, err := stf4go.Listen(laddr)
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+
+		require.NoError(t, err)
+
+		defer conn.Close()
+
+		var buff bytes.Buffer
+
+		buff.WriteByte(version<<4 | flagChecksum)
+		buff.Write(rawFrame([]byte("corrupted"), 0))
+		buff.Write(rawFrame([]byte("valid"), crc32.Checksum([]byte("valid"), crc32cTable)))
+
+		_, err = conn.Write(buff.Bytes())
+
+		require.NoError(t, err)
+
+		// settings mismatch
+		conn, err = listener.Accept()
+
+		require.NoError(t, err)
+
+		_, err = conn.Write([]byte{version << 4})
+
+		require.NoError(t, err)
+	}()
+
+	conn, err := stf4go.Dial(context.Background(), laddr.Encapsulate(frameMultiAddr), WithChecksum(true))
+
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	_, err = conn.(MessageConn).ReadMessage()
+
+	require.True(t, errors.Is(err, ErrChecksum))
+
+	message, err := conn.(MessageConn).ReadMessage()
+
+	require.NoError(t, err)
+
+	require.Equal(t, "valid", string(message))
+
+	_, err = stf4go.Dial(context.Background(), laddr.Encapsulate(frameMultiAddr), WithChecksum(true))
+
+	require.True(t, errors.Is(err, ErrSettings))
+}
+
+func TestLength(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1880")
+
+	require.NoError(t, err)
+
+	// raw tcp listener playing the peer
+	listener, err := stf4go.Listen(laddr)
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	go func() {
+		for _, length := range []uint64{33, 1<<63 + 1} {
+			conn, err := listener.Accept()
+
+			require.NoError(t, err)
+
+			defer conn.Close()
+
+			buff := []byte{version << 4}
+
+			buff = append(buff, make([]byte, binary.MaxVarintLen64)...)
+
+			buff = buff[:1+binary.PutUvarint(buff[1:], length)]
+
+			_, err = conn.Write(append(buff, "small"...))
+
+			require.NoError(t, err)
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		conn, err := stf4go.Dial(context.Background(), laddr.Encapsulate(frameMultiAddr), WithMaxSize(16))
+
+		require.NoError(t, err)
+
+		defer conn.Close()
+
+		_, err = conn.(MessageConn).ReadMessage()
+
+		require.True(t, errors.Is(err, ErrLength))
+
+		// the stream position is lost, the conn stays broken
+		_, err = conn.(MessageConn).ReadMessage()
+
+		require.True(t, errors.Is(err, ErrLength))
+	}
+}
+
+func TestPartialRead(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1886")
+
+	require.NoError(t, err)
+
+	// raw tcp listener playing the peer
+	listener, err := stf4go.Listen(laddr)
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	step := make(chan struct{})
+
+	go func() {
+		conn, err := listener.Accept()
+
+		require.NoError(t, err)
+
+		defer conn.Close()
+
+		_, err = conn.Write([]byte{version << 4})
+
+		require.NoError(t, err)
+
+		<-step
+
+		// a whole frame and the head of the next one
+		_, err = conn.Write(append(rawFrame([]byte("first"), 0)[:6], 10, 'a', 'b', 'c'))
+
+		require.NoError(t, err)
+
+		<-step
+
+		_, err = conn.Write(append([]byte("defghij"), rawFrame([]byte("next"), 0)[:5]...))
+
+		require.NoError(t, err)
+
+		<-step
+	}()
+
+	defer close(step)
+
+	conn, err := stf4go.Dial(context.Background(), laddr.Encapsulate(frameMultiAddr))
+
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	timeout := func(err error) bool {
+		netErr, ok := errors.Unwrap(err).(net.Error)
+
+		return ok && netErr.Timeout()
+	}
+
+	// a deadline between two frames keeps the conn usable
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+
+	_, err = conn.(MessageConn).ReadMessage()
+
+	require.True(t, timeout(err))
+
+	step <- struct{}{}
+
+	require.NoError(t, conn.SetReadDeadline(time.Time{}))
+
+	message, err := conn.(MessageConn).ReadMessage()
+
+	require.NoError(t, err)
+
+	require.Equal(t, "first", string(message))
+
+	// a deadline inside a frame loses the stream position
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+
+	_, err = conn.(MessageConn).ReadMessage()
+
+	require.True(t, timeout(err))
+
+	step <- struct{}{}
+
+	// the rest of the frame is not read as the next frame length
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+
+	_, err2 := conn.(MessageConn).ReadMessage()
+
+	require.Equal(t, err, err2)
+
+	_, err2 = conn.Read(make([]byte, 16))
+
+	require.Equal(t, err, err2)
+}
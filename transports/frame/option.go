@@ -0,0 +1,30 @@
+package frame
+
+import (
+	"github.com/libs4go/errors"
+	"github.com/libs4go/stf4go"
+)
+
+const defaultMaxSize = 1 << 20
+
+// WithMaxSize set the max message size, both directions, default 1MB
+func WithMaxSize(size int) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		if size <= 0 {
+			return errors.Wrap(stf4go.ErrResource, "invalid frame max size %d", size)
+		}
+
+		options.SetConfig(size, "frame", "maxsize")
+
+		return nil
+	}
+}
+
+// WithChecksum append a crc32c checksum to each frame, both ends must agree
+func WithChecksum(enable bool) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetConfig(enable, "frame", "checksum")
+
+		return nil
+	}
+}
@@ -0,0 +1,366 @@
+package httpobfs
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libs4go/errors"
+	"github.com/libs4go/slf4go"
+	"github.com/libs4go/stf4go"
+	"github.com/multiformats/go-multiaddr"
+)
+
+const protocolHTTPObfsID = 494
+
+var protoHTTPObfs = multiaddr.Protocol{
+	Name:  "httpobfs",
+	Code:  protocolHTTPObfsID,
+	VCode: multiaddr.CodeToVarint(protocolHTTPObfsID),
+}
+
+var httpObfsMultiAddr multiaddr.Multiaddr
+
+func init() {
+
+	if err := multiaddr.AddProtocol(protoHTTPObfs); err != nil {
+		panic(err)
+	}
+
+	var err error
+	httpObfsMultiAddr, err = multiaddr.NewMultiaddr("/httpobfs")
+	if err != nil {
+		panic(err)
+	}
+}
+
+const errVendor = "stf4go-transport-httpobfs"
+
+// errors
+var (
+	ErrRequest = errors.New("not a httpobfs request", errors.WithVendor(errVendor), errors.WithCode(-1))
+	ErrStatus  = errors.New("httpobfs request rejected", errors.WithVendor(errVendor), errors.WithCode(-2))
+)
+
+// maxHeaderLen bounds the request and response head read from the peer
+const maxHeaderLen = 8192
+
+// maxChunkLen max body chunk of one Write
+const maxChunkLen = 32 * 1024
+
+// lastChunk ends a chunked body without trailers
+const lastChunk = "0\r\n\r\n"
+
+// closeTimeout bounds the last chunk write of Close
+const closeTimeout = 5 * time.Second
+
+const notFound = "<html>\r\n<head><title>404 Not Found</title></head>\r\n<body>\r\n<center><h1>404 Not Found</h1></center>\r\n<hr><center>nginx</center>\r\n</body>\r\n</html>\r\n"
+
+// headLimit limit the reads while the head is parsed, the body is read unlimited
+type headLimit struct {
+	reader io.Reader
+	n      int
+}
+
+func (limit *headLimit) Read(b []byte) (int, error) {
+	if limit.n < 0 {
+		return limit.reader.Read(b)
+	}
+
+	if limit.n == 0 {
+		return 0, errors.New("httpobfs head too large")
+	}
+
+	if len(b) > limit.n {
+		b = b[:limit.n]
+	}
+
+	n, err := limit.reader.Read(b)
+
+	limit.n -= n
+
+	return n, err
+}
+
+type httpObfsTransport struct {
+	slf4go.Logger
+}
+
+func newHTTPObfsTransport() *httpObfsTransport {
+	return &httpObfsTransport{
+		Logger: slf4go.Get("stf4go-transport-httpobfs"),
+	}
+}
+
+func (transport *httpObfsTransport) String() string {
+	return "stf4go-transport-httpobfs"
+}
+
+func (transport *httpObfsTransport) Protocols() []multiaddr.Protocol {
+	return []multiaddr.Protocol{
+		protoHTTPObfs,
+	}
+}
+
+// defaultHost the remote address, without the port 80
+func defaultHost(conn stf4go.Conn) string {
+	addr, err := stf4go.ToNetAddr(conn.RemoteAddr())
+
+	if err != nil {
+		return "localhost"
+	}
+
+	host, port, err := net.SplitHostPort(addr.String())
+
+	if err != nil || port != "80" {
+		return addr.String()
+	}
+
+	return host
+}
+
+// Client send a chunked POST request head and read the response head, the request and response
+// bodies carry the stream afterwards
+func (transport *httpObfsTransport) Client(conn stf4go.Conn, raddr multiaddr.Multiaddr, options *stf4go.Options) (stf4go.Conn, error) {
+
+	config := options.Config
+
+	host := config.Get("httpobfs", "host").String("")
+
+	if host == "" {
+		host = defaultHost(conn)
+	}
+
+	path := config.Get("httpobfs", "path").String(defaultPath)
+
+	head := "POST " + path + " HTTP/1.1\r\n" +
+		"Host: " + host + "\r\n" +
+		"User-Agent: " + config.Get("httpobfs", "useragent").String(defaultUserAgent) + "\r\n" +
+		"Accept: */*\r\n" +
+		"Accept-Encoding: gzip, deflate\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Transfer-Encoding: chunked\r\n" +
+		"Connection: keep-alive\r\n" +
+		"\r\n"
+
+	if _, err := io.WriteString(conn, head); err != nil {
+		return nil, errors.Wrap(err, "httpobfs write request error")
+	}
+
+	limit := &headLimit{reader: conn, n: maxHeaderLen}
+
+	reader := bufio.NewReader(limit)
+
+	resp, err := http.ReadResponse(reader, nil)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "httpobfs read response error")
+	}
+
+	if resp.StatusCode != http.StatusOK || !chunked(resp.TransferEncoding) {
+		return nil, errors.Wrap(ErrStatus, "POST %s%s to %s, status %s", host, path, raddr.String(), resp.Status)
+	}
+
+	limit.n = -1
+
+	return newHTTPObfsConn(conn, resp.Body), nil
+}
+
+// Server read the request head, a request not made by the client gets the 404 page and the conn fails
+func (transport *httpObfsTransport) Server(conn stf4go.Conn, laddr multiaddr.Multiaddr, options *stf4go.Options) (stf4go.Conn, error) {
+
+	config := options.Config
+
+	limit := &headLimit{reader: conn, n: maxHeaderLen}
+
+	reader := bufio.NewReader(limit)
+
+	req, err := http.ReadRequest(reader)
+
+	if err != nil {
+		return nil, errors.Wrap(ErrRequest, "read request from %s error: %s", conn.RemoteAddr().String(), err)
+	}
+
+	host := config.Get("httpobfs", "host").String("")
+	path := config.Get("httpobfs", "path").String(defaultPath)
+
+	if req.Method != http.MethodPost || req.URL.Path != path || !chunked(req.TransferEncoding) ||
+		(host != "" && !strings.EqualFold(req.Host, host)) {
+
+		// the body is not drained, the conn is closed after the reply
+		io.WriteString(conn, "HTTP/1.1 404 Not Found\r\n"+
+			"Server: nginx\r\n"+
+			"Date: "+time.Now().UTC().Format(http.TimeFormat)+"\r\n"+
+			"Content-Type: text/html\r\n"+
+			"Content-Length: "+strconv.Itoa(len(notFound))+"\r\n"+
+			"Connection: close\r\n"+
+			"\r\n"+
+			notFound)
+
+		transport.W("httpobfs reject {@method} {@host}{@path} from {@raddr}", req.Method, req.Host, req.URL.Path, conn.RemoteAddr().String())
+
+		return nil, errors.Wrap(ErrRequest, "%s %s%s from %s", req.Method, req.Host, req.URL.Path, conn.RemoteAddr().String())
+	}
+
+	head := "HTTP/1.1 200 OK\r\n" +
+		"Server: nginx\r\n" +
+		"Date: " + time.Now().UTC().Format(http.TimeFormat) + "\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Transfer-Encoding: chunked\r\n" +
+		"Connection: keep-alive\r\n" +
+		"Cache-Control: no-store\r\n" +
+		"\r\n"
+
+	if _, err := io.WriteString(conn, head); err != nil {
+		return nil, errors.Wrap(err, "httpobfs write response error")
+	}
+
+	limit.n = -1
+
+	return newHTTPObfsConn(conn, req.Body), nil
+}
+
+func chunked(encodings []string) bool {
+	return len(encodings) == 1 && encodings[0] == "chunked"
+}
+
+// httpObfsConn reads the chunked body of the peer and writes each Write as body chunks,
+// CloseWrite ends the body
+type httpObfsConn struct {
+	underlying  stf4go.Conn
+	laddr       multiaddr.Multiaddr
+	raddr       multiaddr.Multiaddr
+	body        io.ReadCloser
+	rlock       sync.Mutex
+	wlock       sync.Mutex
+	writeClosed bool
+}
+
+func newHTTPObfsConn(underlying stf4go.Conn, body io.ReadCloser) *httpObfsConn {
+	return &httpObfsConn{
+		underlying: underlying,
+		laddr:      underlying.LocalAddr().Encapsulate(httpObfsMultiAddr),
+		raddr:      underlying.RemoteAddr().Encapsulate(httpObfsMultiAddr),
+		body:       body,
+	}
+}
+
+func (conn *httpObfsConn) Read(b []byte) (int, error) {
+	conn.rlock.Lock()
+	defer conn.rlock.Unlock()
+
+	return conn.body.Read(b)
+}
+
+func (conn *httpObfsConn) Write(b []byte) (int, error) {
+	conn.wlock.Lock()
+	defer conn.wlock.Unlock()
+
+	if conn.writeClosed {
+		return 0, io.ErrClosedPipe
+	}
+
+	var n int
+
+	// an empty chunk ends the body, so empty writes send nothing
+	for len(b) > 0 {
+		chunk := b
+
+		if len(chunk) > maxChunkLen {
+			chunk = chunk[:maxChunkLen]
+		}
+
+		buff := make([]byte, 0, len(chunk)+12)
+
+		buff = append(buff, fmt.Sprintf("%x\r\n", len(chunk))...)
+		buff = append(buff, chunk...)
+		buff = append(buff, "\r\n"...)
+
+		if _, err := conn.underlying.Write(buff); err != nil {
+			return n, err
+		}
+
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+
+	return n, nil
+}
+
+// Close end the body before closing, so the peer reads io.EOF instead of a truncated body. like
+// crypto/tls the deadline is set first, so a blocked Write can not hold Close forever
+func (conn *httpObfsConn) Close() error {
+	conn.underlying.SetWriteDeadline(time.Now().Add(closeTimeout))
+
+	conn.wlock.Lock()
+
+	if !conn.writeClosed {
+		conn.writeClosed = true
+		io.WriteString(conn.underlying, lastChunk)
+	}
+
+	conn.wlock.Unlock()
+
+	return conn.underlying.Close()
+}
+
+func (conn *httpObfsConn) LocalAddr() multiaddr.Multiaddr {
+	return conn.laddr
+}
+
+func (conn *httpObfsConn) RemoteAddr() multiaddr.Multiaddr {
+	return conn.raddr
+}
+
+func (conn *httpObfsConn) SetDeadline(t time.Time) error {
+	return conn.underlying.SetDeadline(t)
+}
+
+func (conn *httpObfsConn) SetReadDeadline(t time.Time) error {
+	return conn.underlying.SetReadDeadline(t)
+}
+
+func (conn *httpObfsConn) SetWriteDeadline(t time.Time) error {
+	return conn.underlying.SetWriteDeadline(t)
+}
+
+func (conn *httpObfsConn) Underlying() stf4go.Conn {
+	return conn.underlying
+}
+
+// CloseWrite send the last chunk, the peer reads io.EOF at the end of the body, then half-close
+// the underlying conn if it supports half-close
+func (conn *httpObfsConn) CloseWrite() error {
+	conn.wlock.Lock()
+	defer conn.wlock.Unlock()
+
+	if conn.writeClosed {
+		return nil
+	}
+
+	conn.writeClosed = true
+
+	if _, err := io.WriteString(conn.underlying, lastChunk); err != nil {
+		return errors.Wrap(err, "httpobfs write last chunk error")
+	}
+
+	if _, ok := conn.underlying.(stf4go.HalfCloser); !ok {
+		return nil
+	}
+
+	return stf4go.CloseWrite(conn.underlying)
+}
+
+func (conn *httpObfsConn) CloseRead() error {
+	return stf4go.CloseRead(conn.underlying)
+}
+
+func init() {
+	stf4go.RegisterTransport(newHTTPObfsTransport())
+}
@@ -0,0 +1,158 @@
+package httpobfs
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/libs4go/bcf4go/key"
+	"github.com/libs4go/errors"
+	"github.com/libs4go/scf4go"
+	"github.com/libs4go/scf4go/reader/memory"
+	"github.com/libs4go/slf4go"
+	_ "github.com/libs4go/slf4go/backend/console" //
+	"github.com/libs4go/stf4go"
+	_ "github.com/libs4go/stf4go/transports/tcp" //
+	"github.com/libs4go/stf4go/transports/tls"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+var loggerjson = `
+{
+	"default":{
+		"backend":"console",
+		"level":"debug"
+	},
+	"backend":{
+		"console":{
+			"formatter":{
+				"output": "@t @l @s @m"
+			}
+		}
+	}
+}
+`
+
+func init() {
+	config := scf4go.New()
+
+	err := config.Load(memory.New(memory.Data(loggerjson, "json")))
+
+	if err != nil {
+		panic(err)
+	}
+
+	err = slf4go.Config(config)
+
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestHTTPObfs(t *testing.T) {
+
+	k, err := key.RandomKey("did")
+
+	require.NoError(t, err)
+
+	for _, addr := range []string{"/ip4/127.0.0.1/tcp/1858/httpobfs", "/ip4/127.0.0.1/tcp/1859/httpobfs/tls"} {
+		laddr, err := multiaddr.NewMultiaddr(addr)
+
+		require.NoError(t, err)
+
+		listener, err := stf4go.Listen(laddr, tls.WithKey(k), WithHost("example.com"), WithPath("/upload"))
+
+		require.NoError(t, err)
+
+		go func() {
+			conn, err := listener.Accept()
+
+			require.NoError(t, err)
+
+			defer conn.Close()
+
+			request, err := ioutil.ReadAll(conn)
+
+			require.NoError(t, err)
+
+			_, err = conn.Write([]byte(strings.ToUpper(string(request))))
+
+			require.NoError(t, err)
+		}()
+
+		conn, err := stf4go.Dial(context.Background(), laddr, tls.WithKey(k), WithHost("example.com"), WithPath("/upload"))
+
+		require.NoError(t, err)
+
+		_, err = conn.Write([]byte("hello "))
+
+		require.NoError(t, err)
+
+		_, err = conn.Write([]byte(strings.Repeat("world", 10000)))
+
+		require.NoError(t, err)
+
+		require.NoError(t, stf4go.CloseWrite(conn))
+
+		response, err := ioutil.ReadAll(conn)
+
+		require.NoError(t, err)
+
+		require.Equal(t, "HELLO "+strings.Repeat("WORLD", 10000), string(response))
+
+		conn.Close()
+		listener.Close()
+	}
+}
+
+func TestReject(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1860")
+
+	require.NoError(t, err)
+
+	listener, err := stf4go.Listen(laddr.Encapsulate(httpObfsMultiAddr), WithPath("/upload"))
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	accepted := make(chan error, 2)
+
+	go func() {
+		for i := 0; i < 2; i++ {
+			_, err := listener.Accept()
+
+			accepted <- err
+		}
+	}()
+
+	// a plain http client gets the 404 page
+	conn, err := stf4go.Dial(context.Background(), laddr)
+
+	require.NoError(t, err)
+
+	_, err = io.WriteString(conn, "GET /upload HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n")
+
+	require.NoError(t, err)
+
+	response, err := ioutil.ReadAll(conn)
+
+	require.NoError(t, err)
+
+	require.True(t, strings.HasPrefix(string(response), "HTTP/1.1 404 Not Found\r\n"))
+
+	conn.Close()
+
+	require.True(t, errors.Is(<-accepted, ErrRequest))
+
+	// a client of another path is rejected
+	_, err = stf4go.Dial(context.Background(), laddr.Encapsulate(httpObfsMultiAddr), WithPath("/download"))
+
+	require.True(t, errors.Is(err, ErrStatus))
+
+	require.True(t, errors.Is(<-accepted, ErrRequest))
+}
@@ -0,0 +1,43 @@
+package httpobfs
+
+import (
+	"strings"
+
+	"github.com/libs4go/errors"
+	"github.com/libs4go/stf4go"
+)
+
+const defaultPath = "/"
+const defaultUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/85.0.4183.102 Safari/537.36"
+
+// WithHost set the request Host, the client defaults to the remote address, the server accepts
+// any Host unless set
+func WithHost(host string) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetConfig(host, "httpobfs", "host")
+
+		return nil
+	}
+}
+
+// WithPath set the request path, default /, both ends must agree
+func WithPath(path string) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		if !strings.HasPrefix(path, "/") {
+			return errors.Wrap(stf4go.ErrResource, "invalid httpobfs path %s", path)
+		}
+
+		options.SetConfig(path, "httpobfs", "path")
+
+		return nil
+	}
+}
+
+// WithUserAgent set the request User-Agent, default a desktop browser one
+func WithUserAgent(userAgent string) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetConfig(userAgent, "httpobfs", "useragent")
+
+		return nil
+	}
+}
@@ -0,0 +1,117 @@
+// Package seal the aead cipher state and the length prefixed messages shared by the encrypted tunnel transports
+package seal
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"io"
+	"math"
+
+	"github.com/libs4go/errors"
+)
+
+// TagLen chacha20-poly1305 and aes-gcm have the same tag size
+const TagLen = 16
+
+// MaxMessageLen max length of one message, the length prefix is 2 bytes
+const MaxMessageLen = math.MaxUint16
+
+// MaxPlaintextLen max payload of one sealed message
+const MaxPlaintextLen = MaxMessageLen - TagLen
+
+// CipherState one direction of a conn, the nonce is the seal counter so replayed,
+// reordered or dropped messages fail to decrypt
+type CipherState struct {
+	aead  cipher.AEAD
+	order binary.ByteOrder
+	n     uint64
+}
+
+// NewCipherState create CipherState writing the counter in order to the last 8 nonce bytes,
+// a nil aead passes the plaintext through, as noise does before the first key is mixed
+func NewCipherState(aead cipher.AEAD, order binary.ByteOrder) *CipherState {
+	return &CipherState{
+		aead:  aead,
+		order: order,
+	}
+}
+
+func (cs *CipherState) nonce() []byte {
+	nonce := make([]byte, cs.aead.NonceSize())
+
+	cs.order.PutUint64(nonce[len(nonce)-8:], cs.n)
+
+	return nonce
+}
+
+// Encrypt append the sealed plaintext to out
+func (cs *CipherState) Encrypt(out, ad, plaintext []byte) ([]byte, error) {
+	if cs.aead == nil {
+		return append(out, plaintext...), nil
+	}
+
+	if cs.n == math.MaxUint64 {
+		return nil, errors.New("cipher nonce exhausted")
+	}
+
+	out = cs.aead.Seal(out, cs.nonce(), plaintext, ad)
+
+	cs.n++
+
+	return out, nil
+}
+
+// Decrypt append the opened ciphertext to out
+func (cs *CipherState) Decrypt(out, ad, ciphertext []byte) ([]byte, error) {
+	if cs.aead == nil {
+		return append(out, ciphertext...), nil
+	}
+
+	if cs.n == math.MaxUint64 {
+		return nil, errors.New("cipher nonce exhausted")
+	}
+
+	out, err := cs.aead.Open(out, cs.nonce(), ciphertext, ad)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "decrypt error")
+	}
+
+	cs.n++
+
+	return out, nil
+}
+
+// ReadMessage read one 2 bytes big endian length prefixed message
+func ReadMessage(reader io.Reader) ([]byte, error) {
+	var header [2]byte
+
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, err
+	}
+
+	message := make([]byte, binary.BigEndian.Uint16(header[:]))
+
+	if _, err := io.ReadFull(reader, message); err != nil {
+		return nil, err
+	}
+
+	return message, nil
+}
+
+// WriteMessage write message after its length prefix in one write
+func WriteMessage(writer io.Writer, message []byte) error {
+	if len(message) > MaxMessageLen {
+		return errors.New("message too large")
+	}
+
+	buff := make([]byte, 2+len(message))
+
+	binary.BigEndian.PutUint16(buff, uint16(len(message)))
+
+	copy(buff[2:], message)
+
+	_, err := writer.Write(buff)
+
+	return err
+}
@@ -0,0 +1,87 @@
+package seal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+func newPair(t *testing.T, order binary.ByteOrder) (*CipherState, *CipherState) {
+	key := make([]byte, chacha20poly1305.KeySize)
+
+	send, err := chacha20poly1305.New(key)
+
+	require.NoError(t, err)
+
+	recv, err := chacha20poly1305.New(key)
+
+	require.NoError(t, err)
+
+	return NewCipherState(send, order), NewCipherState(recv, order)
+}
+
+func TestCipherState(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian} {
+		send, recv := newPair(t, order)
+
+		first, err := send.Encrypt(nil, []byte("ad"), []byte("hello"))
+
+		require.NoError(t, err)
+
+		second, err := send.Encrypt(nil, []byte("ad"), []byte("hello"))
+
+		require.NoError(t, err)
+
+		require.NotEqual(t, first, second)
+
+		// out of order
+		_, err = recv.Decrypt(nil, []byte("ad"), second)
+
+		require.Error(t, err)
+
+		plaintext, err := recv.Decrypt(nil, []byte("ad"), first)
+
+		require.NoError(t, err)
+
+		require.Equal(t, "hello", string(plaintext))
+
+		// replayed
+		_, err = recv.Decrypt(nil, []byte("ad"), first)
+
+		require.Error(t, err)
+	}
+
+	plain := NewCipherState(nil, binary.LittleEndian)
+
+	out, err := plain.Encrypt(nil, nil, []byte("hello"))
+
+	require.NoError(t, err)
+
+	require.Equal(t, "hello", string(out))
+}
+
+func TestMessage(t *testing.T) {
+	var buff bytes.Buffer
+
+	require.NoError(t, WriteMessage(&buff, []byte("hello")))
+	require.NoError(t, WriteMessage(&buff, nil))
+
+	require.Error(t, WriteMessage(&buff, make([]byte, MaxMessageLen+1)))
+
+	message, err := ReadMessage(&buff)
+
+	require.NoError(t, err)
+
+	require.Equal(t, "hello", string(message))
+
+	message, err = ReadMessage(&buff)
+
+	require.NoError(t, err)
+
+	require.Empty(t, message)
+
+	require.Equal(t, 0, buff.Len())
+}
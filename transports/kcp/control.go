@@ -0,0 +1,182 @@
+package kcp
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	kcpgo "github.com/xtaci/kcp-go"
+)
+
+// control datagrams share the udp socket with kcp, they are shorter than the kcp header
+// so kcp-go would drop them anyway if one ever slipped through
+var controlMagic = []byte{0xff, 's', 't', 'f'}
+
+const (
+	controlHello byte = iota + 1
+	controlHelloReply
+	controlKeepalive
+	controlChallenge
+	controlChallengeReply
+)
+
+func isControl(packet []byte) bool {
+	return len(packet) > len(controlMagic) && len(packet) < kcpgo.IKCP_OVERHEAD && bytes.HasPrefix(packet, controlMagic)
+}
+
+func newControl(kind byte, payload []byte) []byte {
+	packet := make([]byte, 0, len(controlMagic)+1+len(payload))
+
+	packet = append(packet, controlMagic...)
+	packet = append(packet, kind)
+
+	return append(packet, payload...)
+}
+
+// controlHandler called on the socket read goroutine, it must not block
+type controlHandler func(kind byte, payload []byte, addr net.Addr)
+
+// controlConn net.PacketConn handed to kcp-go, it filters out the control datagrams
+type controlConn struct {
+	net.PacketConn
+	handler controlHandler
+	sync.RWMutex
+	peers    map[string]*peerStats // datagram counters of the watched peers
+	routes   map[string]*route     // outbound sessions dialed from this socket
+	gated    bool                  // listener socket, only pass kcp datagrams from admitted addresses
+	pending  map[string]time.Time
+	inbound  map[string]net.Addr // migrated current address to the session origin address
+	outbound map[string]net.Addr // session origin address to the migrated current address
+}
+
+func newControlConn(conn net.PacketConn, handler controlHandler) *controlConn {
+	return &controlConn{
+		PacketConn: conn,
+		handler:    handler,
+		peers:      make(map[string]*peerStats),
+		routes:     make(map[string]*route),
+		pending:    make(map[string]time.Time),
+		inbound:    make(map[string]net.Addr),
+		outbound:   make(map[string]net.Addr),
+	}
+}
+
+// watch start counting the datagrams of addr
+func (conn *controlConn) watch(addr net.Addr) {
+	conn.Lock()
+	defer conn.Unlock()
+
+	conn.peers[addr.String()] = &peerStats{lastSeen: time.Now().UnixNano()}
+
+	delete(conn.pending, addr.String())
+}
+
+func (conn *controlConn) unwatch(addr net.Addr) {
+	conn.Lock()
+	defer conn.Unlock()
+
+	delete(conn.peers, addr.String())
+
+	if current, ok := conn.outbound[addr.String()]; ok {
+		delete(conn.inbound, current.String())
+		delete(conn.outbound, addr.String())
+	}
+}
+
+// peer the counters of the watched addr, nil if not watched
+func (conn *controlConn) peer(addr net.Addr) *peerStats {
+	conn.RLock()
+	defer conn.RUnlock()
+
+	return conn.peers[addr.String()]
+}
+
+func (conn *controlConn) seen(addr net.Addr) time.Time {
+	if stats := conn.peer(addr); stats != nil {
+		return time.Unix(0, atomic.LoadInt64(&stats.lastSeen))
+	}
+
+	return time.Time{}
+}
+
+func (conn *controlConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := conn.PacketConn.ReadFrom(b)
+
+		if err != nil {
+			return n, addr, err
+		}
+
+		// the settings hello of a peer dialing this address at the same time is answered by the listener
+		if r, ok := conn.getRoute(addr); ok && !(isControl(b[:n]) && b[len(controlMagic)] == controlHello) {
+			r.deliver(b[:n])
+			continue
+		}
+
+		origin := conn.translate(addr)
+
+		if stats := conn.peer(origin); stats != nil {
+			stats.received(n)
+		}
+
+		if !isControl(b[:n]) {
+			if conn.gated && !conn.admitted(origin) {
+				continue
+			}
+
+			return n, origin, nil
+		}
+
+		if conn.handler != nil {
+			payload := make([]byte, n-len(controlMagic)-1)
+
+			copy(payload, b[len(controlMagic)+1:n])
+
+			// control handlers see the real source address
+			conn.handler(b[len(controlMagic)], payload, addr)
+		}
+	}
+}
+
+func (conn *controlConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	conn.RLock()
+	current, ok := conn.outbound[addr.String()]
+	stats := conn.peers[addr.String()]
+	conn.RUnlock()
+
+	if ok {
+		addr = current
+	}
+
+	n, err := conn.PacketConn.WriteTo(b, addr)
+
+	if stats != nil && err == nil {
+		stats.sent(n)
+	}
+
+	return n, err
+}
+
+func (conn *controlConn) writeControl(kind byte, payload []byte, addr net.Addr) error {
+	_, err := conn.WriteTo(newControl(kind, payload), addr)
+
+	return err
+}
+
+func (conn *controlConn) SetReadBuffer(bytes int) error {
+	if socket, ok := conn.PacketConn.(socketBuffer); ok {
+		return socket.SetReadBuffer(bytes)
+	}
+
+	return nil
+}
+
+func (conn *controlConn) SetWriteBuffer(bytes int) error {
+	if socket, ok := conn.PacketConn.(socketBuffer); ok {
+		return socket.SetWriteBuffer(bytes)
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package kcp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+
+	"github.com/libs4go/errors"
+	"github.com/libs4go/stf4go"
+	kcpgo "github.com/xtaci/kcp-go"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const keySalt = "stf4go-transport-kcp"
+const keyCheckPrefix = "stf4go-transport-kcp-key-check"
+
+type blockCipher struct {
+	name   string
+	keyLen int
+	create func(key []byte) (kcpgo.BlockCrypt, error)
+}
+
+// ciphers supported block ciphers, the index is the cipher id exchanged in the settings hello
+var ciphers = []blockCipher{
+	{"none", 0, nil},
+	{"aes", 32, kcpgo.NewAESBlockCrypt},
+	{"aes-128", 16, kcpgo.NewAESBlockCrypt},
+	{"aes-192", 24, kcpgo.NewAESBlockCrypt},
+	{"salsa20", 32, kcpgo.NewSalsa20BlockCrypt},
+	{"blowfish", 32, kcpgo.NewBlowfishBlockCrypt},
+	{"twofish", 32, kcpgo.NewTwofishBlockCrypt},
+	{"cast5", 16, kcpgo.NewCast5BlockCrypt},
+	{"3des", 24, kcpgo.NewTripleDESBlockCrypt},
+	{"tea", 16, kcpgo.NewTEABlockCrypt},
+	{"xtea", 16, kcpgo.NewXTEABlockCrypt},
+	{"sm4", 16, kcpgo.NewSM4BlockCrypt},
+	{"xor", 32, kcpgo.NewSimpleXORBlockCrypt},
+}
+
+func cipherID(name string) (int, bool) {
+	for i, c := range ciphers {
+		if c.name == name {
+			return i, true
+		}
+	}
+
+	return 0, false
+}
+
+func cipherName(id int) string {
+	if id < 0 || id >= len(ciphers) {
+		return "unknown"
+	}
+
+	return ciphers[id].name
+}
+
+// getBlockCrypt create the configured block crypt, the key check value sent in the settings hello
+// and the psk derived key, which is nil without crypt
+func getBlockCrypt(options *stf4go.Options) (kcpgo.BlockCrypt, int, []byte, []byte, error) {
+	name := options.Config.Get("kcp", "crypt").String("none")
+
+	id, ok := cipherID(name)
+
+	if !ok {
+		return nil, 0, nil, nil, errors.Wrap(stf4go.ErrResource, "unknown kcp crypt %s", name)
+	}
+
+	if ciphers[id].create == nil {
+		return nil, id, make([]byte, keyCheckLen), nil, nil
+	}
+
+	psk := options.Config.Get("kcp", "psk").String("")
+
+	if psk == "" {
+		return nil, 0, nil, nil, errors.Wrap(stf4go.ErrResource, "kcp crypt %s expect psk", name)
+	}
+
+	derived := pbkdf2.Key([]byte(psk), []byte(keySalt), 4096, 32, sha1.New)
+
+	block, err := ciphers[id].create(derived[:ciphers[id].keyLen])
+
+	if err != nil {
+		return nil, 0, nil, nil, errors.Wrap(err, "create kcp crypt %s error", name)
+	}
+
+	mac := hmac.New(sha256.New, derived)
+
+	mac.Write([]byte(keyCheckPrefix))
+
+	return block, id, mac.Sum(nil)[:keyCheckLen], derived, nil
+}
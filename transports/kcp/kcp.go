@@ -2,7 +2,14 @@ package kcp
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/libs4go/errors"
 	"github.com/libs4go/slf4go"
@@ -37,11 +44,14 @@ func init() {
 
 type kcpTransport struct {
 	slf4go.Logger
+	sync.RWMutex
+	listeners map[string]*kcpListener // listeners by /kcp terminated addr, for dials sharing the socket
 }
 
 func newKCPTransport() *kcpTransport {
 	return &kcpTransport{
-		Logger: slf4go.Get("stf4go-transport-kcp"),
+		Logger:    slf4go.Get("stf4go-transport-kcp"),
+		listeners: make(map[string]*kcpListener),
 	}
 }
 
@@ -71,25 +81,70 @@ func (transport *kcpTransport) Listen(laddr multiaddr.Multiaddr, options *stf4go
 
 	transport.I("listen on {@laddr}", addr.String())
 
-	listener, err := kcpgo.Listen(addr.String())
+	settings, err := getSettings(options)
+
+	if err != nil {
+		return nil, err
+	}
+
+	tuning := getTuning(options)
+
+	migrationKey, err := getMigrationKey(options, settings, tuning, false)
+
+	if err != nil {
+		return nil, err
+	}
+
+	udpConn, err := net.ListenUDP(network, addr)
 
 	if err != nil {
 		return nil, errors.Wrap(err, "listen %s error", addr.String())
 	}
 
+	kl := &kcpListener{
+		Logger:    transport.Logger,
+		transport: transport,
+		settings:  settings,
+		tuning:    tuning,
+		migration: newMigration(migrationKey),
+		mismatch:  getMismatchHandler(options),
+		accepted:  make(chan *kcpgo.UDPSession),
+		errs:      make(chan error, 1),
+		closed:    make(chan struct{}),
+	}
+
+	kl.conn = newControlConn(udpConn, kl.handleControl)
+	// only admit the addresses that sent a matching settings hello, plain kcp-go clients can not use crypt anyway
+	kl.conn.gated = settings.block != nil
+
+	if err := kl.tuning.applySocket(kl.conn); err != nil {
+		udpConn.Close()
+		return nil, errors.Wrap(err, "set listener %s socket buffer error", addr.String())
+	}
+
+	listener, err := kcpgo.ServeConn(settings.block, settings.dataShards, settings.parityShards, kl.conn)
+
+	if err != nil {
+		udpConn.Close()
+		return nil, errors.Wrap(err, "listen %s error", addr.String())
+	}
+
+	kl.listener = listener
+
 	maddr, err := manet.FromNetAddr(listener.Addr())
 
 	if err != nil {
+		listener.Close()
 		return nil, errors.Wrap(err, "convert laddr %s to multiaddr error", listener.Addr().String())
 	}
 
-	maddr = maddr.Encapsulate(kcpMultiAddr)
+	kl.addr = maddr.Encapsulate(kcpMultiAddr)
+
+	transport.addListener(kl)
 
-	return &kcpListener{
-		Logger:   transport.Logger,
-		listener: listener,
-		addr:     maddr,
-	}, nil
+	go kl.acceptLoop()
+
+	return kl, nil
 }
 
 func (transport *kcpTransport) Dial(ctx context.Context, raddr multiaddr.Multiaddr, options *stf4go.Options) (stf4go.Conn, error) {
@@ -108,39 +163,230 @@ func (transport *kcpTransport) Dial(ctx context.Context, raddr multiaddr.Multiad
 
 	transport.I("dial to {@laddr}", addr.String())
 
-	conn, err := kcpgo.Dial(addr.String())
+	settings, err := getSettings(options)
+
+	if err != nil {
+		return nil, err
+	}
+
+	tuning := getTuning(options)
+
+	migrationKey, err := getMigrationKey(options, settings, tuning, true)
 
 	if err != nil {
+		return nil, err
+	}
+
+	var conv uint32
+
+	if err := binary.Read(rand.Reader, binary.LittleEndian, &conv); err != nil {
+		return nil, errors.Wrap(err, "generate kcp conv error")
+	}
+
+	packetConn, err := transport.dialConn(network, addr, tuning, options, conv)
+
+	if err != nil {
+		return nil, err
+	}
+
+	remoteConv, remoteFixed, err := settings.hello(ctx, packetConn, addr, conv)
+
+	if err != nil {
+		packetConn.Close()
+		return nil, err
+	}
+
+	if r, ok := packetConn.(*route); ok {
+		conv = r.agree(remoteConv, remoteFixed)
+	}
+
+	migration := &migrationClient{key: migrationKey}
+
+	control := newControlConn(packetConn, migration.handleControl)
+
+	migration.control = control
+
+	conn, err := kcpgo.NewConn3(conv, addr, settings.block, settings.dataShards, settings.parityShards, control)
+
+	if err != nil {
+		packetConn.Close()
 		return nil, errors.Wrap(err, "kcp dial to %s error", addr.String())
 	}
 
+	migration.setConv(conn.GetConv())
+
+	tuning.applySession(conn)
+
 	transport.I("dial to {@laddr} -- success", addr.String())
 
-	return newKCPConn(conn)
+	kc, err := newKCPConn(transport.Logger, conn, control, migration.keepalivePayload)
+
+	if err != nil {
+		return nil, err
+	}
+
+	kc.start(tuning)
+
+	return kc, nil
+}
+
+// dialConn open the socket for one dial, it is a route on the shared listener socket if configured
+func (transport *kcpTransport) dialConn(network string, addr *net.UDPAddr, tuning *tuning, options *stf4go.Options, conv uint32) (net.PacketConn, error) {
+	if shared := options.Config.Get("kcp", "shared").String(""); shared != "" {
+		listener, err := transport.getListener(shared)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return listener.conn.newRoute(addr, conv)
+	}
+
+	udpConn, err := net.ListenUDP(network, nil)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "kcp dial to %s error", addr.String())
+	}
+
+	if err := tuning.applySocket(udpConn); err != nil {
+		udpConn.Close()
+		return nil, errors.Wrap(err, "set conn %s socket buffer error", addr.String())
+	}
+
+	return udpConn, nil
 }
 
 type kcpListener struct {
 	slf4go.Logger
-	listener net.Listener
-	addr     multiaddr.Multiaddr
+	transport *kcpTransport
+	listener  *kcpgo.Listener
+	conn      *controlConn
+	addr      multiaddr.Multiaddr
+	settings  *settings
+	tuning    *tuning
+	migration *migration
+	mismatch  MismatchHandler
+	accepted  chan *kcpgo.UDPSession
+	errs      chan error
+	closed    chan struct{}
+	once      sync.Once
+}
+
+func (listener *kcpListener) handleControl(kind byte, payload []byte, addr net.Addr) {
+	switch kind {
+	case controlHello:
+		listener.handleHello(payload, addr)
+	case controlKeepalive:
+		if conv, nonce, ok := listener.migration.keepalive(payload, addr); ok {
+			listener.I("kcp session {@conv} challenge new path {@raddr}", conv, addr.String())
+
+			listener.conn.writeControl(controlChallenge, convPayload(conv, nonce), addr)
+		}
+	case controlChallengeReply:
+		if conn, ok := listener.migration.challengeReply(payload, addr); ok {
+			listener.I("kcp session {@conv} migrate to {@raddr}", conn.session.GetConv(), addr.String())
+
+			listener.conn.rebind(conn.session.RemoteAddr(), addr)
+
+			conn.setRemoteAddr(addr)
+		}
+	}
+}
+
+func (listener *kcpListener) handleHello(payload []byte, addr net.Addr) {
+	remote, remoteConv, _, err := unmarshalHello(payload)
+
+	var conv uint32
+	var fixed bool
+
+	if r, ok := listener.conn.getRoute(addr); ok && err == nil {
+		conv, fixed = r.offer(remoteConv)
+	}
+
+	if err := listener.conn.writeControl(controlHelloReply, listener.settings.helloPayload(conv, fixed), addr); err != nil {
+		listener.E("send settings hello reply to {@raddr} error {@err}", addr.String(), err)
+		return
+	}
+
+	if err == nil {
+		err = listener.settings.check(remote)
+	}
+
+	if err != nil {
+		// the dialer sees the mismatch from the reply, Accept only returns listener failures
+		listener.W("drop settings hello from {@raddr} error {@err}", addr.String(), err)
+
+		if listener.mismatch != nil {
+			if raddr, convErr := manet.FromNetAddr(addr); convErr == nil {
+				// the handler must not stall the socket read loop
+				go listener.mismatch(raddr.Encapsulate(kcpMultiAddr), err)
+			}
+		}
+
+		return
+	}
+
+	listener.conn.admit(addr)
+}
+
+func (listener *kcpListener) acceptLoop() {
+	for {
+		conn, err := listener.listener.AcceptKCP()
+
+		if err != nil {
+			select {
+			case listener.errs <- err:
+			case <-listener.closed:
+			}
+
+			return
+		}
+
+		select {
+		case listener.accepted <- conn:
+		case <-listener.closed:
+			conn.Close()
+			return
+		}
+	}
 }
 
 func (listener *kcpListener) Close() error {
+	listener.once.Do(func() {
+		close(listener.closed)
+		listener.transport.removeListener(listener)
+	})
+
 	return listener.listener.Close()
 }
 
 func (listener *kcpListener) Accept() (stf4go.Conn, error) {
-	listener.I("listener {@laddr} start accept", listener.listener.Addr().String())
+	listener.I("listener {@laddr} start accept", listener.addr.String())
 
-	conn, err := listener.listener.Accept()
+	select {
+	case conn := <-listener.accepted:
+		listener.I("listener {@laddr} recv conn", listener.addr.String())
 
-	listener.I("listener {@laddr} recv conn", listener.listener.Addr().String())
+		listener.tuning.applySession(conn)
 
-	if err != nil {
+		kc, err := newKCPConn(listener.Logger, conn, listener.conn, nil)
+
+		if err != nil {
+			return nil, err
+		}
+
+		listener.migration.add(kc)
+
+		kc.onClose = listener.migration.remove
+
+		kc.start(listener.tuning)
+
+		return kc, nil
+	case err := <-listener.errs:
 		return nil, errors.Wrap(err, "call accept on listener %s error", listener.addr.String())
+	case <-listener.closed:
+		return nil, errors.Wrap(io.ErrClosedPipe, "call accept on listener %s error", listener.addr.String())
 	}
-
-	return newKCPConn(conn)
 }
 
 func (listener *kcpListener) Addr() multiaddr.Multiaddr {
@@ -149,47 +395,162 @@ func (listener *kcpListener) Addr() multiaddr.Multiaddr {
 
 type kcpConn struct {
 	net.Conn
-	laddr multiaddr.Multiaddr
-	raddr multiaddr.Multiaddr
+	logger  slf4go.Logger
+	session *kcpgo.UDPSession
+	control *controlConn
+	laddr   multiaddr.Multiaddr
+	raddr   atomic.Value // multiaddr.Multiaddr of the current path
+	current atomic.Value // net.Addr of the current path
+	payload func() []byte
+	onClose func(conn *kcpConn)
+	sndWnd  int
+	rcvWnd  int
+	closed  chan struct{}
+	once    sync.Once
 }
 
-func newKCPConn(conn net.Conn) (*kcpConn, error) {
+func newKCPConn(logger slf4go.Logger, conn *kcpgo.UDPSession, control *controlConn, payload func() []byte) (*kcpConn, error) {
 
 	laddr, err := manet.FromNetAddr(conn.LocalAddr())
 
 	if err != nil {
+		conn.Close()
 		return nil, errors.Wrap(err, "convert laddr %s to multiaddr error", conn.LocalAddr().String())
 	}
 
 	laddr = laddr.Encapsulate(kcpMultiAddr)
 
-	raddr, err := manet.FromNetAddr(conn.RemoteAddr())
+	kc := &kcpConn{
+		Conn:    conn,
+		logger:  logger,
+		session: conn,
+		control: control,
+		laddr:   laddr,
+		payload: payload,
+		closed:  make(chan struct{}),
+	}
+
+	if err := kc.setRemoteAddr(conn.RemoteAddr()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	control.watch(conn.RemoteAddr())
+
+	return kc, nil
+}
+
+// start the keepalive, call it once the conn is set up
+func (conn *kcpConn) start(tuning *tuning) {
+	conn.sndWnd = tuning.sndWnd
+	conn.rcvWnd = tuning.rcvWnd
+
+	if tuning.keepalive > 0 {
+		go conn.keepalive(tuning.keepalive, tuning.deadTimeout)
+	}
+}
+
+func (conn *kcpConn) setRemoteAddr(addr net.Addr) error {
+	raddr, err := manet.FromNetAddr(addr)
 
 	if err != nil {
-		return nil, errors.Wrap(err, "convert laddr %s to multiaddr error", conn.LocalAddr().String())
+		return errors.Wrap(err, "convert raddr %s to multiaddr error", addr.String())
+	}
+
+	conn.raddr.Store(raddr.Encapsulate(kcpMultiAddr))
+	conn.current.Store(addr)
+
+	return nil
+}
+
+func (conn *kcpConn) remoteNetAddr() net.Addr {
+	return conn.current.Load().(net.Addr)
+}
+
+// keepalive send keepalive datagrams and close the session once the peer is silent longer than timeout,
+// kcp itself never notices a vanished peer while idle. the dialer keepalive also carries the migration token proof
+func (conn *kcpConn) keepalive(interval time.Duration, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		raddr := conn.session.RemoteAddr()
+
+		if timeout > 0 && time.Since(conn.control.seen(raddr)) > timeout {
+			conn.logger.W("close kcp conn {@raddr}, peer silent for {@timeout}", conn.remoteNetAddr().String(), timeout.String())
+			conn.Close()
+			return
+		}
+
+		var payload []byte
+
+		if conn.payload != nil {
+			payload = conn.payload()
+		}
+
+		if err := conn.control.writeControl(controlKeepalive, payload, raddr); err != nil {
+			conn.logger.W("send keepalive to {@raddr} error {@err}", conn.remoteNetAddr().String(), err)
+		}
+
+		select {
+		case <-conn.closed:
+			return
+		case <-ticker.C:
+		}
 	}
+}
+
+func (conn *kcpConn) Close() error {
+	conn.once.Do(func() {
+		close(conn.closed)
+		conn.control.unwatch(conn.session.RemoteAddr())
 
-	raddr = raddr.Encapsulate(kcpMultiAddr)
+		if conn.onClose != nil {
+			conn.onClose(conn)
+		}
+	})
 
-	return &kcpConn{
-		Conn:  conn,
-		laddr: laddr,
-		raddr: raddr,
-	}, nil
+	return conn.session.Close()
 }
 
 func (conn *kcpConn) LocalAddr() multiaddr.Multiaddr {
 	return conn.laddr
 }
 
+// RemoteAddr the current path of the session, it changes after a connection migration
 func (conn *kcpConn) RemoteAddr() multiaddr.Multiaddr {
-	return conn.raddr
+	return conn.raddr.Load().(multiaddr.Multiaddr)
 }
 
 func (conn *kcpConn) Underlying() stf4go.Conn {
 	return nil
 }
 
+// SyscallConn the raw udp socket, a listener socket is shared by all its sessions and the dials from it
+func (conn *kcpConn) SyscallConn() (syscall.RawConn, error) {
+	return conn.control.SyscallConn()
+}
+
+func (conn *kcpConn) Stats() *Stats {
+	stats := &Stats{}
+
+	if peer := conn.control.peer(conn.session.RemoteAddr()); peer != nil {
+		stats = peer.snapshot()
+	}
+
+	stats.SndWnd = conn.sndWnd
+	stats.RcvWnd = conn.rcvWnd
+
+	return stats
+}
+
 func init() {
 	stf4go.RegisterTransport(newKCPTransport())
 }
+
+// Conn .
+type Conn interface {
+	stf4go.Conn
+	// Stats snapshot of the kcp session statistics
+	Stats() *Stats
+}
@@ -2,15 +2,23 @@ package kcp
 
 import (
 	"context"
+	"io"
+	"net"
+	"reflect"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/libs4go/errors"
 	"github.com/libs4go/scf4go"
 	"github.com/libs4go/scf4go/reader/memory"
 	"github.com/libs4go/slf4go"
 	_ "github.com/libs4go/slf4go/backend/console" //
 	"github.com/libs4go/stf4go"
 	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr-net"
 	"github.com/stretchr/testify/require"
+	kcpgo "github.com/xtaci/kcp-go"
 )
 
 var loggerjson = `
@@ -59,7 +67,12 @@ func TestListenConnect(t *testing.T) {
 
 	go func() {
 
-		_, err := stf4go.Dial(context.Background(), laddr)
+		conn, err := stf4go.Dial(context.Background(), laddr)
+
+		require.NoError(t, err)
+
+		// kcp listener only sees the session after the first packet
+		_, err = conn.Write([]byte("hello"))
 
 		require.NoError(t, err)
 	}()
@@ -68,3 +81,735 @@ func TestListenConnect(t *testing.T) {
 
 	require.NoError(t, err)
 }
+
+func kcpField(session *kcpgo.UDPSession, name string) reflect.Value {
+	return reflect.ValueOf(session).Elem().FieldByName("kcp").Elem().FieldByName(name)
+}
+
+func TestTuning(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/udp/1819/kcp")
+
+	require.NoError(t, err)
+
+	listener, err := stf4go.Listen(laddr,
+		WithNoDelay(1, 20, 2, 1),
+		WithWindowSize(256, 512),
+		WithMTU(1200),
+		WithStreamMode(true),
+		WithSocketBuffer(1<<20, 1<<20))
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	go func() {
+		conn, err := stf4go.Dial(context.Background(), laddr, WithWindowSize(128, 1024), WithACKNoDelay(true))
+
+		require.NoError(t, err)
+
+		session := conn.(*kcpConn).session
+
+		require.Equal(t, uint64(128), kcpField(session, "snd_wnd").Uint())
+		require.Equal(t, uint64(1024), kcpField(session, "rcv_wnd").Uint())
+		require.Equal(t, uint64(kcpgo.IKCP_MTU_DEF), kcpField(session, "mtu").Uint())
+		require.True(t, reflect.ValueOf(session).Elem().FieldByName("ackNoDelay").Bool())
+
+		_, err = conn.Write([]byte("hello"))
+
+		require.NoError(t, err)
+	}()
+
+	conn, err := listener.Accept()
+
+	require.NoError(t, err)
+
+	session := conn.(*kcpConn).session
+
+	require.Equal(t, uint64(1), kcpField(session, "nodelay").Uint())
+	require.Equal(t, uint64(20), kcpField(session, "interval").Uint())
+	require.Equal(t, int64(2), kcpField(session, "fastresend").Int())
+	require.Equal(t, int64(1), kcpField(session, "nocwnd").Int())
+	require.Equal(t, uint64(256), kcpField(session, "snd_wnd").Uint())
+	require.Equal(t, uint64(512), kcpField(session, "rcv_wnd").Uint())
+	require.Equal(t, uint64(1200), kcpField(session, "mtu").Uint())
+	require.Equal(t, int64(1), kcpField(session, "stream").Int())
+	require.False(t, reflect.ValueOf(session).Elem().FieldByName("ackNoDelay").Bool())
+
+	var buff [5]byte
+
+	_, err = io.ReadFull(conn, buff[:])
+
+	require.NoError(t, err)
+
+	require.Equal(t, "hello", string(buff[:]))
+}
+
+func TestFECCrypt(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/udp/1820/kcp")
+
+	require.NoError(t, err)
+
+	listener, err := stf4go.Listen(laddr, WithFEC(10, 3), WithCrypt("aes"), WithPSK("secret"))
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	go func() {
+		conn, err := stf4go.Dial(context.Background(), laddr, WithFEC(10, 3), WithCrypt("aes"), WithPSK("secret"))
+
+		require.NoError(t, err)
+
+		_, err = conn.Write([]byte("hello"))
+
+		require.NoError(t, err)
+	}()
+
+	conn, err := listener.Accept()
+
+	require.NoError(t, err)
+
+	var buff [5]byte
+
+	_, err = io.ReadFull(conn, buff[:])
+
+	require.NoError(t, err)
+
+	require.Equal(t, "hello", string(buff[:]))
+}
+
+func TestSettingsMismatch(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/udp/1821/kcp")
+
+	require.NoError(t, err)
+
+	reported := make(chan error, 16)
+
+	listener, err := stf4go.Listen(laddr, WithFEC(10, 3), WithCrypt("aes"), WithPSK("secret"),
+		WithMismatchHandler(func(raddr multiaddr.Multiaddr, err error) {
+			reported <- err
+		}))
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	mismatches := [][]stf4go.Option{
+		{WithCrypt("aes"), WithPSK("secret")},
+		{WithFEC(10, 3), WithCrypt("salsa20"), WithPSK("secret")},
+		{WithFEC(10, 3), WithCrypt("aes"), WithPSK("other")},
+	}
+
+	for _, options := range mismatches {
+		_, err := stf4go.Dial(context.Background(), laddr, options...)
+
+		require.True(t, errors.Is(err, ErrSettings))
+
+		// the listener side sees the mismatch too
+		select {
+		case err := <-reported:
+			require.True(t, errors.Is(err, ErrSettings))
+		case <-time.After(time.Second):
+			require.Fail(t, "settings mismatch not reported on the listener side")
+		}
+	}
+
+	_, err = stf4go.Dial(context.Background(), laddr, WithCrypt("aes"))
+
+	require.True(t, errors.Is(err, stf4go.ErrResource))
+
+	// mismatched hellos are dropped, the listener keeps accepting matching peers
+	go func() {
+		conn, err := stf4go.Dial(context.Background(), laddr, WithFEC(10, 3), WithCrypt("aes"), WithPSK("secret"))
+
+		require.NoError(t, err)
+
+		_, err = conn.Write([]byte("hello"))
+
+		require.NoError(t, err)
+	}()
+
+	conn, err := listener.Accept()
+
+	require.NoError(t, err)
+
+	var buff [5]byte
+
+	_, err = io.ReadFull(conn, buff[:])
+
+	require.NoError(t, err)
+
+	require.Equal(t, "hello", string(buff[:]))
+}
+
+func TestPlainClient(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/udp/1876/kcp")
+
+	require.NoError(t, err)
+
+	listener, err := stf4go.Listen(laddr)
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+
+		require.NoError(t, err)
+
+		io.Copy(conn, conn)
+	}()
+
+	// no crypt configured, kcp-go clients without the settings hello are served
+	conn, err := kcpgo.DialWithOptions("127.0.0.1:1876", nil, 0, 0)
+
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello"))
+
+	require.NoError(t, err)
+
+	var buff [5]byte
+
+	_, err = io.ReadFull(conn, buff[:])
+
+	require.NoError(t, err)
+
+	require.Equal(t, "hello", string(buff[:]))
+}
+
+func TestStats(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/udp/1822/kcp")
+
+	require.NoError(t, err)
+
+	listener, err := stf4go.Listen(laddr, WithWindowSize(64, 128))
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+
+		require.NoError(t, err)
+
+		io.Copy(conn, conn)
+	}()
+
+	conn, err := stf4go.Dial(context.Background(), laddr, WithWindowSize(32, 256))
+
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	for i := 0; i < 10; i++ {
+		_, err = conn.Write([]byte("hello"))
+
+		require.NoError(t, err)
+
+		var buff [5]byte
+
+		_, err = io.ReadFull(conn, buff[:])
+
+		require.NoError(t, err)
+	}
+
+	stats := conn.(Conn).Stats()
+
+	require.Equal(t, 32, stats.SndWnd)
+	require.Equal(t, 256, stats.RcvWnd)
+
+	// the echoes came back, so at least the data segments were counted both ways
+	require.True(t, stats.PacketsOut >= 10)
+	require.True(t, stats.PacketsIn >= 10)
+	require.True(t, stats.BytesOut >= 10*(kcpgo.IKCP_OVERHEAD+5))
+	require.True(t, stats.BytesIn >= 10*(kcpgo.IKCP_OVERHEAD+5))
+
+	require.WithinDuration(t, time.Now(), stats.LastSeen, time.Second)
+
+	require.True(t, SNMP().OutSegs > 0)
+}
+
+func TestDeadPeer(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/udp/1823/kcp")
+
+	require.NoError(t, err)
+
+	listener, err := stf4go.Listen(laddr, WithKeepalive(50*time.Millisecond, 300*time.Millisecond))
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	go func() {
+		// keepalive disabled, the client looks dead after the first write
+		conn, err := stf4go.Dial(context.Background(), laddr, WithKeepalive(0, 0))
+
+		require.NoError(t, err)
+
+		_, err = conn.Write([]byte("hello"))
+
+		require.NoError(t, err)
+	}()
+
+	conn, err := listener.Accept()
+
+	require.NoError(t, err)
+
+	var buff [5]byte
+
+	_, err = io.ReadFull(conn, buff[:])
+
+	require.NoError(t, err)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	start := time.Now()
+
+	_, err = conn.Read(buff[:])
+
+	require.Error(t, err)
+
+	require.True(t, time.Since(start) < 2*time.Second)
+}
+
+func TestSharedSocket(t *testing.T) {
+
+	laddrA, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/udp/1824/kcp")
+
+	require.NoError(t, err)
+
+	laddrB, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/udp/1825/kcp")
+
+	require.NoError(t, err)
+
+	listenerA, err := stf4go.Listen(laddrA)
+
+	require.NoError(t, err)
+
+	defer listenerA.Close()
+
+	listenerB, err := stf4go.Listen(laddrB)
+
+	require.NoError(t, err)
+
+	defer listenerB.Close()
+
+	go func() {
+		conn, err := listenerB.Accept()
+
+		require.NoError(t, err)
+
+		io.Copy(conn, conn)
+	}()
+
+	go func() {
+		conn, err := listenerA.Accept()
+
+		require.NoError(t, err)
+
+		io.Copy(conn, conn)
+	}()
+
+	echo := func(conn stf4go.Conn) {
+		_, err := conn.Write([]byte("hello"))
+
+		require.NoError(t, err)
+
+		var buff [5]byte
+
+		_, err = io.ReadFull(conn, buff[:])
+
+		require.NoError(t, err)
+
+		require.Equal(t, "hello", string(buff[:]))
+	}
+
+	// dial B from the socket of listener A, B sees A's listen port
+	conn, err := stf4go.Dial(context.Background(), laddrB, WithSharedSocket(laddrA))
+
+	require.NoError(t, err)
+
+	require.Equal(t, laddrA.String(), conn.LocalAddr().String())
+
+	echo(conn)
+
+	_, err = stf4go.Dial(context.Background(), laddrB, WithSharedSocket(laddrA))
+
+	require.True(t, errors.Is(err, errRouteExists))
+
+	// listener A still accepts inbound sessions on the shared socket
+	inbound, err := stf4go.Dial(context.Background(), laddrA)
+
+	require.NoError(t, err)
+
+	echo(inbound)
+
+	inbound.Close()
+
+	require.NoError(t, conn.Close())
+
+	unbound, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/udp/1826/kcp")
+
+	require.NoError(t, err)
+
+	_, err = stf4go.Dial(context.Background(), laddrB, WithSharedSocket(unbound))
+
+	require.True(t, errors.Is(err, stf4go.ErrResource))
+}
+
+func TestSimultaneousDial(t *testing.T) {
+
+	laddrA, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/udp/1871/kcp")
+
+	require.NoError(t, err)
+
+	laddrB, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/udp/1872/kcp")
+
+	require.NoError(t, err)
+
+	listenerA, err := stf4go.Listen(laddrA)
+
+	require.NoError(t, err)
+
+	defer listenerA.Close()
+
+	listenerB, err := stf4go.Listen(laddrB)
+
+	require.NoError(t, err)
+
+	defer listenerB.Close()
+
+	// both ends dial each other from their listener sockets, as in nat hole punching
+	conns := make(chan stf4go.Conn, 2)
+
+	dial := func(raddr, laddr multiaddr.Multiaddr) {
+		conn, err := stf4go.Dial(context.Background(), raddr, WithSharedSocket(laddr))
+
+		require.NoError(t, err)
+
+		conns <- conn
+	}
+
+	go dial(laddrB, laddrA)
+	go dial(laddrA, laddrB)
+
+	connA, connB := <-conns, <-conns
+
+	defer connA.Close()
+	defer connB.Close()
+
+	_, err = connA.Write([]byte("hello"))
+
+	require.NoError(t, err)
+
+	var buff [5]byte
+
+	_, err = io.ReadFull(connB, buff[:])
+
+	require.NoError(t, err)
+
+	require.Equal(t, "hello", string(buff[:]))
+
+	_, err = connB.Write([]byte("world"))
+
+	require.NoError(t, err)
+
+	_, err = io.ReadFull(connA, buff[:])
+
+	require.NoError(t, err)
+
+	require.Equal(t, "world", string(buff[:]))
+}
+
+func TestRouteDeadline(t *testing.T) {
+	udpConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+
+	require.NoError(t, err)
+
+	shared := newControlConn(udpConn, nil)
+
+	defer shared.Close()
+
+	r, err := shared.newRoute(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1873}, 1)
+
+	require.NoError(t, err)
+
+	read := make(chan error, 1)
+
+	go func() {
+		_, _, err := r.ReadFrom(make([]byte, 1))
+
+		read <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	// the deadline set after ReadFrom blocked still applies
+	require.NoError(t, r.SetReadDeadline(time.Now()))
+
+	select {
+	case err := <-read:
+		ne, ok := err.(net.Error)
+
+		require.True(t, ok && ne.Timeout())
+	case <-time.After(time.Second):
+		require.Fail(t, "blocked ReadFrom ignores the new deadline")
+	}
+}
+
+// natProxy forwards datagrams between one client and the target, rebind switches the
+// outbound socket like a nat changing the client mapping
+type natProxy struct {
+	sync.Mutex
+	listen   *net.UDPConn
+	target   *net.UDPAddr
+	client   net.Addr
+	outbound *net.UDPConn
+}
+
+func newNATProxy(t *testing.T, listen string, target string) *natProxy {
+	laddr, err := net.ResolveUDPAddr("udp4", listen)
+
+	require.NoError(t, err)
+
+	taddr, err := net.ResolveUDPAddr("udp4", target)
+
+	require.NoError(t, err)
+
+	conn, err := net.ListenUDP("udp4", laddr)
+
+	require.NoError(t, err)
+
+	proxy := &natProxy{
+		listen: conn,
+		target: taddr,
+	}
+
+	proxy.rebind(t)
+
+	go func() {
+		buff := make([]byte, 2048)
+
+		for {
+			n, addr, err := conn.ReadFrom(buff)
+
+			if err != nil {
+				return
+			}
+
+			proxy.Lock()
+			proxy.client = addr
+			outbound := proxy.outbound
+			proxy.Unlock()
+
+			outbound.WriteTo(buff[:n], taddr)
+		}
+	}()
+
+	return proxy
+}
+
+func (proxy *natProxy) rebind(t *testing.T) *net.UDPAddr {
+	outbound, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+
+	require.NoError(t, err)
+
+	proxy.Lock()
+	previous := proxy.outbound
+	proxy.outbound = outbound
+	proxy.Unlock()
+
+	if previous != nil {
+		previous.Close()
+	}
+
+	go func() {
+		buff := make([]byte, 2048)
+
+		for {
+			n, _, err := outbound.ReadFrom(buff)
+
+			if err != nil {
+				return
+			}
+
+			proxy.Lock()
+			client := proxy.client
+			proxy.Unlock()
+
+			proxy.listen.WriteTo(buff[:n], client)
+		}
+	}()
+
+	return outbound.LocalAddr().(*net.UDPAddr)
+}
+
+func (proxy *natProxy) Close() {
+	proxy.Lock()
+	defer proxy.Unlock()
+
+	proxy.listen.Close()
+	proxy.outbound.Close()
+}
+
+func TestMigration(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/udp/1827/kcp")
+
+	require.NoError(t, err)
+
+	proxyAddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/udp/1828/kcp")
+
+	require.NoError(t, err)
+
+	listener, err := stf4go.Listen(laddr, WithKeepalive(50*time.Millisecond, 5*time.Second), WithCrypt("aes"), WithPSK("secret"), WithMigration(true))
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	proxy := newNATProxy(t, "127.0.0.1:1828", "127.0.0.1:1827")
+
+	defer proxy.Close()
+
+	accepted := make(chan stf4go.Conn, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+
+		require.NoError(t, err)
+
+		accepted <- conn
+
+		io.Copy(conn, conn)
+	}()
+
+	conn, err := stf4go.Dial(context.Background(), proxyAddr, WithKeepalive(50*time.Millisecond, 5*time.Second), WithCrypt("aes"), WithPSK("secret"), WithMigration(true))
+
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	echo := func() {
+		_, err := conn.Write([]byte("hello"))
+
+		require.NoError(t, err)
+
+		var buff [5]byte
+
+		_, err = io.ReadFull(conn, buff[:])
+
+		require.NoError(t, err)
+
+		require.Equal(t, "hello", string(buff[:]))
+	}
+
+	echo()
+
+	server := <-accepted
+
+	newAddr := proxy.rebind(t)
+
+	require.NotEqual(t, newAddr.String(), server.RemoteAddr().String())
+
+	echo()
+
+	expect, err := manet.FromNetAddr(newAddr)
+
+	require.NoError(t, err)
+
+	require.Equal(t, expect.Encapsulate(kcpMultiAddr).String(), server.RemoteAddr().String())
+}
+
+func TestMigrationProof(t *testing.T) {
+	key := []byte("psk derived key")
+
+	m := newMigration(key)
+
+	udpConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+
+	require.NoError(t, err)
+
+	defer udpConn.Close()
+
+	session, err := kcpgo.NewConn3(7, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1874}, nil, 0, 0, udpConn)
+
+	require.NoError(t, err)
+
+	kc, err := newKCPConn(slf4go.Get("test"), session, newControlConn(udpConn, nil), nil)
+
+	require.NoError(t, err)
+
+	defer kc.Close()
+
+	m.add(kc)
+
+	client := &migrationClient{key: key}
+
+	client.setConv(7)
+
+	newAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1875}
+
+	// the keepalive proves the token without carrying it
+	keepalive := client.keepalivePayload()
+
+	_, _, ok := m.keepalive(convPayload(7, migrationToken(key, 7)[:proofLen]), newAddr)
+
+	require.False(t, ok)
+
+	conv, nonce, ok := m.keepalive(keepalive, newAddr)
+
+	require.True(t, ok)
+
+	// echoing the observed nonce is not a proof
+	forged := convPayload(conv, append(append([]byte{}, nonce...), make([]byte, proofLen-nonceLen)...))
+
+	_, ok = m.challengeReply(forged, newAddr)
+
+	require.False(t, ok)
+
+	conn, ok := m.challengeReply(convPayload(conv, tokenProof(client.token, nonce)), newAddr)
+
+	require.True(t, ok)
+
+	require.True(t, conn == kc)
+
+	// without the psk derived key there is no migration
+	_, _, ok = newMigration(nil).keepalive(keepalive, newAddr)
+
+	require.False(t, ok)
+}
+
+func TestMigrationOptions(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/udp/1885/kcp")
+
+	require.NoError(t, err)
+
+	// the migration tokens are derived from the psk of the crypt
+	_, err = stf4go.Listen(laddr, WithMigration(true))
+
+	require.True(t, errors.Is(err, stf4go.ErrResource))
+
+	_, err = stf4go.Dial(context.Background(), laddr, WithMigration(true), WithKeepalive(time.Second, 0))
+
+	require.True(t, errors.Is(err, stf4go.ErrResource))
+
+	// the dialer proves the token in its keepalives
+	_, err = stf4go.Dial(context.Background(), laddr, WithMigration(true), WithCrypt("aes"), WithPSK("secret"))
+
+	require.True(t, errors.Is(err, stf4go.ErrResource))
+}
@@ -0,0 +1,262 @@
+package kcp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+// proofLen keeps the keepalive and challenge reply carrying conv and token proof shorter than the kcp header
+const proofLen = 12
+const nonceLen = 8
+
+const migrationPrefix = "stf4go-transport-kcp-migration"
+const keepaliveProof = "keepalive"
+
+// pendingTimeout how long an address that sent the settings hello may start a kcp session
+const pendingTimeout = time.Minute
+const challengeTimeout = 10 * time.Second
+
+// admit allow kcp datagrams from addr on the gated listener socket, called once its settings hello checked out
+func (conn *controlConn) admit(addr net.Addr) {
+	conn.Lock()
+	defer conn.Unlock()
+
+	now := time.Now()
+
+	for key, at := range conn.pending {
+		if now.Sub(at) > pendingTimeout {
+			delete(conn.pending, key)
+		}
+	}
+
+	conn.pending[addr.String()] = now
+}
+
+func (conn *controlConn) admitted(addr net.Addr) bool {
+	conn.RLock()
+	defer conn.RUnlock()
+
+	if _, ok := conn.peers[addr.String()]; ok {
+		return true
+	}
+
+	at, ok := conn.pending[addr.String()]
+
+	return ok && time.Since(at) < pendingTimeout
+}
+
+// translate map the migrated address back to the session origin address kcp-go keys the session by
+func (conn *controlConn) translate(addr net.Addr) net.Addr {
+	conn.RLock()
+	defer conn.RUnlock()
+
+	if origin, ok := conn.inbound[addr.String()]; ok {
+		return origin
+	}
+
+	return addr
+}
+
+// rebind route the session of origin address through current address
+func (conn *controlConn) rebind(origin net.Addr, current net.Addr) {
+	conn.Lock()
+	defer conn.Unlock()
+
+	if previous, ok := conn.outbound[origin.String()]; ok {
+		delete(conn.inbound, previous.String())
+		delete(conn.outbound, origin.String())
+	}
+
+	if current.String() != origin.String() {
+		conn.inbound[current.String()] = origin
+		conn.outbound[origin.String()] = current
+	}
+}
+
+type challenge struct {
+	addr  net.Addr
+	nonce []byte
+	at    time.Time
+}
+
+// migrationToken session token bound to the conv and the psk derived key, it never goes on the wire,
+// the ends only send proofs of it, so observing the control datagrams is not enough to move a session
+func migrationToken(key []byte, conv uint32) []byte {
+	mac := hmac.New(sha256.New, key)
+
+	mac.Write([]byte(migrationPrefix))
+
+	binary.Write(mac, binary.LittleEndian, conv)
+
+	return mac.Sum(nil)
+}
+
+func tokenProof(token []byte, data []byte) []byte {
+	mac := hmac.New(sha256.New, token)
+
+	mac.Write(data)
+
+	return mac.Sum(nil)[:proofLen]
+}
+
+// migration listener side of the connection migration, the path of a session moves to a new address after
+// the client proves the session token from it and answers the challenge sent there with another proof.
+// it needs the psk derived key of the kcp crypt, the key is nil and no session migrates without WithMigration
+type migration struct {
+	sync.Mutex
+	key        []byte
+	sessions   map[uint32]*kcpConn
+	challenges map[uint32]*challenge
+}
+
+func newMigration(key []byte) *migration {
+	return &migration{
+		key:        key,
+		sessions:   make(map[uint32]*kcpConn),
+		challenges: make(map[uint32]*challenge),
+	}
+}
+
+func (m *migration) add(conn *kcpConn) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.sessions[conn.session.GetConv()] = conn
+}
+
+func (m *migration) remove(conn *kcpConn) {
+	m.Lock()
+	defer m.Unlock()
+
+	conv := conn.session.GetConv()
+
+	if m.sessions[conv] == conn {
+		delete(m.sessions, conv)
+		delete(m.challenges, conv)
+	}
+}
+
+// keepalive check the token proof carried by the client keepalive, returns the challenge to send
+// if it arrived from a new address
+func (m *migration) keepalive(payload []byte, addr net.Addr) (uint32, []byte, bool) {
+	if m.key == nil || len(payload) != 4+proofLen {
+		return 0, nil, false
+	}
+
+	conv := binary.LittleEndian.Uint32(payload)
+
+	if !hmac.Equal(tokenProof(migrationToken(m.key, conv), []byte(keepaliveProof)), payload[4:]) {
+		return 0, nil, false
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	conn, ok := m.sessions[conv]
+
+	if !ok || conn.remoteNetAddr().String() == addr.String() {
+		return 0, nil, false
+	}
+
+	nonce := make([]byte, nonceLen)
+
+	if _, err := rand.Read(nonce); err != nil {
+		return 0, nil, false
+	}
+
+	m.challenges[conv] = &challenge{
+		addr:  addr,
+		nonce: nonce,
+		at:    time.Now(),
+	}
+
+	return conv, nonce, true
+}
+
+// challengeReply verify the token proof over the challenge nonce, returns the session to move to addr
+func (m *migration) challengeReply(payload []byte, addr net.Addr) (*kcpConn, bool) {
+	if m.key == nil || len(payload) != 4+proofLen {
+		return nil, false
+	}
+
+	conv := binary.LittleEndian.Uint32(payload)
+
+	m.Lock()
+	defer m.Unlock()
+
+	c, ok := m.challenges[conv]
+
+	if !ok || c.addr.String() != addr.String() || time.Since(c.at) > challengeTimeout {
+		return nil, false
+	}
+
+	if !hmac.Equal(tokenProof(migrationToken(m.key, conv), c.nonce), payload[4:]) {
+		return nil, false
+	}
+
+	delete(m.challenges, conv)
+
+	conn, ok := m.sessions[conv]
+
+	return conn, ok
+}
+
+// convPayload control payload prefixed with the conversation id
+func convPayload(conv uint32, data []byte) []byte {
+	payload := make([]byte, 4, 4+len(data))
+
+	binary.LittleEndian.PutUint32(payload, conv)
+
+	return append(payload, data...)
+}
+
+// migrationClient dial side of the connection migration, it proves the session token in its keepalives
+// and answers the challenges for its session
+type migrationClient struct {
+	sync.Mutex
+	control *controlConn
+	key     []byte
+	conv    uint32
+	token   []byte
+}
+
+func (client *migrationClient) handleControl(kind byte, payload []byte, addr net.Addr) {
+	client.Lock()
+	defer client.Unlock()
+
+	if kind != controlChallenge || client.token == nil {
+		return
+	}
+
+	if len(payload) == 4+nonceLen && binary.LittleEndian.Uint32(payload) == client.conv {
+		client.control.writeControl(controlChallengeReply, convPayload(client.conv, tokenProof(client.token, payload[4:])), addr)
+	}
+}
+
+func (client *migrationClient) setConv(conv uint32) {
+	client.Lock()
+	defer client.Unlock()
+
+	client.conv = conv
+
+	if client.key != nil {
+		client.token = migrationToken(client.key, conv)
+	}
+}
+
+// keepalivePayload conv and token proof, nil without WithMigration
+func (client *migrationClient) keepalivePayload() []byte {
+	client.Lock()
+	defer client.Unlock()
+
+	if client.token == nil {
+		return nil
+	}
+
+	return convPayload(client.conv, tokenProof(client.token, []byte(keepaliveProof)))
+}
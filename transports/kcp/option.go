@@ -0,0 +1,245 @@
+package kcp
+
+import (
+	"time"
+
+	"github.com/libs4go/errors"
+	"github.com/libs4go/stf4go"
+	"github.com/multiformats/go-multiaddr"
+	kcpgo "github.com/xtaci/kcp-go"
+)
+
+// tuning kcp session parameters, defaults are the kcp-go defaults
+type tuning struct {
+	noDelay     int
+	interval    int
+	resend      int
+	nc          int
+	sndWnd      int
+	rcvWnd      int
+	mtu         int
+	ackNoDelay  bool
+	streamMode  bool
+	readBuffer  int // udp socket buffer size, 0 keeps the os default
+	writeBuffer int // udp socket buffer size, 0 keeps the os default
+	keepalive   time.Duration
+	deadTimeout time.Duration // close the session after the peer is silent this long, 0 disables
+}
+
+func getTuning(options *stf4go.Options) *tuning {
+	config := options.Config
+
+	return &tuning{
+		noDelay:     config.Get("kcp", "nodelay").Int(0),
+		interval:    config.Get("kcp", "interval").Int(kcpgo.IKCP_INTERVAL),
+		resend:      config.Get("kcp", "resend").Int(0),
+		nc:          config.Get("kcp", "nc").Int(0),
+		sndWnd:      config.Get("kcp", "sndwnd").Int(kcpgo.IKCP_WND_SND),
+		rcvWnd:      config.Get("kcp", "rcvwnd").Int(kcpgo.IKCP_WND_RCV),
+		mtu:         config.Get("kcp", "mtu").Int(kcpgo.IKCP_MTU_DEF),
+		ackNoDelay:  config.Get("kcp", "acknodelay").Bool(false),
+		streamMode:  config.Get("kcp", "streammode").Bool(false),
+		readBuffer:  config.Get("kcp", "readbuffer").Int(0),
+		writeBuffer: config.Get("kcp", "writebuffer").Int(0),
+		keepalive:   config.Get("kcp", "keepalive").Duration(0),
+		deadTimeout: config.Get("kcp", "deadtimeout").Duration(0),
+	}
+}
+
+type socketBuffer interface {
+	SetReadBuffer(bytes int) error
+	SetWriteBuffer(bytes int) error
+}
+
+func (t *tuning) applySocket(socket socketBuffer) error {
+	if t.readBuffer > 0 {
+		if err := socket.SetReadBuffer(t.readBuffer); err != nil {
+			return err
+		}
+	}
+
+	if t.writeBuffer > 0 {
+		if err := socket.SetWriteBuffer(t.writeBuffer); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *tuning) applySession(session *kcpgo.UDPSession) {
+	session.SetNoDelay(t.noDelay, t.interval, t.resend, t.nc)
+	session.SetWindowSize(t.sndWnd, t.rcvWnd)
+	session.SetMtu(t.mtu)
+	session.SetACKNoDelay(t.ackNoDelay)
+	session.SetStreamMode(t.streamMode)
+}
+
+// WithNoDelay set kcp nodelay mode, e.g. (1, 10, 2, 1) for the turbo mode
+func WithNoDelay(nodelay, interval, resend, nc int) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetConfig(nodelay, "kcp", "nodelay")
+		options.SetConfig(interval, "kcp", "interval")
+		options.SetConfig(resend, "kcp", "resend")
+		options.SetConfig(nc, "kcp", "nc")
+
+		return nil
+	}
+}
+
+// WithWindowSize set kcp send and receive window size in packets
+func WithWindowSize(sndwnd, rcvwnd int) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetConfig(sndwnd, "kcp", "sndwnd")
+		options.SetConfig(rcvwnd, "kcp", "rcvwnd")
+
+		return nil
+	}
+}
+
+// WithMTU set kcp mtu, not including the udp header
+func WithMTU(mtu int) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetConfig(mtu, "kcp", "mtu")
+
+		return nil
+	}
+}
+
+// WithACKNoDelay flush ack immediately for each incoming packet
+func WithACKNoDelay(enable bool) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetConfig(enable, "kcp", "acknodelay")
+
+		return nil
+	}
+}
+
+// WithStreamMode enable kcp stream mode, merging writes into full mtu packets
+func WithStreamMode(enable bool) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetConfig(enable, "kcp", "streammode")
+
+		return nil
+	}
+}
+
+// WithSocketBuffer set udp socket read and write buffer size
+func WithSocketBuffer(readBuffer, writeBuffer int) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetConfig(readBuffer, "kcp", "readbuffer")
+		options.SetConfig(writeBuffer, "kcp", "writebuffer")
+
+		return nil
+	}
+}
+
+// WithFEC enable reed-solomon forward error correction, both ends must use the same shards
+func WithFEC(dataShards, parityShards int) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetConfig(dataShards, "kcp", "datashards")
+		options.SetConfig(parityShards, "kcp", "parityshards")
+
+		return nil
+	}
+}
+
+// WithCrypt set packet block cipher, one of none aes aes-128 aes-192 salsa20 blowfish twofish cast5 3des tea xtea sm4 xor,
+// the key is derived from WithPSK
+func WithCrypt(cipher string) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		if _, ok := cipherID(cipher); !ok {
+			return errors.Wrap(stf4go.ErrResource, "unknown kcp crypt %s", cipher)
+		}
+
+		options.SetConfig(cipher, "kcp", "crypt")
+
+		return nil
+	}
+}
+
+// WithPSK set the pre-shared secret the packet cipher key derived from
+func WithPSK(psk string) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetConfig(psk, "kcp", "psk")
+
+		return nil
+	}
+}
+
+// WithKeepalive set keepalive interval and dead peer timeout, the session is closed after the peer is silent
+// longer than timeout, zero timeout disables the dead peer detection and zero interval disables both,
+// the peer's keepalive interval must be shorter than timeout. both are off by default, see WithMigration
+func WithKeepalive(interval, timeout time.Duration) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetConfig(interval.String(), "kcp", "keepalive")
+		options.SetConfig(timeout.String(), "kcp", "deadtimeout")
+
+		return nil
+	}
+}
+
+// WithMigration let the sessions follow the dialer to a new address, e.g. after a nat rebind, the dialer proves
+// the session token in its keepalives. it needs WithCrypt and WithPSK on both ends and WithKeepalive on the
+// dialer, Dial and Listen fail without them. off by default
+func WithMigration(enable bool) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetConfig(enable, "kcp", "migration")
+
+		return nil
+	}
+}
+
+// getMigrationKey the key the migration tokens are derived from, nil if the migration is off
+func getMigrationKey(options *stf4go.Options, settings *settings, tuning *tuning, dialer bool) ([]byte, error) {
+	if !options.Config.Get("kcp", "migration").Bool(false) {
+		return nil, nil
+	}
+
+	if settings.block == nil {
+		return nil, errors.Wrap(stf4go.ErrResource, "kcp migration expect crypt and psk")
+	}
+
+	if dialer && tuning.keepalive <= 0 {
+		return nil, errors.Wrap(stf4go.ErrResource, "kcp migration expect keepalive")
+	}
+
+	return settings.key, nil
+}
+
+// MismatchHandler called by the listener for the dialers whose settings hello does not match
+type MismatchHandler func(raddr multiaddr.Multiaddr, err error)
+
+// WithMismatchHandler report the settings mismatches on the listener side, handler gets ErrSettings describing
+// the mismatch while the dialer gets it from Dial. Accept does not return them, a misconfigured dialer
+// must not fail the accept loop of the other peers
+func WithMismatchHandler(handler MismatchHandler) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetObject(handler, "kcp", "mismatch")
+
+		return nil
+	}
+}
+
+func getMismatchHandler(options *stf4go.Options) MismatchHandler {
+	obj, ok := options.GetObj("kcp", "mismatch")
+
+	if !ok {
+		return nil
+	}
+
+	handler, _ := obj.(MismatchHandler)
+
+	return handler
+}
+
+// WithSharedSocket dial from the udp socket of the kcp listener bound to laddr, so inbound and outbound
+// sessions share one port, e.g. for nat hole punching. datagrams from the dialed address are no longer
+// seen by the listener while the dialed session is open
+func WithSharedSocket(laddr multiaddr.Multiaddr) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetConfig(laddr.String(), "kcp", "shared")
+
+		return nil
+	}
+}
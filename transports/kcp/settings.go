@@ -0,0 +1,181 @@
+package kcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/libs4go/errors"
+	"github.com/libs4go/stf4go"
+	kcpgo "github.com/xtaci/kcp-go"
+)
+
+const errVendor = "stf4go-transport-kcp"
+
+// errors
+var (
+	ErrSettings = errors.New("kcp settings mismatch", errors.WithVendor(errVendor), errors.WithCode(-1))
+)
+
+const keyCheckLen = 8
+
+const helloInterval = 200 * time.Millisecond
+const helloTimeout = 5 * time.Second
+
+// settings both ends must agree on, exchanged in the settings hello before the kcp session starts
+type settings struct {
+	block        kcpgo.BlockCrypt
+	dataShards   int
+	parityShards int
+	cipher       int
+	keyCheck     []byte
+	key          []byte // psk derived key, nil without crypt
+}
+
+func getSettings(options *stf4go.Options) (*settings, error) {
+	block, cipher, keyCheck, key, err := getBlockCrypt(options)
+
+	if err != nil {
+		return nil, err
+	}
+
+	dataShards := options.Config.Get("kcp", "datashards").Int(0)
+	parityShards := options.Config.Get("kcp", "parityshards").Int(0)
+
+	if dataShards < 0 || parityShards < 0 || dataShards > 0xff || parityShards > 0xff {
+		return nil, errors.Wrap(stf4go.ErrResource, "invalid kcp fec shards %d/%d", dataShards, parityShards)
+	}
+
+	return &settings{
+		block:        block,
+		dataShards:   dataShards,
+		parityShards: parityShards,
+		cipher:       cipher,
+		keyCheck:     keyCheck,
+		key:          key,
+	}, nil
+}
+
+func (s *settings) marshal() []byte {
+	return append([]byte{byte(s.dataShards), byte(s.parityShards), byte(s.cipher)}, s.keyCheck...)
+}
+
+func unmarshalSettings(payload []byte) (*settings, error) {
+	if len(payload) != 3+keyCheckLen {
+		return nil, errors.Wrap(ErrSettings, "invalid settings hello length %d", len(payload))
+	}
+
+	return &settings{
+		dataShards:   int(payload[0]),
+		parityShards: int(payload[1]),
+		cipher:       int(payload[2]),
+		keyCheck:     payload[3:],
+	}, nil
+}
+
+// helloLen settings hello payload, the settings followed by the session conv and whether the conv is fixed
+const helloLen = 3 + keyCheckLen + 5
+
+// helloPayload the conv lets the simultaneous dials of one address pair over shared sockets agree on one session
+func (s *settings) helloPayload(conv uint32, fixed bool) []byte {
+	payload := convPayload(conv, s.marshal())
+
+	if fixed {
+		return append(payload, 1)
+	}
+
+	return append(payload, 0)
+}
+
+func unmarshalHello(payload []byte) (*settings, uint32, bool, error) {
+	if len(payload) != helloLen {
+		return nil, 0, false, errors.Wrap(ErrSettings, "invalid settings hello length %d", len(payload))
+	}
+
+	remote, err := unmarshalSettings(payload[4 : helloLen-1])
+
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	return remote, binary.LittleEndian.Uint32(payload), payload[helloLen-1] == 1, nil
+}
+
+// check returns ErrSettings describing the first different setting
+func (s *settings) check(remote *settings) error {
+	if s.dataShards != remote.dataShards || s.parityShards != remote.parityShards {
+		return errors.Wrap(ErrSettings, "fec shards local %d/%d remote %d/%d",
+			s.dataShards, s.parityShards, remote.dataShards, remote.parityShards)
+	}
+
+	if s.cipher != remote.cipher {
+		return errors.Wrap(ErrSettings, "crypt local %s remote %s", cipherName(s.cipher), cipherName(remote.cipher))
+	}
+
+	if !bytes.Equal(s.keyCheck, remote.keyCheck) {
+		return errors.Wrap(ErrSettings, "crypt %s key differs", cipherName(s.cipher))
+	}
+
+	return nil
+}
+
+func (s *settings) String() string {
+	return fmt.Sprintf("fec %d/%d crypt %s", s.dataShards, s.parityShards, cipherName(s.cipher))
+}
+
+// hello send settings hello with the session conv to raddr until the reply arrives, returns the conv of the reply,
+// it must run before the kcp session owns the socket
+func (s *settings) hello(ctx context.Context, conn net.PacketConn, raddr net.Addr, conv uint32) (uint32, bool, error) {
+	deadline := time.Now().Add(helloTimeout)
+
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	defer conn.SetReadDeadline(time.Time{})
+
+	buff := make([]byte, kcpgo.IKCP_OVERHEAD)
+
+	for time.Now().Before(deadline) {
+		if _, err := conn.WriteTo(newControl(controlHello, s.helloPayload(conv, false)), raddr); err != nil {
+			return 0, false, errors.Wrap(err, "send kcp settings hello to %s error", raddr.String())
+		}
+
+		if err := conn.SetReadDeadline(time.Now().Add(helloInterval)); err != nil {
+			return 0, false, err
+		}
+
+		for {
+			n, addr, err := conn.ReadFrom(buff)
+
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+
+				return 0, false, errors.Wrap(err, "recv kcp settings hello from %s error", raddr.String())
+			}
+
+			if addr.String() != raddr.String() || !isControl(buff[:n]) || buff[len(controlMagic)] != controlHelloReply {
+				continue
+			}
+
+			remote, remoteConv, fixed, err := unmarshalHello(buff[len(controlMagic)+1 : n])
+
+			if err != nil {
+				return 0, false, err
+			}
+
+			return remoteConv, fixed, s.check(remote)
+		}
+
+		if err := ctx.Err(); err != nil {
+			return 0, false, errors.Wrap(err, "kcp settings hello to %s canceled", raddr.String())
+		}
+	}
+
+	return 0, false, errors.Wrap(stf4go.ErrResource, "kcp settings hello to %s timeout", raddr.String())
+}
@@ -0,0 +1,288 @@
+package kcp
+
+import (
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/libs4go/errors"
+	"github.com/libs4go/stf4go"
+	"github.com/multiformats/go-multiaddr"
+)
+
+var errRouteExists = errors.New("route exists")
+
+// routeBacklog max datagrams queued for one outbound session on a shared socket
+const routeBacklog = 256
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// route net.PacketConn of one outbound session dialed from a listener socket,
+// the listener read loop hands over the datagrams from raddr instead of passing them to kcp-go
+type route struct {
+	shared   *controlConn
+	raddr    net.Addr
+	packets  chan []byte
+	closed   chan struct{}
+	once     sync.Once
+	mu       sync.Mutex
+	deadline time.Time
+	changed  chan struct{} // closed when the read deadline changes, wakes the pending ReadFrom
+	conv     uint32        // session conv, offered in the settings hello until fixed
+	peerConv uint32        // conv of the peer dialing this address at the same time
+	fixed    bool
+}
+
+func (r *route) readDeadline() (time.Time, chan struct{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.deadline, r.changed
+}
+
+func (r *route) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		deadline, changed := r.readDeadline()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+
+		if !deadline.IsZero() {
+			wait := time.Until(deadline)
+
+			if wait <= 0 {
+				return 0, nil, timeoutError{}
+			}
+
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+
+		select {
+		case packet := <-r.packets:
+			stopTimer(timer)
+			return copy(b, packet), r.raddr, nil
+		case <-r.closed:
+			stopTimer(timer)
+			return 0, nil, errors.Wrap(io.ErrClosedPipe, "route to %s closed", r.raddr.String())
+		case <-timeout:
+			return 0, nil, timeoutError{}
+		case <-changed:
+			stopTimer(timer)
+		}
+	}
+}
+
+func stopTimer(timer *time.Timer) {
+	if timer != nil {
+		timer.Stop()
+	}
+}
+
+func (r *route) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return r.shared.PacketConn.WriteTo(b, addr)
+}
+
+func (r *route) Close() error {
+	r.once.Do(func() {
+		close(r.closed)
+		r.shared.removeRoute(r)
+	})
+
+	return nil
+}
+
+func (r *route) LocalAddr() net.Addr {
+	return r.shared.LocalAddr()
+}
+
+func (r *route) SetDeadline(t time.Time) error {
+	return r.SetReadDeadline(t)
+}
+
+func (r *route) SetReadDeadline(t time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.deadline = t
+
+	close(r.changed)
+
+	r.changed = make(chan struct{})
+
+	return nil
+}
+
+func (r *route) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (r *route) SyscallConn() (syscall.RawConn, error) {
+	return r.shared.SyscallConn()
+}
+
+// offer record the conv of the peer dialing this address too, returns the local conv for the hello reply
+func (r *route) offer(peerConv uint32) (uint32, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.fixed {
+		r.peerConv = peerConv
+	}
+
+	return r.conv, r.fixed
+}
+
+// agree fix the session conv once the hello reply arrived, a peer that already runs its session decides,
+// otherwise both simultaneous dials pick the lower conv
+func (r *route) agree(remoteConv uint32, remoteFixed bool) uint32 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if remoteConv == 0 {
+		remoteConv = r.peerConv
+	}
+
+	if remoteFixed || (remoteConv != 0 && remoteConv < r.conv) {
+		r.conv = remoteConv
+	}
+
+	r.fixed = true
+
+	return r.conv
+}
+
+func (r *route) deliver(packet []byte) {
+	buff := make([]byte, len(packet))
+
+	copy(buff, packet)
+
+	select {
+	case r.packets <- buff:
+	default:
+		// queue full, drop it as the network would
+	}
+}
+
+// newRoute register outbound route to raddr on the listener socket for the session conv
+func (conn *controlConn) newRoute(raddr net.Addr, conv uint32) (*route, error) {
+	conn.Lock()
+	defer conn.Unlock()
+
+	if _, ok := conn.routes[raddr.String()]; ok {
+		return nil, errors.Wrap(errRouteExists, "already dialed %s from %s", raddr.String(), conn.LocalAddr().String())
+	}
+
+	r := &route{
+		shared:  conn,
+		raddr:   raddr,
+		packets: make(chan []byte, routeBacklog),
+		closed:  make(chan struct{}),
+		changed: make(chan struct{}),
+		conv:    conv,
+	}
+
+	conn.routes[raddr.String()] = r
+
+	return r, nil
+}
+
+func (conn *controlConn) removeRoute(r *route) {
+	conn.Lock()
+	defer conn.Unlock()
+
+	if conn.routes[r.raddr.String()] == r {
+		delete(conn.routes, r.raddr.String())
+	}
+}
+
+func (conn *controlConn) getRoute(addr net.Addr) (*route, bool) {
+	conn.RLock()
+	defer conn.RUnlock()
+
+	r, ok := conn.routes[addr.String()]
+
+	return r, ok
+}
+
+// Close close the socket and the routes sharing it
+func (conn *controlConn) Close() error {
+	conn.Lock()
+	routes := conn.routes
+	conn.routes = make(map[string]*route)
+	conn.Unlock()
+
+	for _, r := range routes {
+		r.once.Do(func() {
+			close(r.closed)
+		})
+	}
+
+	return conn.PacketConn.Close()
+}
+
+func (conn *controlConn) SyscallConn() (syscall.RawConn, error) {
+	sc, ok := conn.PacketConn.(syscall.Conn)
+
+	if !ok {
+		return nil, errors.Wrap(stf4go.ErrResource, "udp socket %s has no raw socket", conn.LocalAddr().String())
+	}
+
+	return sc.SyscallConn()
+}
+
+// kcpAddr strip the protocols after /kcp, e.g. /ip4/127.0.0.1/udp/1813/kcp/tls to /ip4/127.0.0.1/udp/1813/kcp
+func kcpAddr(addr multiaddr.Multiaddr) string {
+	var prefix []multiaddr.Multiaddr
+
+	for _, component := range multiaddr.Split(addr) {
+		prefix = append(prefix, component)
+
+		if component.Protocols()[0].Code == protocolKCPID {
+			break
+		}
+	}
+
+	return multiaddr.Join(prefix...).String()
+}
+
+func (transport *kcpTransport) addListener(listener *kcpListener) {
+	transport.Lock()
+	defer transport.Unlock()
+
+	transport.listeners[kcpAddr(listener.addr)] = listener
+}
+
+func (transport *kcpTransport) removeListener(listener *kcpListener) {
+	transport.Lock()
+	defer transport.Unlock()
+
+	if transport.listeners[kcpAddr(listener.addr)] == listener {
+		delete(transport.listeners, kcpAddr(listener.addr))
+	}
+}
+
+func (transport *kcpTransport) getListener(laddr string) (*kcpListener, error) {
+	addr, err := multiaddr.NewMultiaddr(laddr)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "parse shared socket addr %s error", laddr)
+	}
+
+	transport.RLock()
+	defer transport.RUnlock()
+
+	listener, ok := transport.listeners[kcpAddr(addr)]
+
+	if !ok {
+		return nil, errors.Wrap(stf4go.ErrResource, "kcp listener %s not found", laddr)
+	}
+
+	return listener, nil
+}
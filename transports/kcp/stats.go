@@ -0,0 +1,56 @@
+package kcp
+
+import (
+	"sync/atomic"
+	"time"
+
+	kcpgo "github.com/xtaci/kcp-go"
+)
+
+// Stats kcp session statistics. kcp-go v5.4.20 keeps the rtt, rto and the per session retransmits private,
+// the retransmits and lost segments are only counted process wide, see SNMP
+type Stats struct {
+	SndWnd     int       // configured send window, in packets
+	RcvWnd     int       // configured receive window, in packets
+	PacketsIn  uint64    // datagrams received from the peer, kcp and control
+	PacketsOut uint64    // datagrams sent to the peer, kcp and control
+	BytesIn    uint64    // datagram bytes received from the peer
+	BytesOut   uint64    // datagram bytes sent to the peer
+	LastSeen   time.Time // last datagram received from the peer
+}
+
+// SNMP snapshot of the process wide kcp-go counters, shared by all kcp sessions,
+// e.g. RetransSegs and LostSegs for the retransmits
+func SNMP() *kcpgo.Snmp {
+	return kcpgo.DefaultSnmp.Copy()
+}
+
+// peerStats datagram counters of a watched peer address, updated atomically
+type peerStats struct {
+	lastSeen   int64 // unix nano
+	packetsIn  uint64
+	packetsOut uint64
+	bytesIn    uint64
+	bytesOut   uint64
+}
+
+func (stats *peerStats) received(n int) {
+	atomic.StoreInt64(&stats.lastSeen, time.Now().UnixNano())
+	atomic.AddUint64(&stats.packetsIn, 1)
+	atomic.AddUint64(&stats.bytesIn, uint64(n))
+}
+
+func (stats *peerStats) sent(n int) {
+	atomic.AddUint64(&stats.packetsOut, 1)
+	atomic.AddUint64(&stats.bytesOut, uint64(n))
+}
+
+func (stats *peerStats) snapshot() *Stats {
+	return &Stats{
+		PacketsIn:  atomic.LoadUint64(&stats.packetsIn),
+		PacketsOut: atomic.LoadUint64(&stats.packetsOut),
+		BytesIn:    atomic.LoadUint64(&stats.bytesIn),
+		BytesOut:   atomic.LoadUint64(&stats.bytesOut),
+		LastSeen:   time.Unix(0, atomic.LoadInt64(&stats.lastSeen)),
+	}
+}
@@ -0,0 +1,94 @@
+package login
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+
+	"github.com/libs4go/errors"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/blowfish"
+)
+
+// x/crypto/bcrypt only hashes with a random salt, the client must hash with the salt of the stored hash,
+// so the hash is computed here the way x/crypto/bcrypt does, on the same blowfish primitives
+
+// settingLen the "$2a$10$" prefix and the encoded salt of a bcrypt hash
+const settingLen = 29
+
+// hashLen full bcrypt hash, setting and encoded 23 bytes of the cipher data
+const hashLen = 60
+
+// maxCost bounds the cost a server can make the client spend on one login
+const maxCost = 16
+
+const bcryptAlphabet = "./ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+var bcryptEncoding = base64.NewEncoding(bcryptAlphabet).WithPadding(base64.NoPadding)
+
+var magicCipherData = []byte("OrpheanBeholderScryDoubt")
+
+func parseSetting(setting []byte) (int, []byte, error) {
+	if len(setting) != settingLen || setting[0] != '$' || setting[1] != '2' || setting[3] != '$' || setting[6] != '$' {
+		return 0, nil, errors.New("invalid bcrypt setting")
+	}
+
+	cost, err := strconv.Atoi(string(setting[4:6]))
+
+	if err != nil || cost < bcrypt.MinCost || cost > maxCost {
+		return 0, nil, errors.New("invalid bcrypt cost")
+	}
+
+	salt, err := bcryptEncoding.DecodeString(string(setting[7:]))
+
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "decode bcrypt salt error")
+	}
+
+	return cost, salt, nil
+}
+
+// bcryptHash hash password with the cost and salt of setting, the result is the full bcrypt hash
+// x/crypto/bcrypt would store for the same salt
+func bcryptHash(password []byte, setting []byte) ([]byte, error) {
+	cost, salt, err := parseSetting(setting)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// C implementations expand the trailing NULL of the key string too
+	key := append(append([]byte{}, password...), 0)
+
+	cipher, err := blowfish.NewSaltedCipher(key, salt)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "bcrypt setup error")
+	}
+
+	for i := 0; i < 1<<uint(cost); i++ {
+		blowfish.ExpandKey(key, cipher)
+		blowfish.ExpandKey(salt, cipher)
+	}
+
+	data := append([]byte{}, magicCipherData...)
+
+	for i := 0; i < len(data); i += 8 {
+		for j := 0; j < 64; j++ {
+			cipher.Encrypt(data[i:i+8], data[i:i+8])
+		}
+	}
+
+	// only 23 of the 24 bytes are encoded, as the C implementations do
+	return append(append([]byte{}, setting...), bcryptEncoding.EncodeToString(data[:23])...), nil
+}
+
+// proof answer to the login challenge nonce, keyed by the bcrypt hash
+func proof(hashed []byte, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, hashed)
+
+	mac.Write(nonce)
+
+	return mac.Sum(nil)
+}
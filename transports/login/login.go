@@ -0,0 +1,295 @@
+package login
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/asn1"
+	"encoding/binary"
+	"io"
+
+	"github.com/libs4go/errors"
+	"github.com/libs4go/slf4go"
+	"github.com/libs4go/stf4go"
+	"github.com/multiformats/go-multiaddr"
+)
+
+const protocolLoginID = 490
+
+var protoLogin = multiaddr.Protocol{
+	Name:  "login",
+	Code:  protocolLoginID,
+	VCode: multiaddr.CodeToVarint(protocolLoginID),
+}
+
+var loginMultiAddr multiaddr.Multiaddr
+
+func init() {
+
+	if err := multiaddr.AddProtocol(protoLogin); err != nil {
+		panic(err)
+	}
+
+	var err error
+	loginMultiAddr, err = multiaddr.NewMultiaddr("/login")
+	if err != nil {
+		panic(err)
+	}
+}
+
+// maxMessageLen bounds the messages read from the unauthenticated peer
+const maxMessageLen = 4096
+
+// nonceLen the challenge nonce the client proof is keyed with
+const nonceLen = 32
+
+// handshake result the server sends after checking the proof
+const (
+	resultOK byte = iota
+	resultPassword
+)
+
+type credentials struct {
+	User     string
+	Password string
+}
+
+// challenge the server sends for the user, Setting is the "$2a$10$" prefix and salt of the stored bcrypt hash
+type challenge struct {
+	Setting []byte
+	Nonce   []byte
+}
+
+func readMessage(conn stf4go.Conn) ([]byte, error) {
+	var header [2]byte
+
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint16(header[:])
+
+	if length > maxMessageLen {
+		return nil, errors.New("login message too large")
+	}
+
+	message := make([]byte, length)
+
+	if _, err := io.ReadFull(conn, message); err != nil {
+		return nil, err
+	}
+
+	return message, nil
+}
+
+func writeMessage(conn stf4go.Conn, message []byte) error {
+	if len(message) > maxMessageLen {
+		return errors.New("login message too large")
+	}
+
+	buff := make([]byte, 2+len(message))
+
+	binary.BigEndian.PutUint16(buff, uint16(len(message)))
+
+	copy(buff[2:], message)
+
+	_, err := conn.Write(buff)
+
+	return err
+}
+
+type loginTransport struct {
+	slf4go.Logger
+}
+
+func newLoginTransport() *loginTransport {
+	return &loginTransport{
+		Logger: slf4go.Get("stf4go-transport-login"),
+	}
+}
+
+func (transport *loginTransport) String() string {
+	return "stf4go-transport-login"
+}
+
+func (transport *loginTransport) Protocols() []multiaddr.Protocol {
+	return []multiaddr.Protocol{
+		protoLogin,
+	}
+}
+
+// Client send the user name, hash the password with the bcrypt setting of the server challenge and answer
+// with the hash keyed HMAC of the challenge nonce, the password never leaves the client. the handshake
+// is not encrypted, the user name is visible and the stored hash is as good as the password to the peer
+// holding it, run /login over an authenticated layer when active attackers matter
+func (transport *loginTransport) Client(conn stf4go.Conn, raddr multiaddr.Multiaddr, options *stf4go.Options) (stf4go.Conn, error) {
+
+	creds, err := getCredentials(options)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeMessage(conn, []byte(creds.User)); err != nil {
+		return nil, errors.Wrap(err, "login handshake write user error")
+	}
+
+	message, err := readMessage(conn)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "login handshake read challenge error")
+	}
+
+	var chal challenge
+
+	if _, err := asn1.Unmarshal(message, &chal); err != nil {
+		return nil, errors.Wrap(err, "unmarshal login challenge error")
+	}
+
+	if len(chal.Nonce) != nonceLen {
+		return nil, errors.New("invalid login challenge nonce")
+	}
+
+	hashed, err := bcryptHash([]byte(creds.Password), chal.Setting)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "login challenge from %s error", raddr.String())
+	}
+
+	if err := writeMessage(conn, proof(hashed, chal.Nonce)); err != nil {
+		return nil, errors.Wrap(err, "login handshake write proof error")
+	}
+
+	var result [1]byte
+
+	if _, err := io.ReadFull(conn, result[:]); err != nil {
+		return nil, errors.Wrap(err, "login handshake read result error")
+	}
+
+	if result[0] != resultOK {
+		return nil, errors.Wrap(stf4go.ErrPassword, "login %s rejected by %s", creds.User, raddr.String())
+	}
+
+	return newLoginConn(conn, creds.User), nil
+}
+
+// Server challenge the user with the salt of its stored hash and a fresh nonce, unknown users get a stable
+// fake salt, so the challenge does not tell which users exist
+func (transport *loginTransport) Server(conn stf4go.Conn, laddr multiaddr.Multiaddr, options *stf4go.Options) (stf4go.Conn, error) {
+
+	verifier, err := getVerifier(options)
+
+	if err != nil {
+		return nil, err
+	}
+
+	message, err := readMessage(conn)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "login handshake read user error")
+	}
+
+	user := string(message)
+
+	hashed, ok := verifier.Hash(user)
+
+	chal := challenge{
+		Nonce: make([]byte, nonceLen),
+	}
+
+	if ok && len(hashed) == hashLen {
+		chal.Setting = hashed[:settingLen]
+	} else {
+		ok = false
+		chal.Setting = unknownSetting(user)
+	}
+
+	if _, err := rand.Read(chal.Nonce); err != nil {
+		return nil, errors.Wrap(err, "generate login nonce error")
+	}
+
+	message, err = asn1.Marshal(chal)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal login challenge error")
+	}
+
+	if err := writeMessage(conn, message); err != nil {
+		return nil, errors.Wrap(err, "login handshake write challenge error")
+	}
+
+	response, err := readMessage(conn)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "login handshake read proof error")
+	}
+
+	result := resultOK
+
+	if !ok || !hmac.Equal(proof(hashed, chal.Nonce), response) {
+		result = resultPassword
+		err = errors.Wrap(stf4go.ErrPassword, "user %s login from %s failed", user, conn.RemoteAddr().String())
+	}
+
+	if _, writeErr := conn.Write([]byte{result}); writeErr != nil && err == nil {
+		err = errors.Wrap(writeErr, "login handshake write result error")
+	}
+
+	if err != nil {
+		transport.W("login from {@raddr} failed {@err}", conn.RemoteAddr().String(), err)
+		return nil, err
+	}
+
+	return newLoginConn(conn, user), nil
+}
+
+// loginConn the logged in conn, reads and writes pass through to the underlying conn unchanged
+type loginConn struct {
+	stf4go.Conn
+	laddr multiaddr.Multiaddr
+	raddr multiaddr.Multiaddr
+	user  string
+}
+
+func newLoginConn(underlying stf4go.Conn, user string) *loginConn {
+	return &loginConn{
+		Conn:  underlying,
+		laddr: underlying.LocalAddr().Encapsulate(loginMultiAddr),
+		raddr: underlying.RemoteAddr().Encapsulate(loginMultiAddr),
+		user:  user,
+	}
+}
+
+func (conn *loginConn) LocalAddr() multiaddr.Multiaddr {
+	return conn.laddr
+}
+
+func (conn *loginConn) RemoteAddr() multiaddr.Multiaddr {
+	return conn.raddr
+}
+
+func (conn *loginConn) Underlying() stf4go.Conn {
+	return conn.Conn
+}
+
+func (conn *loginConn) CloseWrite() error {
+	return stf4go.CloseWrite(conn.Conn)
+}
+
+func (conn *loginConn) CloseRead() error {
+	return stf4go.CloseRead(conn.Conn)
+}
+
+func (conn *loginConn) User() string {
+	return conn.user
+}
+
+func init() {
+	stf4go.RegisterTransport(newLoginTransport())
+}
+
+// Conn .
+type Conn interface {
+	stf4go.Conn
+	// User the logged in user name
+	User() string
+}
@@ -0,0 +1,271 @@
+package login
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/libs4go/errors"
+	"github.com/libs4go/scf4go"
+	"github.com/libs4go/scf4go/reader/memory"
+	"github.com/libs4go/slf4go"
+	_ "github.com/libs4go/slf4go/backend/console" //
+	"github.com/libs4go/stf4go"
+	_ "github.com/libs4go/stf4go/transports/tcp" //
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var loggerjson = `
+{
+	"default":{
+		"backend":"console",
+		"level":"debug"
+	},
+	"backend":{
+		"console":{
+			"formatter":{
+				"output": "@t @l @s @m"
+			}
+		}
+	}
+}
+`
+
+func init() {
+	config := scf4go.New()
+
+	err := config.Load(memory.New(memory.Data(loggerjson, "json")))
+
+	if err != nil {
+		panic(err)
+	}
+
+	err = slf4go.Config(config)
+
+	if err != nil {
+		panic(err)
+	}
+}
+
+func htpasswd(t *testing.T, users map[string]string) Verifier {
+	var buff bytes.Buffer
+
+	fmt.Fprintln(&buff, "# generated")
+	fmt.Fprintln(&buff, "md5user:$apr1$salt$hash")
+
+	for user, password := range users {
+		hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+
+		require.NoError(t, err)
+
+		fmt.Fprintf(&buff, "%s:%s\n", user, hashed)
+	}
+
+	verifier, err := HtpasswdVerifier(&buff)
+
+	require.NoError(t, err)
+
+	return verifier
+}
+
+func TestVerifier(t *testing.T) {
+	users := map[string]string{"alice": "wonderland", "bob": "builder"}
+
+	for _, verifier := range []Verifier{StaticVerifier(users), htpasswd(t, users)} {
+		for user, password := range users {
+			hashed, ok := verifier.Hash(user)
+
+			require.True(t, ok)
+			require.NoError(t, bcrypt.CompareHashAndPassword(hashed, []byte(password)))
+		}
+
+		_, ok := verifier.Hash("carol")
+
+		require.False(t, ok)
+
+		_, ok = verifier.Hash("md5user")
+
+		require.False(t, ok)
+	}
+}
+
+func TestBcryptHash(t *testing.T) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte("wonderland"), bcrypt.MinCost)
+
+	require.NoError(t, err)
+
+	computed, err := bcryptHash([]byte("wonderland"), hashed[:settingLen])
+
+	require.NoError(t, err)
+
+	require.Equal(t, string(hashed), string(computed))
+
+	computed, err = bcryptHash([]byte("looking glass"), hashed[:settingLen])
+
+	require.NoError(t, err)
+
+	require.NotEqual(t, string(hashed), string(computed))
+
+	require.Equal(t, string(unknownSetting("carol")), string(unknownSetting("carol")))
+
+	_, _, err = parseSetting(unknownSetting("carol"))
+
+	require.NoError(t, err)
+
+	_, err = bcryptHash([]byte("wonderland"), []byte("$2a$31$"+string(hashed[7:settingLen])))
+
+	require.Error(t, err)
+}
+
+// recordConn records the bytes the client writes
+type recordConn struct {
+	stf4go.Conn
+	written bytes.Buffer
+}
+
+func (conn *recordConn) Write(b []byte) (int, error) {
+	conn.written.Write(b)
+
+	return conn.Conn.Write(b)
+}
+
+func TestChallenge(t *testing.T) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte("wonderland"), bcrypt.MinCost)
+
+	require.NoError(t, err)
+
+	nonce := bytes.Repeat([]byte{1}, nonceLen)
+	other := bytes.Repeat([]byte{2}, nonceLen)
+
+	// a recorded proof does not answer another challenge
+	require.NotEqual(t, proof(hashed, nonce), proof(hashed, other))
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1879/login")
+
+	require.NoError(t, err)
+
+	verifier := VerifierF(func(user string) ([]byte, bool) {
+		return hashed, user == "alice"
+	})
+
+	listener, err := stf4go.Listen(laddr, WithVerifier(verifier))
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	accepted := make(chan error, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+
+		if err == nil {
+			conn.Close()
+		}
+
+		accepted <- err
+	}()
+
+	// the client side of the handshake runs on the plain tcp conn, so its writes can be recorded
+	raddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1879")
+
+	require.NoError(t, err)
+
+	conn, err := stf4go.Dial(context.Background(), raddr)
+
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	record := &recordConn{Conn: conn}
+
+	_, err = newLoginTransport().Client(record, laddr, &stf4go.Options{Config: loginConfig(t, "alice", "wonderland")})
+
+	require.NoError(t, err)
+
+	require.NoError(t, <-accepted)
+
+	// neither the password nor its hash is on the wire
+	require.False(t, bytes.Contains(record.written.Bytes(), []byte("wonderland")))
+	require.False(t, bytes.Contains(record.written.Bytes(), hashed[settingLen:]))
+}
+
+func loginConfig(t *testing.T, user, password string) scf4go.Config {
+	config := scf4go.New()
+
+	err := config.Load(memory.New(memory.Data(fmt.Sprintf(`{"login":{"user":%q,"password":%q}}`, user, password), "json")))
+
+	require.NoError(t, err)
+
+	return config
+}
+
+func TestLogin(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1845/login")
+
+	require.NoError(t, err)
+
+	listener, err := stf4go.Listen(laddr, WithVerifier(htpasswd(t, map[string]string{"alice": "wonderland"})))
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	go func() {
+		conn, err := stf4go.Dial(context.Background(), laddr, WithCredentials("alice", "wonderland"))
+
+		require.NoError(t, err)
+
+		require.Equal(t, "alice", conn.(Conn).User())
+
+		_, err = conn.Write([]byte("hello world"))
+
+		require.NoError(t, err)
+	}()
+
+	conn, err := listener.Accept()
+
+	require.NoError(t, err)
+
+	require.Equal(t, "alice", conn.(Conn).User())
+
+	var buff [11]byte
+
+	_, err = io.ReadFull(conn, buff[:])
+
+	require.NoError(t, err)
+
+	require.Equal(t, "hello world", string(buff[:]))
+}
+
+func TestWrongPassword(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1846/login")
+
+	require.NoError(t, err)
+
+	listener, err := stf4go.Listen(laddr, WithVerifier(StaticVerifier(map[string]string{"alice": "wonderland"})))
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	accepted := make(chan error, 1)
+
+	go func() {
+		_, err := listener.Accept()
+
+		accepted <- err
+	}()
+
+	_, err = stf4go.Dial(context.Background(), laddr, WithCredentials("alice", "looking glass"))
+
+	require.True(t, errors.Is(err, stf4go.ErrPassword))
+
+	require.True(t, errors.Is(<-accepted, stf4go.ErrPassword))
+}
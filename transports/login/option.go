@@ -0,0 +1,54 @@
+package login
+
+import (
+	"github.com/libs4go/errors"
+	"github.com/libs4go/stf4go"
+)
+
+func getCredentials(options *stf4go.Options) (*credentials, error) {
+	user := options.Config.Get("login", "user").String("")
+
+	if user == "" {
+		return nil, errors.Wrap(stf4go.ErrResource, "expect login user")
+	}
+
+	return &credentials{
+		User:     user,
+		Password: options.Config.Get("login", "password").String(""),
+	}, nil
+}
+
+func getVerifier(options *stf4go.Options) (Verifier, error) {
+	obj, ok := options.GetObj("login", "verifier")
+
+	if !ok {
+		return nil, errors.Wrap(stf4go.ErrResource, "expect login verifier")
+	}
+
+	verifier, ok := obj.(Verifier)
+
+	if !ok {
+		return nil, errors.Wrap(stf4go.ErrResource, "expect login verifier")
+	}
+
+	return verifier, nil
+}
+
+// WithCredentials set the user and password the client logs in with
+func WithCredentials(user, password string) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetConfig(user, "login", "user")
+		options.SetConfig(password, "login", "password")
+
+		return nil
+	}
+}
+
+// WithVerifier set the server side credentials verifier
+func WithVerifier(verifier Verifier) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetObject(verifier, "login", "verifier")
+
+		return nil
+	}
+}
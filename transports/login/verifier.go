@@ -0,0 +1,120 @@
+package login
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/libs4go/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Verifier look up the bcrypt hash of the user password on the server side, the client proves it knows
+// the password with the hash, so neither the password nor the hash is sent
+type Verifier interface {
+	Hash(user string) ([]byte, bool)
+}
+
+// VerifierF function adapter of Verifier
+type VerifierF func(user string) ([]byte, bool)
+
+// Hash implement Verifier
+func (f VerifierF) Hash(user string) ([]byte, bool) {
+	return f(user)
+}
+
+type staticVerifier map[string][]byte
+
+// StaticVerifier verify against the user to plain password map, the passwords are bcrypt hashed once here
+func StaticVerifier(users map[string]string) Verifier {
+	verifier := make(staticVerifier)
+
+	for user, password := range users {
+		if hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost); err == nil {
+			verifier[user] = hashed
+		}
+	}
+
+	return verifier
+}
+
+func (verifier staticVerifier) Hash(user string) ([]byte, bool) {
+	hashed, ok := verifier[user]
+
+	return hashed, ok
+}
+
+// unknownSecret keys the salts of unknown users, so the challenge does not tell which users exist
+var unknownSecret []byte
+var unknownOnce sync.Once
+
+// unknownSetting stable bcrypt setting for the user without hash
+func unknownSetting(user string) []byte {
+	unknownOnce.Do(func() {
+		unknownSecret = make([]byte, 32)
+		rand.Read(unknownSecret)
+	})
+
+	mac := hmac.New(sha256.New, unknownSecret)
+
+	mac.Write([]byte(user))
+
+	return []byte(fmt.Sprintf("$2a$%02d$%s", bcrypt.DefaultCost, bcryptEncoding.EncodeToString(mac.Sum(nil)[:16])))
+}
+
+type htpasswdVerifier map[string][]byte
+
+// HtpasswdVerifier verify against the bcrypt entries of a htpasswd file, e.g. from htpasswd -B,
+// lines of other hash schemes are skipped
+func HtpasswdVerifier(reader io.Reader) (Verifier, error) {
+	verifier := make(htpasswdVerifier)
+
+	scanner := bufio.NewScanner(reader)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(line, ":", 2)
+
+		if len(fields) != 2 || len(fields[1]) != hashLen || !strings.HasPrefix(fields[1], "$2") {
+			continue
+		}
+
+		verifier[fields[0]] = []byte(fields[1])
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "read htpasswd error")
+	}
+
+	return verifier, nil
+}
+
+// LoadHtpasswd load HtpasswdVerifier from file
+func LoadHtpasswd(path string) (Verifier, error) {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "open htpasswd %s error", path)
+	}
+
+	defer file.Close()
+
+	return HtpasswdVerifier(file)
+}
+
+func (verifier htpasswdVerifier) Hash(user string) ([]byte, bool) {
+	hashed, ok := verifier[user]
+
+	return hashed, ok
+}
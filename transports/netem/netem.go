@@ -0,0 +1,558 @@
+package netem
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"io"
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libs4go/errors"
+	"github.com/libs4go/slf4go"
+	"github.com/libs4go/stf4go"
+	"github.com/multiformats/go-multiaddr"
+)
+
+const protocolNetemID = 495
+
+var protoNetem = multiaddr.Protocol{
+	Name:  "netem",
+	Code:  protocolNetemID,
+	VCode: multiaddr.CodeToVarint(protocolNetemID),
+}
+
+var netemMultiAddr multiaddr.Multiaddr
+
+func init() {
+
+	if err := multiaddr.AddProtocol(protoNetem); err != nil {
+		panic(err)
+	}
+
+	var err error
+	netemMultiAddr, err = multiaddr.NewMultiaddr("/netem")
+	if err != nil {
+		panic(err)
+	}
+}
+
+const errVendor = "stf4go-transport-netem"
+
+// errors
+var (
+	ErrReset    = errors.New("netem reset", errors.WithVendor(errVendor), errors.WithCode(-1))
+	ErrTooLarge = errors.New("netem datagram too large", errors.WithVendor(errVendor), errors.WithCode(-2))
+)
+
+// maxDatagram datagrams are sent with a 2 bytes length
+const maxDatagram = math.MaxUint16
+
+// queueLen max writes waiting for their delay, Write blocks while the queue is full
+const queueLen = 1024
+
+// closeTimeout bounds the flush of the queued writes after the last due time, Close closes the
+// underlying conn then even if the peer does not read
+const closeTimeout = 5 * time.Second
+
+type netemTransport struct {
+	slf4go.Logger
+}
+
+func newNetemTransport() *netemTransport {
+	return &netemTransport{
+		Logger: slf4go.Get("stf4go-transport-netem"),
+	}
+}
+
+func (transport *netemTransport) String() string {
+	return "stf4go-transport-netem"
+}
+
+func (transport *netemTransport) Protocols() []multiaddr.Protocol {
+	return []multiaddr.Protocol{
+		protoNetem,
+	}
+}
+
+func (transport *netemTransport) Client(conn stf4go.Conn, raddr multiaddr.Multiaddr, options *stf4go.Options) (stf4go.Conn, error) {
+	p, err := getParams(raddr, options)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return newNetemConn(transport.Logger, conn, p), nil
+}
+
+func (transport *netemTransport) Server(conn stf4go.Conn, laddr multiaddr.Multiaddr, options *stf4go.Options) (stf4go.Conn, error) {
+	p, err := getParams(laddr, options)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return newNetemConn(transport.Logger, conn, p), nil
+}
+
+// packet a write waiting for its due time, closeWrite and close packets end the queue
+type packet struct {
+	data       []byte
+	due        time.Time
+	seq        uint64
+	closeWrite bool
+	close      bool
+}
+
+// packetQueue min heap by due time, the write order breaks ties
+type packetQueue []*packet
+
+func (q packetQueue) Len() int { return len(q) }
+
+func (q packetQueue) Less(i, j int) bool {
+	if q[i].due.Equal(q[j].due) {
+		return q[i].seq < q[j].seq
+	}
+
+	return q[i].due.Before(q[j].due)
+}
+
+func (q packetQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *packetQueue) Push(x interface{}) { *q = append(*q, x.(*packet)) }
+
+func (q *packetQueue) Pop() interface{} {
+	old := *q
+	p := old[len(old)-1]
+	*q = old[:len(old)-1]
+
+	return p
+}
+
+// Stats fault counters of the written data
+type Stats struct {
+	Writes    uint64
+	Dropped   uint64
+	Reordered uint64
+	Corrupted uint64
+}
+
+// netemConn injects the faults into the writes, a sender goroutine writes them to the underlying conn
+// once due, the reads are not delayed, so both ends need /netem to disturb both directions
+type netemConn struct {
+	stats       Stats
+	logger      slf4go.Logger
+	underlying  stf4go.Conn
+	laddr       multiaddr.Multiaddr
+	raddr       multiaddr.Multiaddr
+	params      *params
+	reader      *bufio.Reader // datagram mode
+	rlock       sync.Mutex
+	wlock       sync.Mutex
+	rng         *rand.Rand // guarded by wlock
+	seq         uint64
+	lastDue     time.Time // the latest due of the writes, the close packets are queued after it
+	writeClosed bool
+	closed      bool
+	qlock       sync.Mutex
+	queue       packetQueue
+	wake        chan struct{}
+	slots       chan struct{}
+	closing     chan struct{} // closed by Close, wakes the writes waiting for a slot
+	sent        chan struct{} // closed by the sender after it closed the underlying conn
+	err         atomic.Value
+}
+
+func newNetemConn(logger slf4go.Logger, underlying stf4go.Conn, p *params) *netemConn {
+	seed := p.seed
+
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	conn := &netemConn{
+		logger:     logger,
+		underlying: underlying,
+		laddr:      underlying.LocalAddr().Encapsulate(netemMultiAddr),
+		raddr:      underlying.RemoteAddr().Encapsulate(netemMultiAddr),
+		params:     p,
+		rng:        rand.New(rand.NewSource(seed)),
+		wake:       make(chan struct{}, 1),
+		slots:      make(chan struct{}, queueLen),
+		closing:    make(chan struct{}),
+		sent:       make(chan struct{}),
+	}
+
+	if p.datagram {
+		conn.reader = bufio.NewReader(underlying)
+	}
+
+	go conn.sendLoop()
+
+	return conn
+}
+
+func (conn *netemConn) hit(p float64) bool {
+	return p > 0 && conn.rng.Float64() < p
+}
+
+// Write wait for a free slot of the queue before taking the write lock, so Close is not blocked by it
+func (conn *netemConn) Write(b []byte) (int, error) {
+	select {
+	case conn.slots <- struct{}{}:
+	case <-conn.closing:
+		return 0, io.ErrClosedPipe
+	}
+
+	queued := false
+
+	defer func() {
+		if !queued {
+			<-conn.slots
+		}
+	}()
+
+	conn.wlock.Lock()
+	defer conn.wlock.Unlock()
+
+	if err, ok := conn.err.Load().(error); ok {
+		return 0, err
+	}
+
+	if conn.writeClosed {
+		return 0, io.ErrClosedPipe
+	}
+
+	if conn.params.datagram && len(b) > maxDatagram {
+		return 0, errors.Wrap(ErrTooLarge, "write %d bytes, max %d", len(b), maxDatagram)
+	}
+
+	atomic.AddUint64(&conn.stats.Writes, 1)
+
+	if conn.hit(conn.params.reset) {
+		conn.reset()
+		return 0, conn.err.Load().(error)
+	}
+
+	if conn.hit(conn.params.loss) {
+		atomic.AddUint64(&conn.stats.Dropped, 1)
+		return len(b), nil
+	}
+
+	var data []byte
+
+	if conn.params.datagram {
+		data = make([]byte, 2+len(b))
+		binary.BigEndian.PutUint16(data, uint16(len(b)))
+		copy(data[2:], b)
+	} else {
+		data = append([]byte{}, b...)
+	}
+
+	if conn.hit(conn.params.corrupt) && len(b) > 0 {
+		// the datagram length is left intact
+		i := len(data) - len(b) + conn.rng.Intn(len(b))
+
+		data[i] ^= 1 << uint(conn.rng.Intn(8))
+
+		atomic.AddUint64(&conn.stats.Corrupted, 1)
+	}
+
+	due := time.Now().Add(conn.delay())
+
+	if conn.params.datagram {
+		if conn.hit(conn.params.reorder) {
+			due = time.Now()
+			atomic.AddUint64(&conn.stats.Reordered, 1)
+		}
+	} else if due.Before(conn.lastDue) {
+		// the stream must not be reordered
+		due = conn.lastDue
+	}
+
+	if due.After(conn.lastDue) {
+		conn.lastDue = due
+	}
+
+	queued = true
+
+	conn.push(&packet{data: data, due: due})
+
+	return len(b), nil
+}
+
+func (conn *netemConn) delay() time.Duration {
+	delay := conn.params.delay
+
+	if jitter := conn.params.jitter; jitter > 0 {
+		delay += time.Duration(conn.rng.Int63n(int64(2*jitter)+1)) - jitter
+	}
+
+	if delay < 0 {
+		return 0
+	}
+
+	return delay
+}
+
+// reset close the underlying conn at once, the queued writes are lost
+func (conn *netemConn) reset() {
+	conn.logger.W("netem reset conn {@raddr}", conn.raddr.String())
+
+	conn.err.Store(errors.Wrap(ErrReset, "conn %s", conn.raddr.String()))
+
+	conn.underlying.Close()
+}
+
+func (conn *netemConn) push(p *packet) {
+	conn.qlock.Lock()
+
+	p.seq = conn.seq
+	conn.seq++
+
+	heap.Push(&conn.queue, p)
+
+	conn.qlock.Unlock()
+
+	select {
+	case conn.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next wait the first due packet
+func (conn *netemConn) next() *packet {
+	for {
+		conn.qlock.Lock()
+
+		if len(conn.queue) == 0 {
+			conn.qlock.Unlock()
+			<-conn.wake
+			continue
+		}
+
+		wait := time.Until(conn.queue[0].due)
+
+		if wait <= 0 {
+			p := heap.Pop(&conn.queue).(*packet)
+			conn.qlock.Unlock()
+
+			return p
+		}
+
+		conn.qlock.Unlock()
+
+		timer := time.NewTimer(wait)
+
+		select {
+		case <-conn.wake:
+		case <-timer.C:
+		}
+
+		timer.Stop()
+	}
+}
+
+func (conn *netemConn) sendLoop() {
+	defer close(conn.sent)
+
+	var nextFree time.Time
+
+	for {
+		p := conn.next()
+
+		if p.close {
+			conn.underlying.Close()
+			return
+		}
+
+		if p.closeWrite {
+			if err := stf4go.CloseWrite(conn.underlying); err != nil {
+				conn.logger.W("netem close write {@raddr} error {@err}", conn.raddr.String(), err)
+			}
+
+			continue
+		}
+
+		if _, ok := conn.err.Load().(error); ok {
+			// the queued writes are dropped
+			<-conn.slots
+			continue
+		}
+
+		if rate := conn.params.rate; rate > 0 {
+			start := time.Now()
+
+			if nextFree.After(start) {
+				time.Sleep(nextFree.Sub(start))
+				start = nextFree
+			}
+
+			nextFree = start.Add(time.Duration(int64(len(p.data)) * int64(time.Second) / int64(rate)))
+		}
+
+		if _, err := conn.underlying.Write(p.data); err != nil {
+			conn.err.Store(err)
+		}
+
+		<-conn.slots
+	}
+}
+
+func (conn *netemConn) Read(b []byte) (int, error) {
+	n, err := conn.read(b)
+
+	if reset, ok := conn.err.Load().(error); ok && err != nil && errors.Is(reset, ErrReset) {
+		return n, reset
+	}
+
+	return n, err
+}
+
+func (conn *netemConn) read(b []byte) (int, error) {
+	if !conn.params.datagram {
+		return conn.underlying.Read(b)
+	}
+
+	conn.rlock.Lock()
+	defer conn.rlock.Unlock()
+
+	var header [2]byte
+
+	if _, err := io.ReadFull(conn.reader, header[:]); err != nil {
+		return 0, err
+	}
+
+	length := int(binary.BigEndian.Uint16(header[:]))
+
+	n := length
+
+	if n > len(b) {
+		n = len(b)
+	}
+
+	if _, err := io.ReadFull(conn.reader, b[:n]); err != nil {
+		return 0, unexpected(err)
+	}
+
+	if _, err := conn.reader.Discard(length - n); err != nil {
+		return 0, unexpected(err)
+	}
+
+	return n, nil
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
+// Close close the underlying conn after the queued writes are sent, or closeTimeout after their due time
+// at the latest, the reads are shut down at once
+func (conn *netemConn) Close() error {
+	conn.wlock.Lock()
+	defer conn.wlock.Unlock()
+
+	if conn.closed {
+		return nil
+	}
+
+	conn.closed = true
+	conn.writeClosed = true
+
+	close(conn.closing)
+
+	conn.push(&packet{close: true, due: conn.lastDue})
+
+	go conn.flush(time.Until(conn.lastDue) + closeTimeout)
+
+	if _, ok := conn.underlying.(stf4go.HalfCloser); ok {
+		stf4go.CloseRead(conn.underlying)
+	}
+
+	return nil
+}
+
+// flush close the underlying conn if the sender did not within timeout, the blocked sender write fails
+// and the remaining queued writes are dropped
+func (conn *netemConn) flush(timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-conn.sent:
+	case <-timer.C:
+		conn.logger.W("netem close {@raddr}, queued writes not sent in {@timeout}", conn.raddr.String(), timeout)
+		conn.underlying.Close()
+	}
+}
+
+func (conn *netemConn) LocalAddr() multiaddr.Multiaddr {
+	return conn.laddr
+}
+
+func (conn *netemConn) RemoteAddr() multiaddr.Multiaddr {
+	return conn.raddr
+}
+
+func (conn *netemConn) SetDeadline(t time.Time) error {
+	return conn.underlying.SetDeadline(t)
+}
+
+func (conn *netemConn) SetReadDeadline(t time.Time) error {
+	return conn.underlying.SetReadDeadline(t)
+}
+
+// SetWriteDeadline the deadline applies to the delayed writes of the sender, the Write does not block
+func (conn *netemConn) SetWriteDeadline(t time.Time) error {
+	return conn.underlying.SetWriteDeadline(t)
+}
+
+func (conn *netemConn) Underlying() stf4go.Conn {
+	return conn.underlying
+}
+
+// CloseWrite half-close the underlying conn after the queued writes are sent
+func (conn *netemConn) CloseWrite() error {
+	conn.wlock.Lock()
+	defer conn.wlock.Unlock()
+
+	if conn.writeClosed {
+		return nil
+	}
+
+	conn.writeClosed = true
+
+	conn.push(&packet{closeWrite: true, due: conn.lastDue})
+
+	return nil
+}
+
+func (conn *netemConn) CloseRead() error {
+	return stf4go.CloseRead(conn.underlying)
+}
+
+func (conn *netemConn) Stats() *Stats {
+	return &Stats{
+		Writes:    atomic.LoadUint64(&conn.stats.Writes),
+		Dropped:   atomic.LoadUint64(&conn.stats.Dropped),
+		Reordered: atomic.LoadUint64(&conn.stats.Reordered),
+		Corrupted: atomic.LoadUint64(&conn.stats.Corrupted),
+	}
+}
+
+func init() {
+	stf4go.RegisterTransport(newNetemTransport())
+}
+
+// Conn .
+type Conn interface {
+	stf4go.Conn
+	Stats() *Stats
+}
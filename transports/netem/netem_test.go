@@ -0,0 +1,376 @@
+package netem
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/libs4go/errors"
+	"github.com/libs4go/scf4go"
+	"github.com/libs4go/scf4go/reader/memory"
+	"github.com/libs4go/slf4go"
+	_ "github.com/libs4go/slf4go/backend/console" //
+	"github.com/libs4go/stf4go"
+	_ "github.com/libs4go/stf4go/transports/tcp" //
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+var loggerjson = `
+{
+	"default":{
+		"backend":"console",
+		"level":"debug"
+	},
+	"backend":{
+		"console":{
+			"formatter":{
+				"output": "@t @l @s @m"
+			}
+		}
+	}
+}
+`
+
+func init() {
+	config := scf4go.New()
+
+	err := config.Load(memory.New(memory.Data(loggerjson, "json")))
+
+	if err != nil {
+		panic(err)
+	}
+
+	err = slf4go.Config(config)
+
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestLatency(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1861/netem/delay/50ms")
+
+	require.NoError(t, err)
+
+	listener, err := stf4go.Listen(laddr)
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+
+		require.NoError(t, err)
+
+		defer conn.Close()
+
+		io.Copy(conn, conn)
+	}()
+
+	conn, err := stf4go.Dial(context.Background(), laddr)
+
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	start := time.Now()
+
+	_, err = conn.Write([]byte("hello"))
+
+	require.NoError(t, err)
+
+	buff := make([]byte, 5)
+
+	_, err = io.ReadFull(conn, buff)
+
+	require.NoError(t, err)
+
+	require.Equal(t, "hello", string(buff))
+
+	// both directions are delayed
+	require.True(t, time.Since(start) >= 100*time.Millisecond)
+}
+
+func TestRate(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1862/netem")
+
+	require.NoError(t, err)
+
+	listener, err := stf4go.Listen(laddr)
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	received := make(chan []byte, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+
+		require.NoError(t, err)
+
+		defer conn.Close()
+
+		buff, err := ioutil.ReadAll(conn)
+
+		require.NoError(t, err)
+
+		received <- buff
+	}()
+
+	conn, err := stf4go.Dial(context.Background(), laddr, WithRate(64*1024))
+
+	require.NoError(t, err)
+
+	start := time.Now()
+
+	data := bytes.Repeat([]byte("x"), 32*1024)
+
+	for i := 0; i < 32; i++ {
+		_, err := conn.Write(data[i*1024 : (i+1)*1024])
+
+		require.NoError(t, err)
+	}
+
+	conn.Close()
+
+	require.Equal(t, data, <-received)
+
+	// 31 writes wait for the bandwidth
+	require.True(t, time.Since(start) >= 450*time.Millisecond)
+}
+
+// exchange send count datagrams over a new conn and return the ones the listener received
+func exchange(t *testing.T, listener stf4go.Listener, count int, options ...stf4go.Option) ([][]byte, *Stats) {
+
+	received := make(chan [][]byte, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+
+		require.NoError(t, err)
+
+		defer conn.Close()
+
+		var datagrams [][]byte
+
+		for {
+			buff := make([]byte, 64)
+
+			n, err := conn.Read(buff)
+
+			if err != nil {
+				break
+			}
+
+			datagrams = append(datagrams, buff[:n])
+		}
+
+		received <- datagrams
+	}()
+
+	conn, err := stf4go.Dial(context.Background(), listener.Addr(), options...)
+
+	require.NoError(t, err)
+
+	for i := 0; i < count; i++ {
+		datagram := make([]byte, 16)
+
+		binary.BigEndian.PutUint32(datagram, uint32(i))
+
+		_, err := conn.Write(datagram)
+
+		require.NoError(t, err)
+	}
+
+	stats := conn.(Conn).Stats()
+
+	conn.Close()
+
+	return <-received, stats
+}
+
+func TestReproducible(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1863/netem/loss/0.2/corrupt/0.2/seed/42")
+
+	require.NoError(t, err)
+
+	listener, err := stf4go.Listen(laddr, WithDatagram(true))
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	first, stats := exchange(t, listener, 200, WithDatagram(true))
+
+	require.NotZero(t, stats.Dropped)
+	require.NotZero(t, stats.Corrupted)
+	require.Equal(t, int(stats.Writes-stats.Dropped), len(first))
+
+	second, secondStats := exchange(t, listener, 200, WithDatagram(true))
+
+	require.Equal(t, stats, secondStats)
+	require.Equal(t, first, second)
+}
+
+func TestReorder(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1864/netem/delay/20ms/jitter/5ms/reorder/0.3")
+
+	require.NoError(t, err)
+
+	listener, err := stf4go.Listen(laddr, WithDatagram(true))
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	received, stats := exchange(t, listener, 200, WithDatagram(true))
+
+	require.Len(t, received, 200)
+	require.NotZero(t, stats.Reordered)
+
+	sorted := true
+
+	for i, datagram := range received {
+		require.Len(t, datagram, 16)
+
+		if binary.BigEndian.Uint32(datagram) != uint32(i) {
+			sorted = false
+		}
+	}
+
+	require.False(t, sorted)
+}
+
+func TestReset(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1865/netem/reset/1")
+
+	require.NoError(t, err)
+
+	listener, err := stf4go.Listen(laddr)
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	accepted := make(chan error, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+
+		require.NoError(t, err)
+
+		_, err = conn.Read(make([]byte, 1))
+
+		accepted <- err
+	}()
+
+	conn, err := stf4go.Dial(context.Background(), laddr)
+
+	require.NoError(t, err)
+
+	_, err = conn.Write([]byte("hello"))
+
+	require.True(t, errors.Is(err, ErrReset))
+
+	require.Equal(t, io.EOF, <-accepted)
+
+	_, err = conn.Read(make([]byte, 1))
+
+	require.True(t, errors.Is(err, ErrReset))
+}
+
+func TestInvalidParameter(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1866")
+
+	require.NoError(t, err)
+
+	listener, err := stf4go.Listen(laddr)
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	go listener.Accept()
+
+	raddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1866/netem/loss/2")
+
+	require.NoError(t, err)
+
+	_, err = stf4go.Dial(context.Background(), raddr)
+
+	require.True(t, errors.Is(err, stf4go.ErrMultiAddr))
+}
+
+func TestCloseFlush(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1883/netem")
+
+	require.NoError(t, err)
+
+	listener, err := stf4go.Listen(laddr)
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	closed := make(chan struct{})
+
+	go func() {
+		conn, err := listener.Accept()
+
+		require.NoError(t, err)
+
+		defer conn.Close()
+
+		ioutil.ReadAll(conn)
+
+		close(closed)
+	}()
+
+	conn, err := stf4go.Dial(context.Background(), laddr, WithRate(1024))
+
+	require.NoError(t, err)
+
+	written := make(chan error, 1)
+
+	go func() {
+		// the writes fill the queue far beyond what the rate sends before the close timeout
+		for {
+			if _, err := conn.Write(make([]byte, 1024)); err != nil {
+				written <- err
+				return
+			}
+		}
+	}()
+
+	require.Eventually(t, func() bool {
+		return conn.(Conn).Stats().Writes >= queueLen
+	}, time.Second, 10*time.Millisecond)
+
+	start := time.Now()
+
+	require.NoError(t, conn.Close())
+
+	require.True(t, time.Since(start) < 100*time.Millisecond)
+
+	require.Equal(t, io.ErrClosedPipe, <-written)
+
+	select {
+	case <-closed:
+	case <-time.After(closeTimeout + time.Second):
+		require.Fail(t, "underlying conn not closed after the close timeout")
+	}
+}
@@ -0,0 +1,232 @@
+package netem
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/libs4go/errors"
+	"github.com/libs4go/stf4go"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// netem parameters, e.g. /netem/delay/50ms/jitter/10ms/loss/0.01, they override the options
+var parameters = []multiaddr.Protocol{
+	newParameter("delay", 497),
+	newParameter("jitter", 498),
+	newParameter("rate", 499),
+	newParameter("loss", 500),
+	newParameter("reorder", 501),
+	newParameter("corrupt", 502),
+	newParameter("reset", 503),
+	newParameter("seed", 504),
+}
+
+func newParameter(name string, code int) multiaddr.Protocol {
+	return multiaddr.Protocol{
+		Name:       name,
+		Code:       code,
+		VCode:      multiaddr.CodeToVarint(code),
+		Size:       multiaddr.LengthPrefixedVarSize,
+		Transcoder: multiaddr.TranscoderDns,
+	}
+}
+
+func init() {
+	for _, protocol := range parameters {
+		if err := multiaddr.AddProtocol(protocol); err != nil {
+			panic(err)
+		}
+
+		stf4go.RegisterParameter(protocol)
+	}
+}
+
+// params fault injection parameters, the probabilities are per Write
+type params struct {
+	delay    time.Duration
+	jitter   time.Duration
+	rate     int // bytes per second, 0 unlimited
+	loss     float64
+	reorder  float64 // datagram mode only
+	corrupt  float64
+	reset    float64
+	seed     int64 // 0 seeds from the clock
+	datagram bool
+}
+
+func getParams(addr multiaddr.Multiaddr, options *stf4go.Options) (*params, error) {
+	config := options.Config
+
+	p := &params{
+		delay:    config.Get("netem", "delay").Duration(0),
+		jitter:   config.Get("netem", "jitter").Duration(0),
+		rate:     config.Get("netem", "rate").Int(0),
+		loss:     config.Get("netem", "loss").Float64(0),
+		reorder:  config.Get("netem", "reorder").Float64(0),
+		corrupt:  config.Get("netem", "corrupt").Float64(0),
+		reset:    config.Get("netem", "reset").Float64(0),
+		seed:     int64(config.Get("netem", "seed").Int(0)),
+		datagram: config.Get("netem", "datagram").Bool(false),
+	}
+
+	for _, protocol := range parameters {
+		value, err := addr.ValueForProtocol(protocol.Code)
+
+		if err != nil {
+			continue
+		}
+
+		if err := p.set(protocol.Name, value); err != nil {
+			return nil, errors.Wrap(stf4go.ErrMultiAddr, "netem parameter /%s/%s error: %s", protocol.Name, value, err)
+		}
+	}
+
+	return p, nil
+}
+
+func (p *params) set(name string, value string) error {
+	var err error
+
+	switch name {
+	case "delay":
+		p.delay, err = time.ParseDuration(value)
+	case "jitter":
+		p.jitter, err = time.ParseDuration(value)
+	case "rate":
+		p.rate, err = strconv.Atoi(value)
+	case "loss":
+		p.loss, err = parseProbability(value)
+	case "reorder":
+		p.reorder, err = parseProbability(value)
+	case "corrupt":
+		p.corrupt, err = parseProbability(value)
+	case "reset":
+		p.reset, err = parseProbability(value)
+	case "seed":
+		p.seed, err = strconv.ParseInt(value, 10, 64)
+	}
+
+	return err
+}
+
+func parseProbability(value string) (float64, error) {
+	p, err := strconv.ParseFloat(value, 64)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if p < 0 || p > 1 {
+		return 0, errors.New("probability out of [0,1]")
+	}
+
+	return p, nil
+}
+
+func checkProbability(name string, p float64) error {
+	if p < 0 || p > 1 {
+		return errors.Wrap(stf4go.ErrResource, "invalid netem %s probability %f", name, p)
+	}
+
+	return nil
+}
+
+// WithLatency delay each write by delay plus a uniform random jitter in [-jitter, jitter],
+// in stream mode the writes keep their order
+func WithLatency(delay, jitter time.Duration) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		if delay < 0 || jitter < 0 {
+			return errors.Wrap(stf4go.ErrResource, "invalid netem latency %s jitter %s", delay, jitter)
+		}
+
+		options.SetConfig(delay.String(), "netem", "delay")
+		options.SetConfig(jitter.String(), "netem", "jitter")
+
+		return nil
+	}
+}
+
+// WithRate cap the write bandwidth to bytes per second, 0 unlimited
+func WithRate(bytesPerSecond int) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		if bytesPerSecond < 0 {
+			return errors.Wrap(stf4go.ErrResource, "invalid netem rate %d", bytesPerSecond)
+		}
+
+		options.SetConfig(bytesPerSecond, "netem", "rate")
+
+		return nil
+	}
+}
+
+// WithLoss drop writes with probability p, the Write still succeeds
+func WithLoss(p float64) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		if err := checkProbability("loss", p); err != nil {
+			return err
+		}
+
+		options.SetConfig(p, "netem", "loss")
+
+		return nil
+	}
+}
+
+// WithReorder send writes at once with probability p, ahead of the delayed ones, datagram mode only
+func WithReorder(p float64) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		if err := checkProbability("reorder", p); err != nil {
+			return err
+		}
+
+		options.SetConfig(p, "netem", "reorder")
+
+		return nil
+	}
+}
+
+// WithCorrupt flip a random bit of writes with probability p
+func WithCorrupt(p float64) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		if err := checkProbability("corrupt", p); err != nil {
+			return err
+		}
+
+		options.SetConfig(p, "netem", "corrupt")
+
+		return nil
+	}
+}
+
+// WithReset close the conn at a Write with probability p, the Write returns ErrReset
+func WithReset(p float64) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		if err := checkProbability("reset", p); err != nil {
+			return err
+		}
+
+		options.SetConfig(p, "netem", "reset")
+
+		return nil
+	}
+}
+
+// WithSeed seed the fault RNG, the same seed and writes give the same faults, 0 seeds from the clock
+func WithSeed(seed int64) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetConfig(seed, "netem", "seed")
+
+		return nil
+	}
+}
+
+// WithDatagram treat each Write as a datagram, the conn keeps the write boundaries and each Read
+// returns one datagram, the remainder of a datagram longer than the Read buffer is discarded.
+// both ends must agree
+func WithDatagram(enable bool) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetConfig(enable, "netem", "datagram")
+
+		return nil
+	}
+}
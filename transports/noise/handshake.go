@@ -0,0 +1,330 @@
+package noise
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+
+	"github.com/libs4go/errors"
+	"github.com/libs4go/stf4go/transports/internal/seal"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Noise_XX_25519_ChaChaPoly_SHA256, see https://noiseprotocol.org/noise.html
+const protocolName = "Noise_XX_25519_ChaChaPoly_SHA256"
+
+const dhLen = 32
+const hashLen = sha256.Size
+const tagLen = seal.TagLen // poly1305 authenticator size
+
+type keypair struct {
+	private [dhLen]byte
+	public  [dhLen]byte
+}
+
+func newKeypair() (*keypair, error) {
+	kp := &keypair{}
+
+	if _, err := io.ReadFull(rand.Reader, kp.private[:]); err != nil {
+		return nil, errors.Wrap(err, "generate x25519 private key error")
+	}
+
+	public, err := curve25519.X25519(kp.private[:], curve25519.Basepoint)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "generate x25519 public key error")
+	}
+
+	copy(kp.public[:], public)
+
+	return kp, nil
+}
+
+func dh(kp *keypair, public []byte) ([]byte, error) {
+	return curve25519.X25519(kp.private[:], public)
+}
+
+// newCipherState noise writes the nonce counter little endian
+func newCipherState(key []byte) (*seal.CipherState, error) {
+	aead, err := chacha20poly1305.New(key)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "create chacha20poly1305 cipher error")
+	}
+
+	return seal.NewCipherState(aead, binary.LittleEndian), nil
+}
+
+type symmetricState struct {
+	*seal.CipherState
+	ck [hashLen]byte
+	h  [hashLen]byte
+}
+
+func newSymmetricState() *symmetricState {
+	ss := &symmetricState{
+		CipherState: seal.NewCipherState(nil, binary.LittleEndian),
+	}
+
+	// protocol name is exactly hashLen bytes, so h is the name itself
+	copy(ss.h[:], protocolName)
+	copy(ss.ck[:], ss.h[:])
+
+	return ss
+}
+
+func (ss *symmetricState) mixKey(ikm []byte) error {
+	var out [2 * hashLen]byte
+
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, ss.ck[:], nil), out[:]); err != nil {
+		return errors.Wrap(err, "noise hkdf error")
+	}
+
+	copy(ss.ck[:], out[:hashLen])
+
+	cs, err := newCipherState(out[hashLen:])
+
+	if err != nil {
+		return err
+	}
+
+	ss.CipherState = cs
+
+	return nil
+}
+
+func (ss *symmetricState) mixHash(data []byte) {
+	hasher := sha256.New()
+	hasher.Write(ss.h[:])
+	hasher.Write(data)
+	hasher.Sum(ss.h[:0])
+}
+
+func (ss *symmetricState) encryptAndHash(out, plaintext []byte) ([]byte, error) {
+	offset := len(out)
+
+	out, err := ss.Encrypt(out, ss.h[:], plaintext)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ss.mixHash(out[offset:])
+
+	return out, nil
+}
+
+func (ss *symmetricState) decryptAndHash(out, ciphertext []byte) ([]byte, error) {
+	out, err := ss.Decrypt(out, ss.h[:], ciphertext)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ss.mixHash(ciphertext)
+
+	return out, nil
+}
+
+func (ss *symmetricState) split() (*seal.CipherState, *seal.CipherState, error) {
+	var out [2 * hashLen]byte
+
+	if _, err := io.ReadFull(hkdf.New(sha256.New, nil, ss.ck[:], nil), out[:]); err != nil {
+		return nil, nil, errors.Wrap(err, "noise hkdf error")
+	}
+
+	c1, err := newCipherState(out[:hashLen])
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c2, err := newCipherState(out[hashLen:])
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return c1, c2, nil
+}
+
+// handshakeState implements the XX pattern:
+//
+//	-> e
+//	<- e, ee, s, es
+//	-> s, se
+type handshakeState struct {
+	ss        *symmetricState
+	initiator bool
+	s         *keypair
+	e         *keypair
+	rs        []byte
+	re        []byte
+}
+
+func newHandshakeState(initiator bool, s *keypair) *handshakeState {
+	hs := &handshakeState{
+		ss:        newSymmetricState(),
+		initiator: initiator,
+		s:         s,
+	}
+
+	// empty prologue
+	hs.ss.mixHash(nil)
+
+	return hs
+}
+
+// writeMessageA initiator: -> e
+func (hs *handshakeState) writeMessageA(payload []byte) ([]byte, error) {
+	e, err := newKeypair()
+
+	if err != nil {
+		return nil, err
+	}
+
+	hs.e = e
+
+	out := append([]byte{}, e.public[:]...)
+
+	hs.ss.mixHash(e.public[:])
+
+	return hs.ss.encryptAndHash(out, payload)
+}
+
+// readMessageA responder: -> e
+func (hs *handshakeState) readMessageA(message []byte) ([]byte, error) {
+	if len(message) < dhLen {
+		return nil, errors.New("noise handshake message A too short")
+	}
+
+	hs.re = append([]byte{}, message[:dhLen]...)
+
+	hs.ss.mixHash(hs.re)
+
+	return hs.ss.decryptAndHash(nil, message[dhLen:])
+}
+
+// writeMessageB responder: <- e, ee, s, es
+func (hs *handshakeState) writeMessageB(payload []byte) ([]byte, error) {
+	e, err := newKeypair()
+
+	if err != nil {
+		return nil, err
+	}
+
+	hs.e = e
+
+	out := append([]byte{}, e.public[:]...)
+
+	hs.ss.mixHash(e.public[:])
+
+	if err := hs.mixDH(hs.e, hs.re); err != nil {
+		return nil, err
+	}
+
+	out, err = hs.ss.encryptAndHash(out, hs.s.public[:])
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := hs.mixDH(hs.s, hs.re); err != nil {
+		return nil, err
+	}
+
+	return hs.ss.encryptAndHash(out, payload)
+}
+
+// readMessageB initiator: <- e, ee, s, es
+func (hs *handshakeState) readMessageB(message []byte) ([]byte, error) {
+	if len(message) < 2*dhLen+tagLen {
+		return nil, errors.New("noise handshake message B too short")
+	}
+
+	hs.re = append([]byte{}, message[:dhLen]...)
+
+	hs.ss.mixHash(hs.re)
+
+	if err := hs.mixDH(hs.e, hs.re); err != nil {
+		return nil, err
+	}
+
+	rs, err := hs.ss.decryptAndHash(nil, message[dhLen:2*dhLen+tagLen])
+
+	if err != nil {
+		return nil, err
+	}
+
+	hs.rs = rs
+
+	if err := hs.mixDH(hs.e, hs.rs); err != nil {
+		return nil, err
+	}
+
+	return hs.ss.decryptAndHash(nil, message[2*dhLen+tagLen:])
+}
+
+// writeMessageC initiator: -> s, se
+func (hs *handshakeState) writeMessageC(payload []byte) ([]byte, error) {
+	out, err := hs.ss.encryptAndHash(nil, hs.s.public[:])
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := hs.mixDH(hs.s, hs.re); err != nil {
+		return nil, err
+	}
+
+	return hs.ss.encryptAndHash(out, payload)
+}
+
+// readMessageC responder: -> s, se
+func (hs *handshakeState) readMessageC(message []byte) ([]byte, error) {
+	if len(message) < dhLen+tagLen {
+		return nil, errors.New("noise handshake message C too short")
+	}
+
+	rs, err := hs.ss.decryptAndHash(nil, message[:dhLen+tagLen])
+
+	if err != nil {
+		return nil, err
+	}
+
+	hs.rs = rs
+
+	if err := hs.mixDH(hs.e, hs.rs); err != nil {
+		return nil, err
+	}
+
+	return hs.ss.decryptAndHash(nil, message[dhLen+tagLen:])
+}
+
+func (hs *handshakeState) mixDH(kp *keypair, public []byte) error {
+	shared, err := dh(kp, public)
+
+	if err != nil {
+		return errors.Wrap(err, "noise dh error")
+	}
+
+	return hs.ss.mixKey(shared)
+}
+
+// split returns the (send, recv) cipher states of the local side
+func (hs *handshakeState) split() (*seal.CipherState, *seal.CipherState, error) {
+	c1, c2, err := hs.ss.split()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if hs.initiator {
+		return c1, c2, nil
+	}
+
+	return c2, c1, nil
+}
@@ -0,0 +1,372 @@
+package noise
+
+import (
+	"crypto/sha256"
+	"encoding/asn1"
+	"sync"
+	"time"
+
+	"github.com/libs4go/bcf4go/key"
+	_ "github.com/libs4go/bcf4go/key/encoding" //
+	_ "github.com/libs4go/bcf4go/key/provider" //
+	"github.com/libs4go/errors"
+	"github.com/libs4go/slf4go"
+	"github.com/libs4go/stf4go"
+	"github.com/libs4go/stf4go/transports/internal/seal"
+	"github.com/multiformats/go-multiaddr"
+)
+
+const protocolNoiseID = 484
+
+var protoNoise = multiaddr.Protocol{
+	Name:  "noise",
+	Code:  protocolNoiseID,
+	VCode: multiaddr.CodeToVarint(protocolNoiseID),
+}
+
+var noiseMultiAddr multiaddr.Multiaddr
+
+func init() {
+
+	if err := multiaddr.AddProtocol(protoNoise); err != nil {
+		panic(err)
+	}
+
+	var err error
+	noiseMultiAddr, err = multiaddr.NewMultiaddr("/noise")
+	if err != nil {
+		panic(err)
+	}
+}
+
+const staticKeyPrefix = "stf4go-transport-noise-static-key:"
+
+type signedKey struct {
+	Provider  string
+	PubKey    []byte
+	Signature []byte
+}
+
+func staticKeyHash(staticKey []byte) []byte {
+	hashed := sha256.Sum256(append([]byte(staticKeyPrefix), staticKey...))
+
+	return hashed[:]
+}
+
+func signStaticKey(k key.Key, staticKey []byte) ([]byte, error) {
+	signature, err := key.SignWithKey(k, staticKeyHash(staticKey))
+
+	if err != nil {
+		return nil, errors.Wrap(err, "sign noise static key error")
+	}
+
+	return asn1.Marshal(signedKey{
+		Provider:  k.Provider().Name(),
+		PubKey:    k.PubKey(),
+		Signature: signature,
+	})
+}
+
+func verifyStaticKey(payload []byte, staticKey []byte) (*stf4go.Peer, error) {
+	var sk signedKey
+
+	if _, err := asn1.Unmarshal(payload, &sk); err != nil {
+		return nil, errors.Wrap(err, "unmarshal noise identity payload error")
+	}
+
+	return stf4go.VerifyPeer(sk.Provider, sk.PubKey, sk.Signature, staticKeyHash(staticKey))
+}
+
+type noiseTransport struct {
+	slf4go.Logger
+}
+
+func newNoiseTransport() *noiseTransport {
+	return &noiseTransport{
+		Logger: slf4go.Get("stf4go-transport-noise"),
+	}
+}
+
+func (transport *noiseTransport) String() string {
+	return "stf4go-transport-noise"
+}
+
+func (transport *noiseTransport) Protocols() []multiaddr.Protocol {
+	return []multiaddr.Protocol{
+		protoNoise,
+	}
+}
+
+func (transport *noiseTransport) Client(conn stf4go.Conn, raddr multiaddr.Multiaddr, options *stf4go.Options) (stf4go.Conn, error) {
+
+	k, err := getKey(options)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := newKeypair()
+
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := signStaticKey(k, s.public[:])
+
+	if err != nil {
+		return nil, err
+	}
+
+	hs := newHandshakeState(true, s)
+
+	message, err := hs.writeMessageA(nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := seal.WriteMessage(conn, message); err != nil {
+		return nil, errors.Wrap(err, "noise handshake write message A error")
+	}
+
+	message, err = seal.ReadMessage(conn)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "noise handshake read message B error")
+	}
+
+	remotePayload, err := hs.readMessageB(message)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "noise handshake error")
+	}
+
+	remotePeer, err := verifyStaticKey(remotePayload, hs.rs)
+
+	if err != nil {
+		return nil, err
+	}
+
+	message, err = hs.writeMessageC(payload)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := seal.WriteMessage(conn, message); err != nil {
+		return nil, errors.Wrap(err, "noise handshake write message C error")
+	}
+
+	return newNoiseConn(hs, conn, stf4go.NewPeer(k.Provider().Name(), k.PubKey()), remotePeer)
+}
+
+func (transport *noiseTransport) Server(conn stf4go.Conn, laddr multiaddr.Multiaddr, options *stf4go.Options) (stf4go.Conn, error) {
+
+	k, err := getKey(options)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := newKeypair()
+
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := signStaticKey(k, s.public[:])
+
+	if err != nil {
+		return nil, err
+	}
+
+	hs := newHandshakeState(false, s)
+
+	message, err := seal.ReadMessage(conn)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "noise handshake read message A error")
+	}
+
+	if _, err := hs.readMessageA(message); err != nil {
+		return nil, errors.Wrap(err, "noise handshake error")
+	}
+
+	message, err = hs.writeMessageB(payload)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := seal.WriteMessage(conn, message); err != nil {
+		return nil, errors.Wrap(err, "noise handshake write message B error")
+	}
+
+	message, err = seal.ReadMessage(conn)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "noise handshake read message C error")
+	}
+
+	remotePayload, err := hs.readMessageC(message)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "noise handshake error")
+	}
+
+	remotePeer, err := verifyStaticKey(remotePayload, hs.rs)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return newNoiseConn(hs, conn, stf4go.NewPeer(k.Provider().Name(), k.PubKey()), remotePeer)
+}
+
+type noiseConn struct {
+	underlying stf4go.Conn
+	laddr      multiaddr.Multiaddr
+	raddr      multiaddr.Multiaddr
+	localPeer  *stf4go.Peer
+	remotePeer *stf4go.Peer
+	send       *seal.CipherState
+	recv       *seal.CipherState
+	rlock      sync.Mutex
+	wlock      sync.Mutex
+	readBuff   []byte
+}
+
+func newNoiseConn(hs *handshakeState, underlying stf4go.Conn, localPeer *stf4go.Peer, remotePeer *stf4go.Peer) (*noiseConn, error) {
+
+	send, recv, err := hs.split()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &noiseConn{
+		underlying: underlying,
+		laddr:      underlying.LocalAddr().Encapsulate(noiseMultiAddr),
+		raddr:      underlying.RemoteAddr().Encapsulate(noiseMultiAddr),
+		localPeer:  localPeer,
+		remotePeer: remotePeer,
+		send:       send,
+		recv:       recv,
+	}, nil
+}
+
+func (conn *noiseConn) Read(b []byte) (int, error) {
+	conn.rlock.Lock()
+	defer conn.rlock.Unlock()
+
+	for len(conn.readBuff) == 0 {
+		message, err := seal.ReadMessage(conn.underlying)
+
+		if err != nil {
+			return 0, err
+		}
+
+		conn.readBuff, err = conn.recv.Decrypt(message[:0], nil, message)
+
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, conn.readBuff)
+
+	conn.readBuff = conn.readBuff[n:]
+
+	return n, nil
+}
+
+func (conn *noiseConn) Write(b []byte) (int, error) {
+	conn.wlock.Lock()
+	defer conn.wlock.Unlock()
+
+	var n int
+
+	for len(b) > 0 {
+		chunk := b
+
+		if len(chunk) > seal.MaxPlaintextLen {
+			chunk = chunk[:seal.MaxPlaintextLen]
+		}
+
+		message, err := conn.send.Encrypt(nil, nil, chunk)
+
+		if err != nil {
+			return n, err
+		}
+
+		if err := seal.WriteMessage(conn.underlying, message); err != nil {
+			return n, err
+		}
+
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+
+	return n, nil
+}
+
+func (conn *noiseConn) Close() error {
+	return conn.underlying.Close()
+}
+
+func (conn *noiseConn) LocalAddr() multiaddr.Multiaddr {
+	return conn.laddr
+}
+
+func (conn *noiseConn) RemoteAddr() multiaddr.Multiaddr {
+	return conn.raddr
+}
+
+func (conn *noiseConn) SetDeadline(t time.Time) error {
+	return conn.underlying.SetDeadline(t)
+}
+
+func (conn *noiseConn) SetReadDeadline(t time.Time) error {
+	return conn.underlying.SetReadDeadline(t)
+}
+
+func (conn *noiseConn) SetWriteDeadline(t time.Time) error {
+	return conn.underlying.SetWriteDeadline(t)
+}
+
+func (conn *noiseConn) Underlying() stf4go.Conn {
+	return conn.underlying
+}
+
+// CloseWrite half-close the underlying conn between two messages, the peer reads io.EOF at the message boundary
+func (conn *noiseConn) CloseWrite() error {
+	conn.wlock.Lock()
+	defer conn.wlock.Unlock()
+
+	return stf4go.CloseWrite(conn.underlying)
+}
+
+func (conn *noiseConn) CloseRead() error {
+	return stf4go.CloseRead(conn.underlying)
+}
+
+func (conn *noiseConn) RemotePeer() *stf4go.Peer {
+	return conn.remotePeer
+}
+
+func (conn *noiseConn) LocalPeer() *stf4go.Peer {
+	return conn.localPeer
+}
+
+func init() {
+	stf4go.RegisterTransport(newNoiseTransport())
+}
+
+// Conn .
+type Conn interface {
+	stf4go.Conn
+	// RemotePeer the verified remote identity
+	RemotePeer() *stf4go.Peer
+	// LocalPeer the local identity
+	LocalPeer() *stf4go.Peer
+}
@@ -0,0 +1,268 @@
+package noise
+
+import (
+	"context"
+	"encoding/asn1"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/libs4go/bcf4go/key"
+	"github.com/libs4go/errors"
+	"github.com/libs4go/scf4go"
+	"github.com/libs4go/scf4go/reader/memory"
+	"github.com/libs4go/slf4go"
+	_ "github.com/libs4go/slf4go/backend/console" //
+	"github.com/libs4go/stf4go"
+	_ "github.com/libs4go/stf4go/transports/tcp" //
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+var loggerjson = `
+{
+	"default":{
+		"backend":"console",
+		"level":"debug"
+	},
+	"backend":{
+		"console":{
+			"formatter":{
+				"output": "@t @l @s @m"
+			}
+		}
+	}
+}
+`
+
+func init() {
+	config := scf4go.New()
+
+	err := config.Load(memory.New(memory.Data(loggerjson, "json")))
+
+	if err != nil {
+		panic(err)
+	}
+
+	err = slf4go.Config(config)
+
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	s1, err := newKeypair()
+
+	require.NoError(t, err)
+
+	s2, err := newKeypair()
+
+	require.NoError(t, err)
+
+	initiator := newHandshakeState(true, s1)
+	responder := newHandshakeState(false, s2)
+
+	message, err := initiator.writeMessageA(nil)
+
+	require.NoError(t, err)
+
+	_, err = responder.readMessageA(message)
+
+	require.NoError(t, err)
+
+	message, err = responder.writeMessageB([]byte("responder"))
+
+	require.NoError(t, err)
+
+	payload, err := initiator.readMessageB(message)
+
+	require.NoError(t, err)
+
+	require.Equal(t, "responder", string(payload))
+
+	require.Equal(t, s2.public[:], initiator.rs)
+
+	message, err = initiator.writeMessageC([]byte("initiator"))
+
+	require.NoError(t, err)
+
+	payload, err = responder.readMessageC(message)
+
+	require.NoError(t, err)
+
+	require.Equal(t, "initiator", string(payload))
+
+	require.Equal(t, s1.public[:], responder.rs)
+
+	send, _, err := initiator.split()
+
+	require.NoError(t, err)
+
+	_, recv, err := responder.split()
+
+	require.NoError(t, err)
+
+	message, err = send.Encrypt(nil, nil, []byte("hello world"))
+
+	require.NoError(t, err)
+
+	plaintext, err := recv.Decrypt(nil, nil, message)
+
+	require.NoError(t, err)
+
+	require.Equal(t, "hello world", string(plaintext))
+
+	message[0] ^= 0xff
+
+	_, err = recv.Decrypt(nil, nil, message)
+
+	require.Error(t, err)
+}
+
+func TestListenConnect(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1814/noise")
+
+	require.NoError(t, err)
+
+	serverKey, err := key.RandomKey("did")
+
+	require.NoError(t, err)
+
+	clientKey, err := key.RandomKey("did")
+
+	require.NoError(t, err)
+
+	listener, err := stf4go.Listen(laddr, WithKey(serverKey))
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	go func() {
+
+		conn, err := stf4go.Dial(context.Background(), laddr, WithKey(clientKey))
+
+		require.NoError(t, err)
+
+		require.Equal(t, serverKey.PubKey(), conn.(Conn).RemotePeer().PubKey)
+
+		_, err = conn.Write([]byte("hello world"))
+
+		require.NoError(t, err)
+	}()
+
+	conn, err := listener.Accept()
+
+	require.NoError(t, err)
+
+	require.Equal(t, clientKey.PubKey(), conn.(Conn).RemotePeer().PubKey)
+
+	require.Equal(t, clientKey.Address(), conn.(Conn).RemotePeer().ID)
+
+	var buff [11]byte
+
+	_, err = io.ReadFull(conn, buff[:])
+
+	require.NoError(t, err)
+
+	require.Equal(t, "hello world", string(buff[:]))
+}
+
+func TestHalfClose(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1833/noise")
+
+	require.NoError(t, err)
+
+	serverKey, err := key.RandomKey("did")
+
+	require.NoError(t, err)
+
+	clientKey, err := key.RandomKey("did")
+
+	require.NoError(t, err)
+
+	listener, err := stf4go.Listen(laddr, WithKey(serverKey))
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+
+		require.NoError(t, err)
+
+		defer conn.Close()
+
+		// read until the client half-closed, then answer on the open direction
+		data, err := ioutil.ReadAll(conn)
+
+		require.NoError(t, err)
+
+		_, err = conn.Write(append([]byte("echo "), data...))
+
+		require.NoError(t, err)
+	}()
+
+	conn, err := stf4go.Dial(context.Background(), laddr, WithKey(clientKey))
+
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello"))
+
+	require.NoError(t, err)
+
+	require.NoError(t, stf4go.CloseWrite(conn))
+
+	data, err := ioutil.ReadAll(conn)
+
+	require.NoError(t, err)
+
+	require.Equal(t, "echo hello", string(data))
+}
+
+func TestForgedIdentity(t *testing.T) {
+	attacker, err := key.RandomKey("did")
+
+	require.NoError(t, err)
+
+	victim, err := key.RandomKey("did")
+
+	require.NoError(t, err)
+
+	staticKey, err := newKeypair()
+
+	require.NoError(t, err)
+
+	payload, err := signStaticKey(attacker, staticKey.public[:])
+
+	require.NoError(t, err)
+
+	peer, err := verifyStaticKey(payload, staticKey.public[:])
+
+	require.NoError(t, err)
+
+	require.Equal(t, attacker.PubKey(), peer.PubKey)
+
+	// the attacker signature with the victim key claimed
+	var sk signedKey
+
+	_, err = asn1.Unmarshal(payload, &sk)
+
+	require.NoError(t, err)
+
+	sk.PubKey = victim.PubKey()
+
+	payload, err = asn1.Marshal(sk)
+
+	require.NoError(t, err)
+
+	_, err = verifyStaticKey(payload, staticKey.public[:])
+
+	require.True(t, errors.Is(err, stf4go.ErrSign))
+}
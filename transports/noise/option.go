@@ -0,0 +1,32 @@
+package noise
+
+import (
+	"github.com/libs4go/bcf4go/key"
+	"github.com/libs4go/errors"
+	"github.com/libs4go/stf4go"
+)
+
+func getKey(options *stf4go.Options) (key.Key, error) {
+	obj, ok := options.GetObj("noise", "key")
+
+	if !ok {
+		return nil, errors.Wrap(stf4go.ErrResource, "expect key")
+	}
+
+	k, ok := obj.(key.Key)
+
+	if !ok {
+		return nil, errors.Wrap(stf4go.ErrResource, "expect key")
+	}
+
+	return k, nil
+}
+
+// WithKey set the identity key used to sign the noise static key
+func WithKey(k key.Key) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetObject(k, "noise", "key")
+
+		return nil
+	}
+}
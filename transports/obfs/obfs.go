@@ -0,0 +1,448 @@
+package obfs
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"math"
+	mrand "math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libs4go/errors"
+	"github.com/libs4go/slf4go"
+	"github.com/libs4go/stf4go"
+	"github.com/libs4go/stf4go/transports/internal/seal"
+	"github.com/multiformats/go-multiaddr"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const protocolObfsID = 493
+
+var protoObfs = multiaddr.Protocol{
+	Name:  "obfs",
+	Code:  protocolObfsID,
+	VCode: multiaddr.CodeToVarint(protocolObfsID),
+}
+
+var obfsMultiAddr multiaddr.Multiaddr
+
+func init() {
+
+	if err := multiaddr.AddProtocol(protoObfs); err != nil {
+		panic(err)
+	}
+
+	var err error
+	obfsMultiAddr, err = multiaddr.NewMultiaddr("/obfs")
+	if err != nil {
+		panic(err)
+	}
+}
+
+const seedLen = 32
+const kdfInfo = "stf4go-transport-obfs"
+
+// tagLen chacha20-poly1305 tag size
+const tagLen = seal.TagLen
+
+// headerLen the sealed payload and padding lengths
+const headerLen = 4 + tagLen
+
+// frameOverhead wire bytes of a frame besides the payload and padding
+const frameOverhead = headerLen + tagLen
+
+// maxBody max payload plus padding of one frame
+const maxBody = math.MaxUint16
+
+// maxPayload max payload of one frame, the rest of the body is left for the padding
+const maxPayload = 16 * 1024
+
+// newCipherState derive the write key of role from the secret and the seed the writer sent,
+// the role keeps a stream from being reflected back to its writer. the header and the body
+// of a frame take one nonce each
+func newCipherState(secret string, seed []byte, role string) (*seal.CipherState, error) {
+	key := make([]byte, chacha20poly1305.KeySize)
+
+	if _, err := io.ReadFull(hkdf.New(sha256.New, []byte(secret), seed, []byte(kdfInfo+":"+role)), key); err != nil {
+		return nil, errors.Wrap(err, "derive obfs key error")
+	}
+
+	aead, err := chacha20poly1305.New(key)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "create chacha20poly1305 cipher error")
+	}
+
+	return seal.NewCipherState(aead, binary.BigEndian), nil
+}
+
+func newSeed() ([]byte, error) {
+	seed := make([]byte, seedLen)
+
+	if _, err := rand.Read(seed); err != nil {
+		return nil, errors.Wrap(err, "generate obfs seed error")
+	}
+
+	return seed, nil
+}
+
+type obfsTransport struct {
+	slf4go.Logger
+}
+
+func newObfsTransport() *obfsTransport {
+	return &obfsTransport{
+		Logger: slf4go.Get("stf4go-transport-obfs"),
+	}
+}
+
+func (transport *obfsTransport) String() string {
+	return "stf4go-transport-obfs"
+}
+
+func (transport *obfsTransport) Protocols() []multiaddr.Protocol {
+	return []multiaddr.Protocol{
+		protoObfs,
+	}
+}
+
+// Client send the seed with a padding frame and return at once, the server seed is read with the
+// first frame. obfs hides the traffic shape only, a recorded client stream can be replayed to the
+// server, run an authenticated layer such as /tls or /noise above it
+func (transport *obfsTransport) Client(conn stf4go.Conn, raddr multiaddr.Multiaddr, options *stf4go.Options) (stf4go.Conn, error) {
+
+	secret, err := getSecret(options)
+
+	if err != nil {
+		return nil, err
+	}
+
+	oc := newObfsConn(conn, secret, "server", options)
+
+	if err := oc.hello("client"); err != nil {
+		return nil, err
+	}
+
+	return oc, nil
+}
+
+// Server check the secret with the first client frame before sending anything, so a prober without
+// the secret reads no byte back
+func (transport *obfsTransport) Server(conn stf4go.Conn, laddr multiaddr.Multiaddr, options *stf4go.Options) (stf4go.Conn, error) {
+
+	secret, err := getSecret(options)
+
+	if err != nil {
+		return nil, err
+	}
+
+	oc := newObfsConn(conn, secret, "client", options)
+
+	if err := oc.readSeed(); err != nil {
+		return nil, err
+	}
+
+	if _, err := oc.readFrame(); err != nil {
+		transport.W("obfs handshake with {@raddr} failed {@err}", conn.RemoteAddr().String(), err)
+		return nil, err
+	}
+
+	if err := oc.hello("server"); err != nil {
+		return nil, err
+	}
+
+	return oc, nil
+}
+
+// Stats obfuscated stream counters, the Bytes are the application data and the Wire the obfuscated data
+type Stats struct {
+	BytesIn  uint64
+	BytesOut uint64
+	WireIn   uint64
+	WireOut  uint64
+}
+
+// Overhead the extra wire bytes per application byte of both directions, 0 before any data
+func (stats *Stats) Overhead() float64 {
+	if stats.BytesIn+stats.BytesOut == 0 {
+		return 0
+	}
+
+	return float64(stats.WireIn+stats.WireOut)/float64(stats.BytesIn+stats.BytesOut) - 1
+}
+
+type obfsConn struct {
+	stats      Stats
+	underlying stf4go.Conn
+	laddr      multiaddr.Multiaddr
+	raddr      multiaddr.Multiaddr
+	secret     string
+	peerRole   string
+	padding    Padding
+	jitter     time.Duration
+	send       *seal.CipherState
+	recv       *seal.CipherState // nil until the peer seed is read
+	rlock      sync.Mutex
+	wlock      sync.Mutex
+	readBuff   []byte
+}
+
+func newObfsConn(underlying stf4go.Conn, secret string, peerRole string, options *stf4go.Options) *obfsConn {
+	return &obfsConn{
+		underlying: underlying,
+		laddr:      underlying.LocalAddr().Encapsulate(obfsMultiAddr),
+		raddr:      underlying.RemoteAddr().Encapsulate(obfsMultiAddr),
+		secret:     secret,
+		peerRole:   peerRole,
+		padding:    getPadding(options),
+		jitter:     options.Config.Get("obfs", "jitter").Duration(0),
+	}
+}
+
+// hello send the seed and a padding frame in one write, so the first write has no fixed length
+func (conn *obfsConn) hello(role string) error {
+	seed, err := newSeed()
+
+	if err != nil {
+		return err
+	}
+
+	conn.send, err = newCipherState(conn.secret, seed, role)
+
+	if err != nil {
+		return err
+	}
+
+	buff, err := conn.seal(seed, nil)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := conn.write(buff); err != nil {
+		return errors.Wrap(err, "obfs handshake write seed error")
+	}
+
+	return nil
+}
+
+func (conn *obfsConn) readSeed() error {
+	seed := make([]byte, seedLen)
+
+	if _, err := conn.readFull(seed); err != nil {
+		return errors.Wrap(err, "obfs handshake read seed error")
+	}
+
+	var err error
+
+	conn.recv, err = newCipherState(conn.secret, seed, conn.peerRole)
+
+	return err
+}
+
+// seal append the frame of payload to out
+func (conn *obfsConn) seal(out []byte, payload []byte) ([]byte, error) {
+	pad := conn.padding.Pad(len(payload))
+
+	if pad < 0 {
+		pad = 0
+	} else if pad > maxBody-len(payload) {
+		pad = maxBody - len(payload)
+	}
+
+	var header [4]byte
+
+	binary.BigEndian.PutUint16(header[:2], uint16(len(payload)))
+	binary.BigEndian.PutUint16(header[2:], uint16(pad))
+
+	out, err := conn.send.Encrypt(out, nil, header[:])
+
+	if err != nil {
+		return nil, err
+	}
+
+	body := make([]byte, len(payload)+pad)
+
+	copy(body, payload)
+
+	return conn.send.Encrypt(out, nil, body)
+}
+
+func (conn *obfsConn) readFrame() ([]byte, error) {
+	header := make([]byte, headerLen)
+
+	if _, err := conn.readFull(header); err != nil {
+		return nil, err
+	}
+
+	header, err := conn.recv.Decrypt(header[:0], nil, header)
+
+	if err != nil {
+		return nil, errors.Wrap(stf4go.ErrPassword, "obfs frame from %s rejected", conn.underlying.RemoteAddr().String())
+	}
+
+	payload := int(binary.BigEndian.Uint16(header[:2]))
+	pad := int(binary.BigEndian.Uint16(header[2:]))
+
+	body := make([]byte, payload+pad+tagLen)
+
+	if _, err := conn.readFull(body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return nil, err
+	}
+
+	body, err = conn.recv.Decrypt(body[:0], nil, body)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "obfs decrypt error")
+	}
+
+	return body[:payload], nil
+}
+
+func (conn *obfsConn) readFull(b []byte) (int, error) {
+	n, err := io.ReadFull(conn.underlying, b)
+
+	atomic.AddUint64(&conn.stats.WireIn, uint64(n))
+
+	return n, err
+}
+
+func (conn *obfsConn) write(b []byte) (int, error) {
+	if conn.jitter > 0 {
+		time.Sleep(time.Duration(mrand.Int63n(int64(conn.jitter) + 1)))
+	}
+
+	n, err := conn.underlying.Write(b)
+
+	atomic.AddUint64(&conn.stats.WireOut, uint64(n))
+
+	return n, err
+}
+
+func (conn *obfsConn) Read(b []byte) (int, error) {
+	conn.rlock.Lock()
+	defer conn.rlock.Unlock()
+
+	if conn.recv == nil {
+		if err := conn.readSeed(); err != nil {
+			return 0, err
+		}
+	}
+
+	for len(conn.readBuff) == 0 {
+		frame, err := conn.readFrame()
+
+		if err != nil {
+			return 0, err
+		}
+
+		conn.readBuff = frame
+	}
+
+	n := copy(b, conn.readBuff)
+
+	conn.readBuff = conn.readBuff[n:]
+
+	atomic.AddUint64(&conn.stats.BytesIn, uint64(n))
+
+	return n, nil
+}
+
+func (conn *obfsConn) Write(b []byte) (int, error) {
+	conn.wlock.Lock()
+	defer conn.wlock.Unlock()
+
+	var n int
+
+	for len(b) > 0 {
+		chunk := b
+
+		if len(chunk) > maxPayload {
+			chunk = chunk[:maxPayload]
+		}
+
+		frame, err := conn.seal(nil, chunk)
+
+		if err != nil {
+			return n, err
+		}
+
+		if _, err := conn.write(frame); err != nil {
+			return n, err
+		}
+
+		atomic.AddUint64(&conn.stats.BytesOut, uint64(len(chunk)))
+
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+
+	return n, nil
+}
+
+func (conn *obfsConn) Close() error {
+	return conn.underlying.Close()
+}
+
+func (conn *obfsConn) LocalAddr() multiaddr.Multiaddr {
+	return conn.laddr
+}
+
+func (conn *obfsConn) RemoteAddr() multiaddr.Multiaddr {
+	return conn.raddr
+}
+
+func (conn *obfsConn) SetDeadline(t time.Time) error {
+	return conn.underlying.SetDeadline(t)
+}
+
+func (conn *obfsConn) SetReadDeadline(t time.Time) error {
+	return conn.underlying.SetReadDeadline(t)
+}
+
+func (conn *obfsConn) SetWriteDeadline(t time.Time) error {
+	return conn.underlying.SetWriteDeadline(t)
+}
+
+func (conn *obfsConn) Underlying() stf4go.Conn {
+	return conn.underlying
+}
+
+// CloseWrite half-close the underlying conn between two frames, the peer reads io.EOF at the frame boundary
+func (conn *obfsConn) CloseWrite() error {
+	conn.wlock.Lock()
+	defer conn.wlock.Unlock()
+
+	return stf4go.CloseWrite(conn.underlying)
+}
+
+func (conn *obfsConn) CloseRead() error {
+	return stf4go.CloseRead(conn.underlying)
+}
+
+func (conn *obfsConn) Stats() *Stats {
+	return &Stats{
+		BytesIn:  atomic.LoadUint64(&conn.stats.BytesIn),
+		BytesOut: atomic.LoadUint64(&conn.stats.BytesOut),
+		WireIn:   atomic.LoadUint64(&conn.stats.WireIn),
+		WireOut:  atomic.LoadUint64(&conn.stats.WireOut),
+	}
+}
+
+func init() {
+	stf4go.RegisterTransport(newObfsTransport())
+}
+
+// Conn .
+type Conn interface {
+	stf4go.Conn
+	Stats() *Stats
+}
@@ -0,0 +1,220 @@
+package obfs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/libs4go/errors"
+	"github.com/libs4go/scf4go"
+	"github.com/libs4go/scf4go/reader/memory"
+	"github.com/libs4go/slf4go"
+	_ "github.com/libs4go/slf4go/backend/console" //
+	"github.com/libs4go/stf4go"
+	_ "github.com/libs4go/stf4go/transports/tcp" //
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+var loggerjson = `
+{
+	"default":{
+		"backend":"console",
+		"level":"debug"
+	},
+	"backend":{
+		"console":{
+			"formatter":{
+				"output": "@t @l @s @m"
+			}
+		}
+	}
+}
+`
+
+func init() {
+	config := scf4go.New()
+
+	err := config.Load(memory.New(memory.Data(loggerjson, "json")))
+
+	if err != nil {
+		panic(err)
+	}
+
+	err = slf4go.Config(config)
+
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestObfs(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1855/obfs")
+
+	require.NoError(t, err)
+
+	listener, err := stf4go.Listen(laddr, WithSecret("secret"))
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	message := bytes.Repeat([]byte("x"), 100)
+
+	overhead := make(map[string]float64)
+
+	for name, padding := range map[string]Padding{
+		"none":    NoPadding(),
+		"uniform": UniformPadding(256),
+		"block":   BlockPadding(512),
+	} {
+		conn, err := stf4go.Dial(context.Background(), laddr, WithSecret("secret"), WithPadding(padding), WithJitter(time.Millisecond))
+
+		require.NoError(t, err)
+
+		buff := make([]byte, len(message))
+
+		for i := 0; i < 100; i++ {
+			_, err := conn.Write(message)
+
+			require.NoError(t, err)
+
+			_, err = io.ReadFull(conn, buff)
+
+			require.NoError(t, err)
+
+			require.Equal(t, message, buff)
+		}
+
+		stats := conn.(Conn).Stats()
+
+		require.Equal(t, uint64(100*len(message)), stats.BytesOut)
+		require.Equal(t, stats.BytesOut, stats.BytesIn)
+
+		overhead[name] = float64(stats.WireOut)/float64(stats.BytesOut) - 1
+
+		t.Logf("padding %s write overhead %.2f total overhead %.2f", name, overhead[name], stats.Overhead())
+
+		if name == "block" {
+			require.Zero(t, (stats.WireOut-seedLen)%512)
+		}
+
+		conn.Close()
+	}
+
+	// seed, hello frame and 100 frames of 36 bytes overhead
+	require.InDelta(t, float64(seedLen+frameOverhead+100*frameOverhead)/10000, overhead["none"], 0.001)
+	require.True(t, overhead["uniform"] > overhead["none"])
+	require.True(t, overhead["block"] > overhead["uniform"])
+}
+
+func TestSecretMismatch(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1856/obfs")
+
+	require.NoError(t, err)
+
+	listener, err := stf4go.Listen(laddr, WithSecret("server secret"))
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	accepted := make(chan error, 1)
+
+	go func() {
+		_, err := listener.Accept()
+
+		accepted <- err
+	}()
+
+	conn, err := stf4go.Dial(context.Background(), laddr, WithSecret("client secret"))
+
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	require.True(t, errors.Is(<-accepted, stf4go.ErrPassword))
+
+	// the server closes without sending a byte
+	n, err := conn.Read(make([]byte, 1))
+
+	require.Zero(t, n)
+	require.Error(t, err)
+}
+
+func TestUniformBytes(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1857")
+
+	require.NoError(t, err)
+
+	// raw tcp listener records the wire
+	listener, err := stf4go.Listen(laddr)
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	const wireLen = 256 * 1024
+
+	wire := make(chan []byte, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+
+		require.NoError(t, err)
+
+		defer conn.Close()
+
+		buff := make([]byte, wireLen)
+
+		_, err = io.ReadFull(conn, buff)
+
+		require.NoError(t, err)
+
+		wire <- buff
+	}()
+
+	conn, err := stf4go.Dial(context.Background(), laddr.Encapsulate(obfsMultiAddr), WithSecret("secret"), WithPadding(NoPadding()))
+
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	_, err = conn.Write(make([]byte, wireLen))
+
+	require.NoError(t, err)
+
+	var counts [256]float64
+
+	for _, b := range <-wire {
+		counts[b]++
+	}
+
+	// chi-square of the byte histogram, 255 degrees of freedom
+	expect := float64(wireLen) / 256
+
+	var chi2 float64
+
+	for _, count := range counts {
+		chi2 += (count - expect) * (count - expect) / expect
+	}
+
+	require.True(t, chi2 < 400, "chi-square %f", chi2)
+}
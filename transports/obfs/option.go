@@ -0,0 +1,67 @@
+package obfs
+
+import (
+	"time"
+
+	"github.com/libs4go/errors"
+	"github.com/libs4go/stf4go"
+)
+
+const defaultMaxPadding = 256
+
+func getSecret(options *stf4go.Options) (string, error) {
+	secret := options.Config.Get("obfs", "secret").String("")
+
+	if secret == "" {
+		return "", errors.Wrap(stf4go.ErrResource, "expect obfs secret")
+	}
+
+	return secret, nil
+}
+
+func getPadding(options *stf4go.Options) Padding {
+	obj, ok := options.GetObj("obfs", "padding")
+
+	if !ok {
+		return UniformPadding(defaultMaxPadding)
+	}
+
+	padding, ok := obj.(Padding)
+
+	if !ok {
+		return UniformPadding(defaultMaxPadding)
+	}
+
+	return padding
+}
+
+// WithSecret set the shared secret the frames are encrypted with, both ends must agree
+func WithSecret(secret string) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetConfig(secret, "obfs", "secret")
+
+		return nil
+	}
+}
+
+// WithPadding set the padding strategy, default UniformPadding(256)
+func WithPadding(padding Padding) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetObject(padding, "obfs", "padding")
+
+		return nil
+	}
+}
+
+// WithJitter delay each frame write by a random duration up to max, zero disables
+func WithJitter(max time.Duration) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		if max < 0 {
+			return errors.Wrap(stf4go.ErrResource, "invalid obfs jitter %s", max)
+		}
+
+		options.SetConfig(max.String(), "obfs", "jitter")
+
+		return nil
+	}
+}
@@ -0,0 +1,49 @@
+package obfs
+
+import (
+	"math/rand"
+)
+
+// Padding padding strategy, returns the padding length of a frame carrying n payload bytes,
+// the result is clamped to the frame limit
+type Padding interface {
+	Pad(n int) int
+}
+
+// PaddingF function adapter of Padding
+type PaddingF func(n int) int
+
+// Pad implement Padding
+func (f PaddingF) Pad(n int) int {
+	return f(n)
+}
+
+// NoPadding frames carry the payload only, the frame lengths follow the write sizes
+func NoPadding() Padding {
+	return PaddingF(func(n int) int {
+		return 0
+	})
+}
+
+// UniformPadding pad each frame with 0 to max random bytes
+func UniformPadding(max int) Padding {
+	return PaddingF(func(n int) int {
+		if max <= 0 {
+			return 0
+		}
+
+		return rand.Intn(max + 1)
+	})
+}
+
+// BlockPadding pad each frame to a multiple of size bytes on the wire, so the frame lengths
+// only tell the write sizes rounded up to size
+func BlockPadding(size int) Padding {
+	return PaddingF(func(n int) int {
+		if size <= 0 {
+			return 0
+		}
+
+		return (size - (frameOverhead+n)%size) % size
+	})
+}
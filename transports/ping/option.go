@@ -0,0 +1,26 @@
+package ping
+
+import (
+	"time"
+
+	"github.com/libs4go/errors"
+	"github.com/libs4go/stf4go"
+)
+
+const defaultInterval = 10 * time.Second
+const defaultMisses = 3
+
+// WithHeartbeat set the heartbeat interval and the missed beats after which the conn is closed,
+// zero interval stops sending heartbeats, the conn still answers the peer's ones
+func WithHeartbeat(interval time.Duration, misses int) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		if interval < 0 || misses <= 0 {
+			return errors.Wrap(stf4go.ErrResource, "invalid heartbeat interval %s misses %d", interval, misses)
+		}
+
+		options.SetConfig(interval.String(), "ping", "interval")
+		options.SetConfig(misses, "ping", "misses")
+
+		return nil
+	}
+}
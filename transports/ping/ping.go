@@ -0,0 +1,570 @@
+package ping
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libs4go/errors"
+	"github.com/libs4go/slf4go"
+	"github.com/libs4go/stf4go"
+	"github.com/multiformats/go-multiaddr"
+)
+
+const protocolPingID = 492
+
+var protoPing = multiaddr.Protocol{
+	Name:  "ping",
+	Code:  protocolPingID,
+	VCode: multiaddr.CodeToVarint(protocolPingID),
+}
+
+var pingMultiAddr multiaddr.Multiaddr
+
+func init() {
+
+	if err := multiaddr.AddProtocol(protoPing); err != nil {
+		panic(err)
+	}
+
+	var err error
+	pingMultiAddr, err = multiaddr.NewMultiaddr("/ping")
+	if err != nil {
+		panic(err)
+	}
+}
+
+const errVendor = "stf4go-transport-ping"
+
+// errors
+var (
+	ErrDead  = errors.New("peer missed heartbeats", errors.WithVendor(errVendor), errors.WithCode(-1))
+	ErrFrame = errors.New("unknown ping frame", errors.WithVendor(errVendor), errors.WithCode(-2))
+)
+
+// frame types, data frames carry a 2 bytes length and the payload, ping and pong frames the 8 bytes
+// timestamp of the ping sender, echoed in the pong. stall frames carry one byte, 1 when the read loop of
+// the sender starts waiting for its application and its pings are no longer answered, 0 when it resumes
+const (
+	frameData byte = iota
+	framePing
+	framePong
+	frameStall
+)
+
+const maxPayload = 0xffff
+
+// readQueue data frames the conn reads ahead of the application, the heartbeats are only answered
+// while the queue has room, a stall frame tells the peer not to count its beats meanwhile
+const readQueue = 64
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// deadline read deadline of the conn, the underlying conn is read by the read loop and keeps no deadline
+type deadline struct {
+	sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{
+		cancel: make(chan struct{}),
+	}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		// the timer fired, wait it closing cancel
+		<-d.cancel
+	}
+
+	d.timer = nil
+
+	expired := isClosed(d.cancel)
+
+	if t.IsZero() {
+		if expired {
+			d.cancel = make(chan struct{})
+		}
+
+		return
+	}
+
+	if duration := time.Until(t); duration > 0 {
+		if expired {
+			d.cancel = make(chan struct{})
+		}
+
+		cancel := d.cancel
+
+		d.timer = time.AfterFunc(duration, func() {
+			close(cancel)
+		})
+
+		return
+	}
+
+	if !expired {
+		close(d.cancel)
+	}
+}
+
+func (d *deadline) wait() chan struct{} {
+	d.Lock()
+	defer d.Unlock()
+
+	return d.cancel
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+type pingTransport struct {
+	slf4go.Logger
+}
+
+func newPingTransport() *pingTransport {
+	return &pingTransport{
+		Logger: slf4go.Get("stf4go-transport-ping"),
+	}
+}
+
+func (transport *pingTransport) String() string {
+	return "stf4go-transport-ping"
+}
+
+func (transport *pingTransport) Protocols() []multiaddr.Protocol {
+	return []multiaddr.Protocol{
+		protoPing,
+	}
+}
+
+func (transport *pingTransport) Client(conn stf4go.Conn, raddr multiaddr.Multiaddr, options *stf4go.Options) (stf4go.Conn, error) {
+	return newPingConn(transport.Logger, conn, options), nil
+}
+
+func (transport *pingTransport) Server(conn stf4go.Conn, laddr multiaddr.Multiaddr, options *stf4go.Options) (stf4go.Conn, error) {
+	return newPingConn(transport.Logger, conn, options), nil
+}
+
+// pingConn interleaves heartbeat frames with the data frames, a read loop reads the underlying conn
+// so the heartbeats are answered while the application is not reading
+type pingConn struct {
+	lastSeen     int64 // unix nano
+	rtt          int64 // smoothed, nano
+	logger       slf4go.Logger
+	underlying   stf4go.Conn
+	reader       *bufio.Reader
+	laddr        multiaddr.Multiaddr
+	raddr        multiaddr.Multiaddr
+	start        time.Time
+	rlock        sync.Mutex
+	readBuff     []byte
+	data         chan []byte
+	readDone     chan struct{}
+	readErr      error // set before readDone is closed
+	readDeadline *deadline
+	wlock        sync.Mutex
+	writeClosed  bool
+	closed       chan struct{}
+	once         sync.Once
+	dead         atomic.Value
+	answered     int32 // a pong arrived since the last heartbeat
+	stalled      int32 // the read loop waits for the application to read
+	writing      int32 // a frame is being written to the underlying conn
+	peerStalled  int32 // the peer reported its read loop waits for its application
+}
+
+func newPingConn(logger slf4go.Logger, underlying stf4go.Conn, options *stf4go.Options) *pingConn {
+	conn := &pingConn{
+		logger:       logger,
+		underlying:   underlying,
+		reader:       bufio.NewReader(underlying),
+		laddr:        underlying.LocalAddr().Encapsulate(pingMultiAddr),
+		raddr:        underlying.RemoteAddr().Encapsulate(pingMultiAddr),
+		start:        time.Now(),
+		data:         make(chan []byte, readQueue),
+		readDone:     make(chan struct{}),
+		readDeadline: newDeadline(),
+		closed:       make(chan struct{}),
+		lastSeen:     time.Now().UnixNano(),
+	}
+
+	go conn.readLoop()
+
+	interval := options.Config.Get("ping", "interval").Duration(defaultInterval)
+
+	if interval > 0 {
+		go conn.heartbeat(interval, options.Config.Get("ping", "misses").Int(defaultMisses))
+	}
+
+	return conn
+}
+
+func (conn *pingConn) readLoop() {
+	defer close(conn.readDone)
+
+	for {
+		frame, err := conn.reader.ReadByte()
+
+		if err != nil {
+			conn.readErr = err
+			return
+		}
+
+		atomic.StoreInt64(&conn.lastSeen, time.Now().UnixNano())
+
+		switch frame {
+		case frameData:
+			payload, err := conn.readData()
+
+			if err != nil {
+				conn.readErr = err
+				return
+			}
+
+			if !conn.deliver(payload) {
+				conn.readErr = io.ErrClosedPipe
+				return
+			}
+
+		case framePing, framePong:
+			var timestamp [8]byte
+
+			if _, err := io.ReadFull(conn.reader, timestamp[:]); err != nil {
+				conn.readErr = unexpected(err)
+				return
+			}
+
+			if frame == framePong {
+				conn.sample(time.Duration(binary.BigEndian.Uint64(timestamp[:])))
+				continue
+			}
+
+			if err := conn.writeFrame(framePong, timestamp[:]); err != nil && err != io.ErrClosedPipe {
+				conn.logger.W("send pong to {@raddr} error {@err}", conn.raddr.String(), err)
+			}
+
+		case frameStall:
+			stalled, err := conn.reader.ReadByte()
+
+			if err != nil {
+				conn.readErr = unexpected(err)
+				return
+			}
+
+			atomic.StoreInt32(&conn.peerStalled, int32(stalled&1))
+
+		default:
+			conn.readErr = errors.Wrap(ErrFrame, "frame type %d from %s", frame, conn.raddr.String())
+			return
+		}
+	}
+}
+
+func (conn *pingConn) readData() ([]byte, error) {
+	var header [2]byte
+
+	if _, err := io.ReadFull(conn.reader, header[:]); err != nil {
+		return nil, unexpected(err)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[:]))
+
+	if _, err := io.ReadFull(conn.reader, payload); err != nil {
+		return nil, unexpected(err)
+	}
+
+	return payload, nil
+}
+
+// deliver queue the payload for Read, returns false if the conn is closed meanwhile
+func (conn *pingConn) deliver(payload []byte) bool {
+	select {
+	case conn.data <- payload:
+		return true
+	default:
+	}
+
+	atomic.StoreInt32(&conn.stalled, 1)
+	defer atomic.StoreInt32(&conn.stalled, 0)
+
+	conn.notifyStall(1)
+	defer conn.notifyStall(0)
+
+	select {
+	case conn.data <- payload:
+		return true
+	case <-conn.closed:
+		return false
+	}
+}
+
+// notifyStall tell the peer the read loop waits for the application, so the peer does not count the
+// beats this conn can not answer meanwhile
+func (conn *pingConn) notifyStall(stalled byte) {
+	if err := conn.writeFrame(frameStall, []byte{stalled}); err != nil && err != io.ErrClosedPipe {
+		conn.logger.W("send stall to {@raddr} error {@err}", conn.raddr.String(), err)
+	}
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
+func (conn *pingConn) sample(timestamp time.Duration) {
+	rtt := time.Since(conn.start) - timestamp
+
+	if rtt < 0 {
+		return
+	}
+
+	srtt := atomic.LoadInt64(&conn.rtt)
+
+	if srtt == 0 {
+		srtt = int64(rtt)
+	} else {
+		srtt += (int64(rtt) - srtt) / 8
+	}
+
+	atomic.StoreInt64(&conn.rtt, srtt)
+	atomic.StoreInt32(&conn.answered, 1)
+}
+
+// heartbeat send a ping and close the conn after misses intervals without pong. the beats are not counted
+// while the application does not read, nor after the peer closed its write side. a peer whose application
+// does not read stops answering too, so the beats are not counted while the peer reports a stall or a local
+// write is blocked, and each ping gets a full interval after it was written. a peer host lost while
+// stalled is left to the tcp retransmission timeout
+func (conn *pingConn) heartbeat(interval time.Duration, misses int) {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	missed := 0
+
+	for {
+		if err := conn.ping(); err == io.ErrClosedPipe {
+			return
+		} else if err != nil {
+			conn.logger.W("send ping to {@raddr} error {@err}", conn.raddr.String(), err)
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+
+		timer.Reset(interval)
+
+		select {
+		case <-conn.closed:
+			return
+		case <-conn.readDone:
+			return
+		case <-timer.C:
+		}
+
+		if atomic.SwapInt32(&conn.answered, 0) == 1 {
+			missed = 0
+		} else if atomic.LoadInt32(&conn.stalled) == 0 && atomic.LoadInt32(&conn.peerStalled) == 0 &&
+			atomic.LoadInt32(&conn.writing) == 0 {
+			missed++
+		}
+
+		if missed >= misses {
+			conn.logger.W("close ping conn {@raddr}, {@missed} heartbeats missed", conn.raddr.String(), missed)
+			conn.dead.Store(errors.Wrap(ErrDead, "%d heartbeats of %s missed", missed, conn.raddr.String()))
+			conn.Close()
+			return
+		}
+	}
+}
+
+func (conn *pingConn) ping() error {
+	var timestamp [8]byte
+
+	binary.BigEndian.PutUint64(timestamp[:], uint64(time.Since(conn.start)))
+
+	return conn.writeFrame(framePing, timestamp[:])
+}
+
+func (conn *pingConn) writeFrame(frame byte, payload []byte) error {
+	buff := make([]byte, 0, 3+len(payload))
+
+	buff = append(buff, frame)
+
+	if frame == frameData {
+		buff = append(buff, byte(len(payload)>>8), byte(len(payload)))
+	}
+
+	buff = append(buff, payload...)
+
+	conn.wlock.Lock()
+	defer conn.wlock.Unlock()
+
+	if conn.writeClosed {
+		return io.ErrClosedPipe
+	}
+
+	atomic.StoreInt32(&conn.writing, 1)
+	defer atomic.StoreInt32(&conn.writing, 0)
+
+	_, err := conn.underlying.Write(buff)
+
+	return err
+}
+
+func (conn *pingConn) Read(b []byte) (int, error) {
+	conn.rlock.Lock()
+	defer conn.rlock.Unlock()
+
+	for len(conn.readBuff) == 0 {
+		select {
+		case conn.readBuff = <-conn.data:
+		case <-conn.readDone:
+			select {
+			case conn.readBuff = <-conn.data:
+			default:
+				return 0, conn.readError()
+			}
+		case <-conn.readDeadline.wait():
+			return 0, timeoutError{}
+		}
+	}
+
+	n := copy(b, conn.readBuff)
+
+	conn.readBuff = conn.readBuff[n:]
+
+	return n, nil
+}
+
+func (conn *pingConn) readError() error {
+	if err, ok := conn.dead.Load().(error); ok {
+		return err
+	}
+
+	return conn.readErr
+}
+
+func (conn *pingConn) Write(b []byte) (int, error) {
+	var n int
+
+	for len(b) > 0 {
+		chunk := b
+
+		if len(chunk) > maxPayload {
+			chunk = chunk[:maxPayload]
+		}
+
+		if err := conn.writeFrame(frameData, chunk); err != nil {
+			if dead, ok := conn.dead.Load().(error); ok {
+				err = dead
+			}
+
+			return n, err
+		}
+
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+
+	return n, nil
+}
+
+func (conn *pingConn) Close() error {
+	conn.once.Do(func() {
+		close(conn.closed)
+	})
+
+	return conn.underlying.Close()
+}
+
+func (conn *pingConn) LocalAddr() multiaddr.Multiaddr {
+	return conn.laddr
+}
+
+func (conn *pingConn) RemoteAddr() multiaddr.Multiaddr {
+	return conn.raddr
+}
+
+func (conn *pingConn) SetDeadline(t time.Time) error {
+	conn.readDeadline.set(t)
+
+	return conn.underlying.SetWriteDeadline(t)
+}
+
+func (conn *pingConn) SetReadDeadline(t time.Time) error {
+	conn.readDeadline.set(t)
+
+	return nil
+}
+
+func (conn *pingConn) SetWriteDeadline(t time.Time) error {
+	return conn.underlying.SetWriteDeadline(t)
+}
+
+func (conn *pingConn) Underlying() stf4go.Conn {
+	return conn.underlying
+}
+
+// CloseWrite stop the data and heartbeats and half-close the underlying conn, the pings of the peer
+// are no longer answered, so the peer must not expect heartbeats after it read io.EOF
+func (conn *pingConn) CloseWrite() error {
+	conn.wlock.Lock()
+	defer conn.wlock.Unlock()
+
+	conn.writeClosed = true
+
+	return stf4go.CloseWrite(conn.underlying)
+}
+
+func (conn *pingConn) CloseRead() error {
+	return stf4go.CloseRead(conn.underlying)
+}
+
+// RTT the smoothed heartbeat round trip time, 0 before the first pong
+func (conn *pingConn) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&conn.rtt))
+}
+
+// LastSeen the time the last frame of the peer arrived, the conn setup time before any
+func (conn *pingConn) LastSeen() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&conn.lastSeen))
+}
+
+func init() {
+	stf4go.RegisterTransport(newPingTransport())
+}
+
+// Conn .
+type Conn interface {
+	stf4go.Conn
+	// RTT the smoothed heartbeat round trip time
+	RTT() time.Duration
+	// LastSeen the time the peer was last heard of
+	LastSeen() time.Time
+}
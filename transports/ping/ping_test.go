@@ -0,0 +1,273 @@
+package ping
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/libs4go/bcf4go/key"
+	"github.com/libs4go/errors"
+	"github.com/libs4go/scf4go"
+	"github.com/libs4go/scf4go/reader/memory"
+	"github.com/libs4go/slf4go"
+	_ "github.com/libs4go/slf4go/backend/console" //
+	"github.com/libs4go/stf4go"
+	_ "github.com/libs4go/stf4go/transports/tcp" //
+	"github.com/libs4go/stf4go/transports/tls"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+var loggerjson = `
+{
+	"default":{
+		"backend":"console",
+		"level":"debug"
+	},
+	"backend":{
+		"console":{
+			"formatter":{
+				"output": "@t @l @s @m"
+			}
+		}
+	}
+}
+`
+
+func init() {
+	config := scf4go.New()
+
+	err := config.Load(memory.New(memory.Data(loggerjson, "json")))
+
+	if err != nil {
+		panic(err)
+	}
+
+	err = slf4go.Config(config)
+
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+
+	k, err := key.RandomKey("did")
+
+	require.NoError(t, err)
+
+	for _, addr := range []string{"/ip4/127.0.0.1/tcp/1851/ping", "/ip4/127.0.0.1/tcp/1852/ping/tls"} {
+		laddr, err := multiaddr.NewMultiaddr(addr)
+
+		require.NoError(t, err)
+
+		listener, err := stf4go.Listen(laddr, tls.WithKey(k), WithHeartbeat(50*time.Millisecond, 3))
+
+		require.NoError(t, err)
+
+		go func() {
+			conn, err := listener.Accept()
+
+			require.NoError(t, err)
+
+			defer conn.Close()
+
+			io.Copy(conn, conn)
+		}()
+
+		conn, err := stf4go.Dial(context.Background(), laddr, tls.WithKey(k), WithHeartbeat(50*time.Millisecond, 3))
+
+		require.NoError(t, err)
+
+		var pc Conn
+
+		for c := conn; c != nil; c = c.Underlying() {
+			if p, ok := c.(Conn); ok {
+				pc = p
+				break
+			}
+		}
+
+		require.NotNil(t, pc)
+
+		_, err = conn.Write([]byte("hello"))
+
+		require.NoError(t, err)
+
+		buff := make([]byte, 5)
+
+		_, err = io.ReadFull(conn, buff)
+
+		require.NoError(t, err)
+
+		require.Equal(t, "hello", string(buff))
+
+		// idle well past the missed beats, the heartbeats keep the conn alive
+		time.Sleep(300 * time.Millisecond)
+
+		require.NotZero(t, pc.RTT())
+
+		require.WithinDuration(t, time.Now(), pc.LastSeen(), 200*time.Millisecond)
+
+		_, err = conn.Write([]byte("world"))
+
+		require.NoError(t, err)
+
+		_, err = io.ReadFull(conn, buff)
+
+		require.NoError(t, err)
+
+		require.Equal(t, "world", string(buff))
+
+		conn.Close()
+		listener.Close()
+	}
+}
+
+func TestDeadPeer(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1853")
+
+	require.NoError(t, err)
+
+	// raw tcp listener playing the silent peer
+	listener, err := stf4go.Listen(laddr)
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+
+		require.NoError(t, err)
+
+		time.Sleep(time.Second)
+
+		conn.Close()
+	}()
+
+	conn, err := stf4go.Dial(context.Background(), laddr.Encapsulate(pingMultiAddr), WithHeartbeat(50*time.Millisecond, 3))
+
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	start := time.Now()
+
+	_, err = conn.Read(make([]byte, 1))
+
+	require.True(t, errors.Is(err, ErrDead))
+
+	require.True(t, time.Since(start) < 500*time.Millisecond)
+}
+
+func TestReadDeadline(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1854/ping")
+
+	require.NoError(t, err)
+
+	listener, err := stf4go.Listen(laddr)
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+
+		require.NoError(t, err)
+
+		time.Sleep(200 * time.Millisecond)
+
+		conn.Write([]byte("late"))
+	}()
+
+	conn, err := stf4go.Dial(context.Background(), laddr)
+
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(20*time.Millisecond)))
+
+	_, err = conn.Read(make([]byte, 4))
+
+	netErr, ok := err.(interface{ Timeout() bool })
+
+	require.True(t, ok && netErr.Timeout())
+
+	// the read loop is not affected by the expired deadline
+	require.NoError(t, conn.SetReadDeadline(time.Time{}))
+
+	buff := make([]byte, 4)
+
+	_, err = io.ReadFull(conn, buff)
+
+	require.NoError(t, err)
+
+	require.Equal(t, "late", string(buff))
+}
+
+func TestSlowConsumer(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1881/ping")
+
+	require.NoError(t, err)
+
+	listener, err := stf4go.Listen(laddr, WithHeartbeat(50*time.Millisecond, 3))
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	// more frames than the read queue holds, far less than the socket buffers, so the writer never blocks
+	const frames = readQueue * 2
+
+	dialed := make(chan stf4go.Conn, 1)
+
+	go func() {
+		conn, err := stf4go.Dial(context.Background(), laddr, WithHeartbeat(50*time.Millisecond, 3))
+
+		require.NoError(t, err)
+
+		for i := 0; i < frames; i++ {
+			_, err = conn.Write(make([]byte, 1024))
+
+			require.NoError(t, err)
+		}
+
+		dialed <- conn
+	}()
+
+	conn, err := listener.Accept()
+
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	client := <-dialed
+
+	defer client.Close()
+
+	// the read loop waits for the application for many intervals, the peer's pings wait behind the data
+	time.Sleep(time.Second)
+
+	_, err = io.ReadFull(conn, make([]byte, frames*1024))
+
+	require.NoError(t, err)
+
+	_, err = client.Write([]byte("alive"))
+
+	require.NoError(t, err)
+
+	var buff [5]byte
+
+	_, err = io.ReadFull(conn, buff[:])
+
+	require.NoError(t, err)
+
+	require.Equal(t, "alive", string(buff[:]))
+}
@@ -0,0 +1,49 @@
+package psk
+
+import (
+	"github.com/libs4go/errors"
+	"github.com/libs4go/stf4go"
+)
+
+const defaultCipher = "chacha20-poly1305"
+
+func getConfig(options *stf4go.Options) (string, byte, error) {
+	passphrase := options.Config.Get("psk", "passphrase").String("")
+
+	if passphrase == "" {
+		return "", 0, errors.Wrap(stf4go.ErrResource, "expect psk passphrase")
+	}
+
+	name := options.Config.Get("psk", "cipher").String(defaultCipher)
+
+	id, ok := ciphers[name]
+
+	if !ok {
+		return "", 0, errors.Wrap(stf4go.ErrResource, "unknown psk cipher %s", name)
+	}
+
+	return passphrase, id, nil
+}
+
+// WithPassphrase set the shared passphrase, the handshake confirm frame allows offline guessing
+// by an eavesdropper, so use a long random passphrase
+func WithPassphrase(passphrase string) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetConfig(passphrase, "psk", "passphrase")
+
+		return nil
+	}
+}
+
+// WithCipher set the frame cipher, chacha20-poly1305 (default) or aes-256-gcm, both ends must agree
+func WithCipher(name string) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		if _, ok := ciphers[name]; !ok {
+			return errors.Wrap(stf4go.ErrResource, "unknown psk cipher %s", name)
+		}
+
+		options.SetConfig(name, "psk", "cipher")
+
+		return nil
+	}
+}
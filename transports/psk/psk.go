@@ -0,0 +1,402 @@
+package psk
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/libs4go/errors"
+	"github.com/libs4go/slf4go"
+	"github.com/libs4go/stf4go"
+	"github.com/libs4go/stf4go/transports/internal/seal"
+	"github.com/multiformats/go-multiaddr"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const protocolPSKID = 488
+
+var protoPSK = multiaddr.Protocol{
+	Name:  "psk",
+	Code:  protocolPSKID,
+	VCode: multiaddr.CodeToVarint(protocolPSKID),
+}
+
+var pskMultiAddr multiaddr.Multiaddr
+
+func init() {
+
+	if err := multiaddr.AddProtocol(protoPSK); err != nil {
+		panic(err)
+	}
+
+	var err error
+	pskMultiAddr, err = multiaddr.NewMultiaddr("/psk")
+	if err != nil {
+		panic(err)
+	}
+}
+
+const version = 1
+const nonceLen = 32
+const helloLen = 2 + nonceLen
+const keyLen = 32
+const kdfInfo = "stf4go-transport-psk"
+
+// ciphers by the id sent in the hello
+var ciphers = map[string]byte{
+	"chacha20-poly1305": 1,
+	"aes-256-gcm":       2,
+}
+
+func newAEAD(id byte, key []byte) (cipher.AEAD, error) {
+	switch id {
+	case 1:
+		return chacha20poly1305.New(key)
+	case 2:
+		block, err := aes.NewCipher(key)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return cipher.NewGCM(block)
+	}
+
+	return nil, errors.Wrap(stf4go.ErrResource, "unknown psk cipher %d", id)
+}
+
+// deriveKeys derive the client and server write keys from the passphrase and both hello nonces,
+// the nonces make the keys unique per conn, so a recorded session can not be replayed
+func deriveKeys(id byte, passphrase string, clientHello, serverHello []byte) (*seal.CipherState, *seal.CipherState, error) {
+	salt := append(append([]byte{}, clientHello...), serverHello...)
+
+	kdf := hkdf.New(sha256.New, []byte(passphrase), salt, []byte(kdfInfo))
+
+	var states [2]*seal.CipherState
+
+	for i := range states {
+		key := make([]byte, keyLen)
+
+		if _, err := io.ReadFull(kdf, key); err != nil {
+			return nil, nil, errors.Wrap(err, "derive psk key error")
+		}
+
+		aead, err := newAEAD(id, key)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		states[i] = seal.NewCipherState(aead, binary.BigEndian)
+	}
+
+	return states[0], states[1], nil
+}
+
+func newHello(id byte) ([]byte, error) {
+	hello := make([]byte, helloLen)
+
+	hello[0] = version
+	hello[1] = id
+
+	if _, err := rand.Read(hello[2:]); err != nil {
+		return nil, errors.Wrap(err, "generate psk nonce error")
+	}
+
+	return hello, nil
+}
+
+func checkHello(hello []byte, id byte) error {
+	if hello[0] != version {
+		return errors.Wrap(stf4go.ErrResource, "psk version %d not supported", hello[0])
+	}
+
+	if hello[1] != id {
+		return errors.Wrap(stf4go.ErrResource, "psk cipher mismatch, local %d remote %d", id, hello[1])
+	}
+
+	return nil
+}
+
+type pskTransport struct {
+	slf4go.Logger
+}
+
+func newPSKTransport() *pskTransport {
+	return &pskTransport{
+		Logger: slf4go.Get("stf4go-transport-psk"),
+	}
+}
+
+func (transport *pskTransport) String() string {
+	return "stf4go-transport-psk"
+}
+
+func (transport *pskTransport) Protocols() []multiaddr.Protocol {
+	return []multiaddr.Protocol{
+		protoPSK,
+	}
+}
+
+// Client send the client hello, read the server hello, then each side proves the derived keys
+// with an empty confirm frame bound to both hellos, the client first
+func (transport *pskTransport) Client(conn stf4go.Conn, raddr multiaddr.Multiaddr, options *stf4go.Options) (stf4go.Conn, error) {
+
+	passphrase, id, err := getConfig(options)
+
+	if err != nil {
+		return nil, err
+	}
+
+	clientHello, err := newHello(id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(clientHello); err != nil {
+		return nil, errors.Wrap(err, "psk handshake write hello error")
+	}
+
+	serverHello := make([]byte, helloLen)
+
+	if _, err := io.ReadFull(conn, serverHello); err != nil {
+		return nil, errors.Wrap(err, "psk handshake read hello error")
+	}
+
+	if err := checkHello(serverHello, id); err != nil {
+		return nil, err
+	}
+
+	send, recv, err := deriveKeys(id, passphrase, clientHello, serverHello)
+
+	if err != nil {
+		return nil, err
+	}
+
+	transcript := append(append([]byte{}, clientHello...), serverHello...)
+
+	if err := confirm(conn, send, transcript); err != nil {
+		return nil, err
+	}
+
+	if err := checkConfirm(conn, recv, transcript); err != nil {
+		return nil, err
+	}
+
+	return newPSKConn(conn, send, recv), nil
+}
+
+func (transport *pskTransport) Server(conn stf4go.Conn, laddr multiaddr.Multiaddr, options *stf4go.Options) (stf4go.Conn, error) {
+
+	passphrase, id, err := getConfig(options)
+
+	if err != nil {
+		return nil, err
+	}
+
+	clientHello := make([]byte, helloLen)
+
+	if _, err := io.ReadFull(conn, clientHello); err != nil {
+		return nil, errors.Wrap(err, "psk handshake read hello error")
+	}
+
+	if err := checkHello(clientHello, id); err != nil {
+		return nil, err
+	}
+
+	serverHello, err := newHello(id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(serverHello); err != nil {
+		return nil, errors.Wrap(err, "psk handshake write hello error")
+	}
+
+	recv, send, err := deriveKeys(id, passphrase, clientHello, serverHello)
+
+	if err != nil {
+		return nil, err
+	}
+
+	transcript := append(append([]byte{}, clientHello...), serverHello...)
+
+	if err := checkConfirm(conn, recv, transcript); err != nil {
+		transport.W("psk handshake with {@raddr} failed {@err}", conn.RemoteAddr().String(), err)
+
+		if errors.Is(err, stf4go.ErrPassword) {
+			// tell the client it used the wrong passphrase
+			seal.WriteMessage(conn, nil)
+		}
+
+		return nil, err
+	}
+
+	if err := confirm(conn, send, transcript); err != nil {
+		return nil, err
+	}
+
+	return newPSKConn(conn, send, recv), nil
+}
+
+func confirm(conn stf4go.Conn, send *seal.CipherState, transcript []byte) error {
+	frame, err := send.Encrypt(nil, transcript, nil)
+
+	if err != nil {
+		return err
+	}
+
+	if err := seal.WriteMessage(conn, frame); err != nil {
+		return errors.Wrap(err, "psk handshake write confirm error")
+	}
+
+	return nil
+}
+
+// checkConfirm the confirm frame only opens if both ends derived the same keys
+func checkConfirm(conn stf4go.Conn, recv *seal.CipherState, transcript []byte) error {
+	frame, err := seal.ReadMessage(conn)
+
+	if err != nil {
+		return errors.Wrap(err, "psk handshake read confirm error")
+	}
+
+	// an empty frame is the server rejecting the client confirm, no sealed frame is shorter than the tag
+	if len(frame) == 0 {
+		return errors.Wrap(stf4go.ErrPassword, "psk key rejected by %s", conn.RemoteAddr().String())
+	}
+
+	if _, err := recv.Decrypt(nil, transcript, frame); err != nil {
+		return errors.Wrap(stf4go.ErrPassword, "psk key mismatch with %s", conn.RemoteAddr().String())
+	}
+
+	return nil
+}
+
+type pskConn struct {
+	underlying stf4go.Conn
+	laddr      multiaddr.Multiaddr
+	raddr      multiaddr.Multiaddr
+	send       *seal.CipherState
+	recv       *seal.CipherState
+	rlock      sync.Mutex
+	wlock      sync.Mutex
+	readBuff   []byte
+}
+
+func newPSKConn(underlying stf4go.Conn, send *seal.CipherState, recv *seal.CipherState) *pskConn {
+	return &pskConn{
+		underlying: underlying,
+		laddr:      underlying.LocalAddr().Encapsulate(pskMultiAddr),
+		raddr:      underlying.RemoteAddr().Encapsulate(pskMultiAddr),
+		send:       send,
+		recv:       recv,
+	}
+}
+
+func (conn *pskConn) Read(b []byte) (int, error) {
+	conn.rlock.Lock()
+	defer conn.rlock.Unlock()
+
+	for len(conn.readBuff) == 0 {
+		frame, err := seal.ReadMessage(conn.underlying)
+
+		if err != nil {
+			return 0, err
+		}
+
+		conn.readBuff, err = conn.recv.Decrypt(frame[:0], nil, frame)
+
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, conn.readBuff)
+
+	conn.readBuff = conn.readBuff[n:]
+
+	return n, nil
+}
+
+func (conn *pskConn) Write(b []byte) (int, error) {
+	conn.wlock.Lock()
+	defer conn.wlock.Unlock()
+
+	var n int
+
+	for len(b) > 0 {
+		chunk := b
+
+		if len(chunk) > seal.MaxPlaintextLen {
+			chunk = chunk[:seal.MaxPlaintextLen]
+		}
+
+		frame, err := conn.send.Encrypt(nil, nil, chunk)
+
+		if err != nil {
+			return n, err
+		}
+
+		if err := seal.WriteMessage(conn.underlying, frame); err != nil {
+			return n, err
+		}
+
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+
+	return n, nil
+}
+
+func (conn *pskConn) Close() error {
+	return conn.underlying.Close()
+}
+
+func (conn *pskConn) LocalAddr() multiaddr.Multiaddr {
+	return conn.laddr
+}
+
+func (conn *pskConn) RemoteAddr() multiaddr.Multiaddr {
+	return conn.raddr
+}
+
+func (conn *pskConn) SetDeadline(t time.Time) error {
+	return conn.underlying.SetDeadline(t)
+}
+
+func (conn *pskConn) SetReadDeadline(t time.Time) error {
+	return conn.underlying.SetReadDeadline(t)
+}
+
+func (conn *pskConn) SetWriteDeadline(t time.Time) error {
+	return conn.underlying.SetWriteDeadline(t)
+}
+
+func (conn *pskConn) Underlying() stf4go.Conn {
+	return conn.underlying
+}
+
+// CloseWrite half-close the underlying conn between two frames, the peer reads io.EOF at the frame boundary
+func (conn *pskConn) CloseWrite() error {
+	conn.wlock.Lock()
+	defer conn.wlock.Unlock()
+
+	return stf4go.CloseWrite(conn.underlying)
+}
+
+func (conn *pskConn) CloseRead() error {
+	return stf4go.CloseRead(conn.underlying)
+}
+
+func init() {
+	stf4go.RegisterTransport(newPSKTransport())
+}
@@ -0,0 +1,178 @@
+package psk
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/libs4go/errors"
+	"github.com/libs4go/scf4go"
+	"github.com/libs4go/scf4go/reader/memory"
+	"github.com/libs4go/slf4go"
+	_ "github.com/libs4go/slf4go/backend/console" //
+	"github.com/libs4go/stf4go"
+	"github.com/libs4go/stf4go/transports/internal/seal"
+	_ "github.com/libs4go/stf4go/transports/tcp" //
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+var loggerjson = `
+{
+	"default":{
+		"backend":"console",
+		"level":"debug"
+	},
+	"backend":{
+		"console":{
+			"formatter":{
+				"output": "@t @l @s @m"
+			}
+		}
+	}
+}
+`
+
+func init() {
+	config := scf4go.New()
+
+	err := config.Load(memory.New(memory.Data(loggerjson, "json")))
+
+	if err != nil {
+		panic(err)
+	}
+
+	err = slf4go.Config(config)
+
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestListenConnect(t *testing.T) {
+
+	for i, cipher := range []string{"chacha20-poly1305", "aes-256-gcm"} {
+		laddr, err := multiaddr.NewMultiaddr([]string{"/ip4/127.0.0.1/tcp/1840/psk", "/ip4/127.0.0.1/tcp/1841/psk"}[i])
+
+		require.NoError(t, err)
+
+		listener, err := stf4go.Listen(laddr, WithPassphrase("correct horse battery staple"), WithCipher(cipher))
+
+		require.NoError(t, err)
+
+		go func() {
+			conn, err := listener.Accept()
+
+			require.NoError(t, err)
+
+			defer conn.Close()
+
+			_, err = io.Copy(conn, conn)
+
+			require.NoError(t, err)
+		}()
+
+		conn, err := stf4go.Dial(context.Background(), laddr, WithPassphrase("correct horse battery staple"), WithCipher(cipher))
+
+		require.NoError(t, err)
+
+		// larger than one frame
+		data := make([]byte, 3*seal.MaxPlaintextLen)
+
+		for i := range data {
+			data[i] = byte(i)
+		}
+
+		go func() {
+			_, err := conn.Write(data)
+
+			require.NoError(t, err)
+		}()
+
+		buff := make([]byte, len(data))
+
+		_, err = io.ReadFull(conn, buff)
+
+		require.NoError(t, err)
+
+		require.Equal(t, data, buff)
+
+		conn.Close()
+		listener.Close()
+	}
+}
+
+func TestKeyMismatch(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1842/psk")
+
+	require.NoError(t, err)
+
+	listener, err := stf4go.Listen(laddr, WithPassphrase("server secret"))
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	accepted := make(chan error, 1)
+
+	go func() {
+		_, err := listener.Accept()
+
+		accepted <- err
+	}()
+
+	_, err = stf4go.Dial(context.Background(), laddr, WithPassphrase("client secret"))
+
+	require.True(t, errors.Is(err, stf4go.ErrPassword))
+
+	require.True(t, errors.Is(<-accepted, stf4go.ErrPassword))
+}
+
+func TestReplay(t *testing.T) {
+	id := ciphers[defaultCipher]
+
+	clientHello, err := newHello(id)
+
+	require.NoError(t, err)
+
+	serverHello, err := newHello(id)
+
+	require.NoError(t, err)
+
+	clientSend, _, err := deriveKeys(id, "secret", clientHello, serverHello)
+
+	require.NoError(t, err)
+
+	serverRecv, _, err := deriveKeys(id, "secret", clientHello, serverHello)
+
+	require.NoError(t, err)
+
+	frame, err := clientSend.Encrypt(nil, nil, []byte("hello"))
+
+	require.NoError(t, err)
+
+	plaintext, err := serverRecv.Decrypt(nil, nil, frame)
+
+	require.NoError(t, err)
+
+	require.Equal(t, "hello", string(plaintext))
+
+	// the same frame again within the conn
+	_, err = serverRecv.Decrypt(nil, nil, frame)
+
+	require.Error(t, err)
+
+	// the recorded frame against a new conn, the server picks a fresh nonce
+	serverHello, err = newHello(id)
+
+	require.NoError(t, err)
+
+	serverRecv, _, err = deriveKeys(id, "secret", clientHello, serverHello)
+
+	require.NoError(t, err)
+
+	_, err = serverRecv.Decrypt(nil, nil, frame)
+
+	require.Error(t, err)
+}
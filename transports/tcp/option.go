@@ -0,0 +1,207 @@
+package tcp
+
+import (
+	"net"
+	"time"
+
+	"github.com/libs4go/errors"
+	"github.com/libs4go/stf4go"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr-net"
+)
+
+// sockopts tcp socket options, zero values keep the os or go defaults
+type sockopts struct {
+	keepalive   time.Duration // 0 go default, negative disables
+	noDelay     bool
+	linger      int // -1 os default
+	readBuffer  int
+	writeBuffer int
+	reuseAddr   bool
+	reusePort   bool
+	tos         int // IP_TOS / IPV6_TCLASS, dscp << 2
+	userTimeout time.Duration
+	localAddr   string // dial source address
+	fastOpen    int    // listener TCP_FASTOPEN queue length, dial TCP_FASTOPEN_CONNECT if positive
+	deferAccept time.Duration
+}
+
+func getSockopts(options *stf4go.Options) *sockopts {
+	config := options.Config
+
+	return &sockopts{
+		keepalive:   config.Get("tcp", "keepalive").Duration(0),
+		noDelay:     config.Get("tcp", "nodelay").Bool(true),
+		linger:      config.Get("tcp", "linger").Int(-1),
+		readBuffer:  config.Get("tcp", "readbuffer").Int(0),
+		writeBuffer: config.Get("tcp", "writebuffer").Int(0),
+		reuseAddr:   config.Get("tcp", "reuseaddr").Bool(false),
+		reusePort:   config.Get("tcp", "reuseport").Bool(false),
+		tos:         config.Get("tcp", "tos").Int(0),
+		userTimeout: config.Get("tcp", "usertimeout").Duration(0),
+		localAddr:   config.Get("tcp", "localaddr").String(""),
+		fastOpen:    config.Get("tcp", "fastopen").Int(0),
+		deferAccept: config.Get("tcp", "deferaccept").Duration(0),
+	}
+}
+
+// dialer create the dialer with the socket options applied by Control, on supported platforms
+func (opts *sockopts) dialer() (*net.Dialer, error) {
+	dialer := &net.Dialer{
+		KeepAlive: opts.keepalive,
+		Control:   opts.dialControl,
+	}
+
+	if opts.localAddr != "" {
+		laddr, err := multiaddr.NewMultiaddr(opts.localAddr)
+
+		if err != nil {
+			return nil, errors.Wrap(err, "parse local addr %s error", opts.localAddr)
+		}
+
+		addr, err := manet.ToNetAddr(laddr)
+
+		if err != nil {
+			return nil, errors.Wrap(err, "convert local addr %s error", opts.localAddr)
+		}
+
+		dialer.LocalAddr = addr
+	}
+
+	return dialer, nil
+}
+
+func (opts *sockopts) listenConfig() *net.ListenConfig {
+	return &net.ListenConfig{
+		KeepAlive: opts.keepalive,
+		Control:   opts.listenControl,
+	}
+}
+
+// apply the options go resets after connect, go always enables TCP_NODELAY on new conns
+func (opts *sockopts) apply(conn net.Conn) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+
+	if !ok {
+		return nil
+	}
+
+	if err := tcpConn.SetNoDelay(opts.noDelay); err != nil {
+		return errors.Wrap(err, "set TCP_NODELAY error")
+	}
+
+	if opts.linger >= 0 {
+		if err := tcpConn.SetLinger(opts.linger); err != nil {
+			return errors.Wrap(err, "set SO_LINGER error")
+		}
+	}
+
+	return nil
+}
+
+// WithKeepAlive set tcp keepalive period, negative disables keepalive
+func WithKeepAlive(period time.Duration) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetConfig(period.String(), "tcp", "keepalive")
+
+		return nil
+	}
+}
+
+// WithNoDelay set TCP_NODELAY, default is true
+func WithNoDelay(enable bool) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetConfig(enable, "tcp", "nodelay")
+
+		return nil
+	}
+}
+
+// WithLinger set SO_LINGER in seconds, see net.TCPConn.SetLinger
+func WithLinger(sec int) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetConfig(sec, "tcp", "linger")
+
+		return nil
+	}
+}
+
+// WithBuffer set SO_RCVBUF and SO_SNDBUF, set before listen they are inherited by the accepted conns
+func WithBuffer(readBuffer, writeBuffer int) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetConfig(readBuffer, "tcp", "readbuffer")
+		options.SetConfig(writeBuffer, "tcp", "writebuffer")
+
+		return nil
+	}
+}
+
+// WithReuseAddr set SO_REUSEADDR
+func WithReuseAddr(enable bool) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetConfig(enable, "tcp", "reuseaddr")
+
+		return nil
+	}
+}
+
+// WithReusePort set SO_REUSEPORT, several listeners may bind the same port
+func WithReusePort(enable bool) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetConfig(enable, "tcp", "reuseport")
+
+		return nil
+	}
+}
+
+// WithTOS set IP_TOS (IPV6_TCLASS for ipv6) byte
+func WithTOS(tos int) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetConfig(tos, "tcp", "tos")
+
+		return nil
+	}
+}
+
+// WithDSCP set the differentiated services code point, the upper six bits of the tos byte
+func WithDSCP(dscp int) stf4go.Option {
+	return WithTOS(dscp << 2)
+}
+
+// WithUserTimeout set TCP_USER_TIMEOUT, the max time transmitted data may stay unacknowledged
+func WithUserTimeout(timeout time.Duration) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetConfig(timeout.String(), "tcp", "usertimeout")
+
+		return nil
+	}
+}
+
+// WithLocalAddr dial from the local address, e.g. /ip4/0.0.0.0/tcp/5000 to fix the source port
+func WithLocalAddr(laddr multiaddr.Multiaddr) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetConfig(laddr.String(), "tcp", "localaddr")
+
+		return nil
+	}
+}
+
+// WithFastOpen enable TCP Fast Open, queue is the listener's pending fast open request limit, dials send
+// their first write with the syn and fall back to the regular handshake if the kernel refuses
+func WithFastOpen(queue int) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetConfig(queue, "tcp", "fastopen")
+
+		return nil
+	}
+}
+
+// WithDeferAccept set the listener TCP_DEFER_ACCEPT, accept only returns conns once the client sent data,
+// conns idle longer than timeout after the handshake are dropped, the kernel rounds it to retransmit periods
+func WithDeferAccept(timeout time.Duration) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetConfig(timeout.String(), "tcp", "deferaccept")
+
+		return nil
+	}
+}
@@ -0,0 +1,115 @@
+//go:build linux
+// +build linux
+
+package tcp
+
+import (
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/libs4go/errors"
+	"golang.org/x/sys/unix"
+)
+
+// control run set on the socket before bind or connect
+func control(network string, c syscall.RawConn, set func(fd int, ipv6 bool) error) error {
+	var err error
+
+	controlErr := c.Control(func(fd uintptr) {
+		err = set(int(fd), strings.HasSuffix(network, "6"))
+	})
+
+	if controlErr != nil {
+		return controlErr
+	}
+
+	return err
+}
+
+func (opts *sockopts) listenControl(network, address string, c syscall.RawConn) error {
+	return control(network, c, func(fd int, ipv6 bool) error {
+		if err := opts.setsockopt(fd, ipv6); err != nil {
+			return err
+		}
+
+		if opts.fastOpen > 0 {
+			if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_FASTOPEN, opts.fastOpen); err != nil {
+				return errors.Wrap(err, "set TCP_FASTOPEN error")
+			}
+		}
+
+		if opts.deferAccept > 0 {
+			sec := int((opts.deferAccept + time.Second - 1) / time.Second)
+
+			if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_DEFER_ACCEPT, sec); err != nil {
+				return errors.Wrap(err, "set TCP_DEFER_ACCEPT error")
+			}
+		}
+
+		return nil
+	})
+}
+
+func (opts *sockopts) dialControl(network, address string, c syscall.RawConn) error {
+	return control(network, c, func(fd int, ipv6 bool) error {
+		if err := opts.setsockopt(fd, ipv6); err != nil {
+			return err
+		}
+
+		if opts.fastOpen > 0 {
+			// kernels before 4.11 or with fast open disabled refuse it, connect then does the regular handshake
+			unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1)
+		}
+
+		return nil
+	})
+}
+
+func (opts *sockopts) setsockopt(fd int, ipv6 bool) error {
+	if opts.reuseAddr {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+			return errors.Wrap(err, "set SO_REUSEADDR error")
+		}
+	}
+
+	if opts.reusePort {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); err != nil {
+			return errors.Wrap(err, "set SO_REUSEPORT error")
+		}
+	}
+
+	if opts.readBuffer > 0 {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF, opts.readBuffer); err != nil {
+			return errors.Wrap(err, "set SO_RCVBUF error")
+		}
+	}
+
+	if opts.writeBuffer > 0 {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_SNDBUF, opts.writeBuffer); err != nil {
+			return errors.Wrap(err, "set SO_SNDBUF error")
+		}
+	}
+
+	if opts.tos > 0 {
+		if ipv6 {
+			if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_TCLASS, opts.tos); err != nil {
+				return errors.Wrap(err, "set IPV6_TCLASS error")
+			}
+		} else {
+			if err := unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TOS, opts.tos); err != nil {
+				return errors.Wrap(err, "set IP_TOS error")
+			}
+		}
+	}
+
+	if opts.userTimeout > 0 {
+		ms := int(opts.userTimeout.Milliseconds())
+
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, ms); err != nil {
+			return errors.Wrap(err, "set TCP_USER_TIMEOUT error")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,155 @@
+//go:build linux
+// +build linux
+
+package tcp
+
+import (
+	"context"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/libs4go/scf4go"
+	"github.com/libs4go/scf4go/reader/memory"
+	"github.com/libs4go/stf4go"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func getsockopt(t *testing.T, conn stf4go.Conn, level, opt int) int {
+	raw, err := conn.(*tcpConn).Conn.(*net.TCPConn).SyscallConn()
+
+	require.NoError(t, err)
+
+	return rawsockopt(t, raw, level, opt)
+}
+
+func rawsockopt(t *testing.T, raw syscall.RawConn, level, opt int) int {
+	var value int
+	var err error
+
+	require.NoError(t, raw.Control(func(fd uintptr) {
+		value, err = unix.GetsockoptInt(int(fd), level, opt)
+	}))
+
+	require.NoError(t, err)
+
+	return value
+}
+
+func TestSockopts(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1829")
+
+	require.NoError(t, err)
+
+	listener, err := stf4go.Listen(laddr, WithBuffer(64*1024, 64*1024), WithReusePort(true), WithNoDelay(false))
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	// SO_REUSEPORT lets a second listener bind the same port
+	listener2, err := stf4go.Listen(laddr, WithReusePort(true))
+
+	require.NoError(t, err)
+
+	listener2.Close()
+
+	accepted := make(chan stf4go.Conn, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+
+		require.NoError(t, err)
+
+		accepted <- conn
+	}()
+
+	local, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1830")
+
+	require.NoError(t, err)
+
+	conn, err := stf4go.Dial(context.Background(), laddr,
+		WithKeepAlive(30*time.Second),
+		WithLinger(0),
+		WithDSCP(46),
+		WithUserTimeout(5*time.Second),
+		WithLocalAddr(local))
+
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	require.Equal(t, local.String(), conn.LocalAddr().String())
+
+	require.Equal(t, 46<<2, getsockopt(t, conn, unix.IPPROTO_IP, unix.IP_TOS))
+	require.Equal(t, 5000, getsockopt(t, conn, unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT))
+	require.Equal(t, 1, getsockopt(t, conn, unix.SOL_SOCKET, unix.SO_KEEPALIVE))
+	require.Equal(t, 30, getsockopt(t, conn, unix.IPPROTO_TCP, unix.TCP_KEEPIDLE))
+	require.Equal(t, 1, getsockopt(t, conn, unix.IPPROTO_TCP, unix.TCP_NODELAY))
+
+	server := <-accepted
+
+	defer server.Close()
+
+	require.Equal(t, 0, getsockopt(t, server, unix.IPPROTO_TCP, unix.TCP_NODELAY))
+	// the kernel doubles the requested buffer size for bookkeeping
+	require.Equal(t, 2*64*1024, getsockopt(t, server, unix.SOL_SOCKET, unix.SO_RCVBUF))
+}
+
+func TestFastOpen(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1836")
+
+	require.NoError(t, err)
+
+	// listen with the native transport to reach the listener socket,
+	// the config is what WithFastOpen(16) and WithDeferAccept(5*time.Second) write
+	config := scf4go.New()
+
+	require.NoError(t, config.Load(memory.New(memory.Data(`{"tcp":{"fastopen":16,"deferaccept":"5s"}}`, "json"))))
+
+	listener, err := newTCPTransport().Listen(laddr, &stf4go.Options{Config: config})
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	raw, err := listener.(*tcpListener).listener.(*net.TCPListener).SyscallConn()
+
+	require.NoError(t, err)
+
+	require.Equal(t, 16, rawsockopt(t, raw, unix.IPPROTO_TCP, unix.TCP_FASTOPEN))
+	require.GreaterOrEqual(t, rawsockopt(t, raw, unix.IPPROTO_TCP, unix.TCP_DEFER_ACCEPT), 5)
+
+	conn, err := stf4go.Dial(context.Background(), laddr, WithFastOpen(1))
+
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	require.Equal(t, 1, getsockopt(t, conn, unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT))
+
+	// the deferred accept returns once the first write arrived
+	_, err = conn.Write([]byte("hello"))
+
+	require.NoError(t, err)
+
+	server, err := listener.Accept()
+
+	require.NoError(t, err)
+
+	defer server.Close()
+
+	var buff [5]byte
+
+	_, err = io.ReadFull(server, buff[:])
+
+	require.NoError(t, err)
+
+	require.Equal(t, "hello", string(buff[:]))
+}
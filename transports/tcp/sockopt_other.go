@@ -0,0 +1,34 @@
+//go:build !linux
+// +build !linux
+
+package tcp
+
+import (
+	"runtime"
+	"syscall"
+
+	"github.com/libs4go/errors"
+	"github.com/libs4go/stf4go"
+)
+
+// supported the socket level options are only implemented on linux
+func (opts *sockopts) supported() error {
+	if opts.reuseAddr || opts.reusePort || opts.readBuffer > 0 || opts.writeBuffer > 0 || opts.tos > 0 || opts.userTimeout > 0 {
+		return errors.Wrap(stf4go.ErrResource, "tcp socket options not supported on %s", runtime.GOOS)
+	}
+
+	return nil
+}
+
+func (opts *sockopts) listenControl(network, address string, c syscall.RawConn) error {
+	if opts.fastOpen > 0 || opts.deferAccept > 0 {
+		return errors.Wrap(stf4go.ErrResource, "tcp fast open and deferred accept not supported on %s", runtime.GOOS)
+	}
+
+	return opts.supported()
+}
+
+// dialControl dials fall back to the regular handshake without fast open
+func (opts *sockopts) dialControl(network, address string, c syscall.RawConn) error {
+	return opts.supported()
+}
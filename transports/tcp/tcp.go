@@ -3,6 +3,7 @@ package tcp
 import (
 	"context"
 	"net"
+	"syscall"
 
 	"github.com/libs4go/errors"
 	"github.com/libs4go/slf4go"
@@ -41,7 +42,9 @@ func (transport *tcpTransport) Listen(laddr multiaddr.Multiaddr, options *stf4go
 		return nil, errors.Wrap(err, "parser laddr %s error", laddr.String())
 	}
 
-	listener, err := net.Listen(network, host)
+	opts := getSockopts(options)
+
+	listener, err := opts.listenConfig().Listen(context.Background(), network, host)
 
 	if err != nil {
 		return nil, errors.Wrap(err, "call net.Listen(%s,%s) error", network, host)
@@ -50,6 +53,7 @@ func (transport *tcpTransport) Listen(laddr multiaddr.Multiaddr, options *stf4go
 	return &tcpListener{
 		listener: listener,
 		addr:     laddr,
+		opts:     opts,
 	}, nil
 }
 
@@ -61,7 +65,13 @@ func (transport *tcpTransport) Dial(ctx context.Context, raddr multiaddr.Multiad
 		return nil, errors.Wrap(err, "parser laddr %s error", raddr.String())
 	}
 
-	var dialer net.Dialer
+	opts := getSockopts(options)
+
+	dialer, err := opts.dialer()
+
+	if err != nil {
+		return nil, err
+	}
 
 	conn, err := dialer.DialContext(ctx, network, host)
 
@@ -69,12 +79,18 @@ func (transport *tcpTransport) Dial(ctx context.Context, raddr multiaddr.Multiad
 		return nil, errors.Wrap(err, "call net.Dial(%s,%s) error", network, host)
 	}
 
+	if err := opts.apply(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
 	return newTCPConn(conn)
 }
 
 type tcpListener struct {
 	listener net.Listener
 	addr     multiaddr.Multiaddr
+	opts     *sockopts
 }
 
 func (listener *tcpListener) Close() error {
@@ -88,6 +104,11 @@ func (listener *tcpListener) Accept() (stf4go.Conn, error) {
 		return nil, errors.Wrap(err, "call accept on listener %s error", listener.addr.String())
 	}
 
+	if err := listener.opts.apply(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
 	return newTCPConn(conn)
 }
 
@@ -134,6 +155,38 @@ func (conn *tcpConn) Underlying() stf4go.Conn {
 	return nil
 }
 
+// SyscallConn the raw tcp socket, e.g. to read TCP_INFO
+func (conn *tcpConn) SyscallConn() (syscall.RawConn, error) {
+	sc, ok := conn.Conn.(syscall.Conn)
+
+	if !ok {
+		return nil, errors.Wrap(stf4go.ErrResource, "conn %s has no raw socket", conn.laddr.String())
+	}
+
+	return sc.SyscallConn()
+}
+
+// CloseWrite send FIN, the peer reads io.EOF
+func (conn *tcpConn) CloseWrite() error {
+	tcpConn, ok := conn.Conn.(*net.TCPConn)
+
+	if !ok {
+		return errors.Wrap(stf4go.ErrResource, "conn %s not support half-close", conn.laddr.String())
+	}
+
+	return tcpConn.CloseWrite()
+}
+
+func (conn *tcpConn) CloseRead() error {
+	tcpConn, ok := conn.Conn.(*net.TCPConn)
+
+	if !ok {
+		return errors.Wrap(stf4go.ErrResource, "conn %s not support half-close", conn.laddr.String())
+	}
+
+	return tcpConn.CloseRead()
+}
+
 func init() {
 	stf4go.RegisterTransport(newTCPTransport())
 }
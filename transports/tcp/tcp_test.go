@@ -2,6 +2,7 @@ package tcp
 
 import (
 	"context"
+	"io/ioutil"
 	"net"
 	"sync"
 	"testing"
@@ -88,3 +89,51 @@ func TestListenConnect(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestHalfClose(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1831")
+
+	require.NoError(t, err)
+
+	listener, err := stf4go.Listen(laddr)
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+
+		require.NoError(t, err)
+
+		defer conn.Close()
+
+		// read until the client half-closed, then answer on the open direction
+		data, err := ioutil.ReadAll(conn)
+
+		require.NoError(t, err)
+
+		_, err = conn.Write(append([]byte("echo "), data...))
+
+		require.NoError(t, err)
+	}()
+
+	conn, err := stf4go.Dial(context.Background(), laddr)
+
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello"))
+
+	require.NoError(t, err)
+
+	require.NoError(t, stf4go.CloseWrite(conn))
+
+	data, err := ioutil.ReadAll(conn)
+
+	require.NoError(t, err)
+
+	require.Equal(t, "echo hello", string(data))
+}
@@ -0,0 +1,93 @@
+package tls
+
+import (
+	"crypto/tls"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/libs4go/bcf4go/key"
+	"github.com/libs4go/stf4go"
+)
+
+type cachedCert struct {
+	cert     *tls.Certificate
+	created  time.Time
+	validity time.Duration
+	rotation time.Duration
+}
+
+func (cached *cachedCert) expired(now time.Time) bool {
+	return now.Sub(cached.created) >= cached.rotation
+}
+
+// certCache identity mode certificates indexed by identity key,
+// so busy listeners skip the ecdsa keygen and x509 signing per handshake
+type certCache struct {
+	sync.Mutex
+	certs map[string]*cachedCert
+}
+
+// certRotationMargin rotation is clamped to validity minus 1/certRotationMargin of it
+const certRotationMargin = 10
+
+var globalCertCache = newCertCache()
+
+func newCertCache() *certCache {
+	return &certCache{
+		certs: make(map[string]*cachedCert),
+	}
+}
+
+func (cache *certCache) get(k key.Key, validity time.Duration, rotation time.Duration) (*tls.Certificate, error) {
+
+	// never hand out a certificate close to its NotAfter, the peer may check it a bit later
+	if max := validity - validity/certRotationMargin; rotation > max {
+		rotation = max
+	}
+
+	if rotation <= 0 {
+		return keyToCertificate(k, validity)
+	}
+
+	index := k.Provider().Name() + ":" + hex.EncodeToString(k.PubKey())
+
+	cache.Lock()
+	defer cache.Unlock()
+
+	now := time.Now()
+
+	for index, cached := range cache.certs {
+		if cached.expired(now) {
+			delete(cache.certs, index)
+		}
+	}
+
+	cached, ok := cache.certs[index]
+
+	if ok && cached.validity == validity && cached.rotation == rotation {
+		return cached.cert, nil
+	}
+
+	cert, err := keyToCertificate(k, validity)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cache.certs[index] = &cachedCert{
+		cert:     cert,
+		created:  now,
+		validity: validity,
+		rotation: rotation,
+	}
+
+	return cert, nil
+}
+
+func getIdentityCertificate(k key.Key, options *stf4go.Options) (*tls.Certificate, error) {
+	validity := options.Config.Get("tls", "validity").Duration(certValidityPeriod)
+	rotation := options.Config.Get("tls", "rotation").Duration(certRotationPeriod)
+
+	return globalCertCache.get(k, validity, rotation)
+}
@@ -20,6 +20,7 @@ import (
 )
 
 const certValidityPeriod = 100 * 365 * 24 * time.Hour // ~100 years
+const certRotationPeriod = 24 * time.Hour
 const certificatePrefix = "stf4go-transport-tls-handshake:"
 const alpn string = "stf4go-transport-tls"
 
@@ -50,7 +51,7 @@ type signedKey struct {
 	Signature []byte
 }
 
-func keyToCertificate(k key.Key) (*tls.Certificate, error) {
+func keyToCertificate(k key.Key, validity time.Duration) (*tls.Certificate, error) {
 	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
 		return nil, err
@@ -66,6 +67,10 @@ func keyToCertificate(k key.Key) (*tls.Certificate, error) {
 
 	signature, err := key.SignWithKey(k, append([]byte(certificatePrefix), certKeyPub...))
 
+	if err != nil {
+		return nil, err
+	}
+
 	value, err := asn1.Marshal(signedKey{
 		Provider:  k.Provider().Name(),
 		PubKey:    keyBytes,
@@ -83,7 +88,7 @@ func keyToCertificate(k key.Key) (*tls.Certificate, error) {
 	tmpl := &x509.Certificate{
 		SerialNumber: sn,
 		NotBefore:    time.Time{},
-		NotAfter:     time.Now().Add(certValidityPeriod),
+		NotAfter:     time.Now().Add(validity),
 		ExtraExtensions: []pkix.Extension{
 			{Id: extensionID, Value: value},
 		},
@@ -100,13 +105,13 @@ func keyToCertificate(k key.Key) (*tls.Certificate, error) {
 	}, nil
 }
 
-func newTLSConfig(key key.Key) (*tls.Config, chan []byte, error) {
-	cert, err := keyToCertificate(key)
-	if err != nil {
-		return nil, nil, err
-	}
+// remotePeer filled by VerifyPeerCertificate, it is set once the handshake succeeds
+type remotePeer struct {
+	peer *stf4go.Peer
+}
 
-	keyChan := make(chan []byte, 1)
+func newTLSConfig(cert *tls.Certificate, verifiers []stf4go.PeerVerifier, protos []string) (*tls.Config, *remotePeer) {
+	remote := &remotePeer{}
 
 	return &tls.Config{
 		MinVersion:               tls.VersionTLS13,
@@ -125,22 +130,26 @@ func newTLSConfig(key key.Key) (*tls.Config, chan []byte, error) {
 				chain[i] = cert
 			}
 
-			pubKey, err := publicKeyFromCertChain(chain)
+			peer, err := peerFromCertChain(chain)
 
 			if err != nil {
 				return err
 			}
 
-			keyChan <- pubKey
+			if err := stf4go.AuthorizePeer(verifiers, peer); err != nil {
+				return err
+			}
+
+			remote.peer = peer
 
 			return nil
 		},
-		NextProtos:             []string{alpn},
+		NextProtos:             protos,
 		SessionTicketsDisabled: true,
-	}, keyChan, nil
+	}, remote
 }
 
-func publicKeyFromCertChain(chain []*x509.Certificate) ([]byte, error) {
+func peerFromCertChain(chain []*x509.Certificate) (*stf4go.Peer, error) {
 	if len(chain) != 1 {
 		return nil, errors.New("expected one certificates in the chain")
 	}
@@ -176,13 +185,7 @@ func publicKeyFromCertChain(chain []*x509.Certificate) ([]byte, error) {
 		return nil, err
 	}
 
-	valid := key.Verify(sk.Provider, sk.PubKey, sk.Signature, append([]byte(certificatePrefix), certKeyPub...))
-
-	if !valid {
-		return nil, errors.Wrap(stf4go.ErrSign, "")
-	}
-
-	return sk.PubKey, nil
+	return stf4go.VerifyPeer(sk.Provider, sk.PubKey, sk.Signature, append([]byte(certificatePrefix), certKeyPub...))
 }
 
 // We want nodes without AES hardware (e.g. ARM) support to always use ChaCha.
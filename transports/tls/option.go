@@ -1,6 +1,10 @@
 package tls
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"time"
+
 	"github.com/libs4go/bcf4go/key"
 	"github.com/libs4go/errors"
 	"github.com/libs4go/stf4go"
@@ -30,3 +34,127 @@ func WithKey(k key.Key) stf4go.Option {
 		return nil
 	}
 }
+
+// WithMode select the tls transport mode, default is ModeIdentity
+func WithMode(mode Mode) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetConfig(string(mode), "tls", "mode")
+
+		return nil
+	}
+}
+
+// WithRootCAs set the CA pool used to verify server certificate chains in pki mode,
+// the system pool is used if not set
+func WithRootCAs(pool *x509.CertPool) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetObject(pool, "tls", "rootcas")
+
+		return nil
+	}
+}
+
+// WithRootCAsFile load the pki mode CA pool from PEM file
+func WithRootCAsFile(file string) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetConfig(file, "tls", "rootcas")
+
+		return nil
+	}
+}
+
+// WithCertificate set the certificate presented to the peer in pki mode,
+// it is required on the server side and optional on the client side
+func WithCertificate(cert tls.Certificate) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetObject(cert, "tls", "certificate")
+
+		return nil
+	}
+}
+
+// WithCertificateFile load the pki mode certificate chain and private key from PEM files
+func WithCertificateFile(certFile, keyFile string) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetConfig(certFile, "tls", "certfile")
+		options.SetConfig(keyFile, "tls", "keyfile")
+
+		return nil
+	}
+}
+
+// WithServerName set the server name used for SNI and hostname verification in pki mode,
+// the /sni/<name> multiaddr parameter takes precedence
+func WithServerName(name string) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetConfig(name, "tls", "servername")
+
+		return nil
+	}
+}
+
+// WithClientAuth set the server side client certificate policy in pki mode
+func WithClientAuth(auth tls.ClientAuthType) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetConfig(int(auth), "tls", "clientauth")
+
+		return nil
+	}
+}
+
+// WithClientCAs set the CA pool used to verify client certificates in pki mode
+func WithClientCAs(pool *x509.CertPool) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetObject(pool, "tls", "clientcas")
+
+		return nil
+	}
+}
+
+// WithClientCAsFile load the client CA pool from PEM file
+func WithClientCAsFile(file string) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetConfig(file, "tls", "clientcas")
+
+		return nil
+	}
+}
+
+// WithCertValidity set identity mode certificate validity period, default is ~100 years
+func WithCertValidity(d time.Duration) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetConfig(d.String(), "tls", "validity")
+
+		return nil
+	}
+}
+
+// WithCertRotation set identity mode certificate cache rotation interval, default is 24h,
+// zero disables the cache and generates new certificate per handshake,
+// the interval is clamped to 90% of the certificate validity
+func WithCertRotation(d time.Duration) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetConfig(d.String(), "tls", "rotation")
+
+		return nil
+	}
+}
+
+func getALPN(options *stf4go.Options, def []string) []string {
+	obj, ok := options.GetObj("tls", "alpn")
+
+	if !ok {
+		return def
+	}
+
+	return obj.([]string)
+}
+
+// WithALPN set the ALPN protocols in preference order, replacing the identity mode default stf4go-transport-tls
+func WithALPN(protos ...string) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetObject(protos, "tls", "alpn")
+
+		return nil
+	}
+}
@@ -0,0 +1,186 @@
+package tls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+
+	"github.com/libs4go/errors"
+	"github.com/libs4go/stf4go"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// Mode tls transport working mode
+type Mode string
+
+// tls transport modes
+const (
+	// ModeIdentity self-signed certificate carrying the signed identity key extension (default)
+	ModeIdentity Mode = "identity"
+	// ModePKI standard X.509 certificate chains verified against a CA pool
+	ModePKI Mode = "pki"
+)
+
+const protocolSNIID = 485
+
+// protoSNI tls parameter carrying the server name, e.g. /tls/sni/example.com
+var protoSNI = multiaddr.Protocol{
+	Name:       "sni",
+	Code:       protocolSNIID,
+	VCode:      multiaddr.CodeToVarint(protocolSNIID),
+	Size:       multiaddr.LengthPrefixedVarSize,
+	Transcoder: multiaddr.TranscoderDns,
+}
+
+func init() {
+	if err := multiaddr.AddProtocol(protoSNI); err != nil {
+		panic(err)
+	}
+
+	stf4go.RegisterParameter(protoSNI)
+}
+
+func getMode(options *stf4go.Options) Mode {
+	return Mode(options.Config.Get("tls", "mode").String(string(ModeIdentity)))
+}
+
+func getServerName(conn stf4go.Conn, raddr multiaddr.Multiaddr, options *stf4go.Options) (string, error) {
+	if sni, err := raddr.ValueForProtocol(protocolSNIID); err == nil {
+		return sni, nil
+	}
+
+	if serverName := options.Config.Get("tls", "servername").String(""); serverName != "" {
+		return serverName, nil
+	}
+
+	// fallback to the remote host, so ip SANs can be verified
+	addr, err := stf4go.ToNetAddr(conn.RemoteAddr())
+
+	if err != nil {
+		return "", err
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+
+	if err != nil {
+		return "", errors.Wrap(err, "split remote addr %s error", addr.String())
+	}
+
+	return host, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	buff, err := ioutil.ReadFile(file)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "read ca file %s error", file)
+	}
+
+	pool := x509.NewCertPool()
+
+	if !pool.AppendCertsFromPEM(buff) {
+		return nil, errors.Wrap(stf4go.ErrResource, "ca file %s contains no PEM certificate", file)
+	}
+
+	return pool, nil
+}
+
+func getCertPool(options *stf4go.Options, name string) (*x509.CertPool, error) {
+	if obj, ok := options.GetObj("tls", name); ok {
+		pool, ok := obj.(*x509.CertPool)
+
+		if !ok {
+			return nil, errors.Wrap(stf4go.ErrResource, "expect x509.CertPool")
+		}
+
+		return pool, nil
+	}
+
+	if file := options.Config.Get("tls", name).String(""); file != "" {
+		return loadCertPool(file)
+	}
+
+	return nil, nil
+}
+
+func getCertificates(options *stf4go.Options) ([]tls.Certificate, error) {
+	if obj, ok := options.GetObj("tls", "certificate"); ok {
+		cert, ok := obj.(tls.Certificate)
+
+		if !ok {
+			return nil, errors.Wrap(stf4go.ErrResource, "expect tls.Certificate")
+		}
+
+		return []tls.Certificate{cert}, nil
+	}
+
+	certFile := options.Config.Get("tls", "certfile").String("")
+	keyFile := options.Config.Get("tls", "keyfile").String("")
+
+	if certFile == "" || keyFile == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "load x509 key pair %s %s error", certFile, keyFile)
+	}
+
+	return []tls.Certificate{cert}, nil
+}
+
+func newPKIClientConfig(conn stf4go.Conn, raddr multiaddr.Multiaddr, options *stf4go.Options) (*tls.Config, error) {
+	rootCAs, err := getCertPool(options, "rootcas")
+
+	if err != nil {
+		return nil, err
+	}
+
+	serverName, err := getServerName(conn, raddr, options)
+
+	if err != nil {
+		return nil, err
+	}
+
+	certs, err := getCertificates(options)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		RootCAs:      rootCAs, // nil means the system pool
+		ServerName:   serverName,
+		Certificates: certs,
+		NextProtos:   getALPN(options, nil),
+	}, nil
+}
+
+func newPKIServerConfig(options *stf4go.Options) (*tls.Config, error) {
+	certs, err := getCertificates(options)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(certs) == 0 {
+		return nil, errors.Wrap(stf4go.ErrResource, "expect server certificate")
+	}
+
+	clientCAs, err := getCertPool(options, "clientcas")
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: certs,
+		ClientAuth:   tls.ClientAuthType(options.Config.Get("tls", "clientauth").Int(int(tls.NoClientCert))),
+		ClientCAs:    clientCAs,
+		NextProtos:   getALPN(options, nil),
+	}, nil
+}
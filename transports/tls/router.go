@@ -0,0 +1,138 @@
+package tls
+
+import (
+	"sync"
+	"time"
+
+	"github.com/libs4go/slf4go"
+	"github.com/libs4go/stf4go"
+)
+
+// Handler serve one tls conn routed by negotiated ALPN protocol
+type Handler func(conn Conn)
+
+// Router dispatch conns accepted from one tls listener to handlers by negotiated ALPN protocol,
+// so one tls port can serve several application protocols
+type Router struct {
+	slf4go.Logger
+	sync.RWMutex
+	listener stf4go.Listener
+	handlers map[string]Handler
+	fallback Handler
+	closed   bool
+}
+
+// NewRouter create ALPN router over tls listener, the listener should be created with WithALPN
+func NewRouter(listener stf4go.Listener) *Router {
+	return &Router{
+		Logger:   slf4go.Get("stf4go-transport-tls-router"),
+		listener: listener,
+		handlers: make(map[string]Handler),
+	}
+}
+
+// Handle register handler for conns negotiated ALPN protocol
+func (router *Router) Handle(protocol string, handler Handler) {
+	router.Lock()
+	defer router.Unlock()
+
+	router.handlers[protocol] = handler
+}
+
+// HandleDefault register handler for conns without matching protocol handler,
+// including conns without negotiated protocol, those conns are closed if not set
+func (router *Router) HandleDefault(handler Handler) {
+	router.Lock()
+	defer router.Unlock()
+
+	router.fallback = handler
+}
+
+func (router *Router) handler(protocol string) Handler {
+	router.RLock()
+	defer router.RUnlock()
+
+	if handler, ok := router.handlers[protocol]; ok {
+		return handler
+	}
+
+	return router.fallback
+}
+
+func (router *Router) isClosed() bool {
+	router.RLock()
+	defer router.RUnlock()
+
+	return router.closed
+}
+
+// Serve accept conns and dispatch them to handlers in new goroutines, returns nil after Close.
+// failed handshakes only concern their conn and are skipped at once, temporary accept errors are
+// retried with backoff as net/http does, other accept errors are returned
+func (router *Router) Serve() error {
+	var delay time.Duration
+
+	for {
+		conn, err := router.listener.Accept()
+
+		if err != nil {
+			if router.isClosed() {
+				return nil
+			}
+
+			acceptErr, ok := err.(*stf4go.AcceptError)
+
+			if !ok {
+				router.W("accept handshake error {@err}", err)
+				continue
+			}
+
+			if !acceptErr.Temporary() {
+				return err
+			}
+
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > time.Second {
+				delay = time.Second
+			}
+
+			router.W("accept error {@err}, retry in {@delay}", err, delay.String())
+
+			time.Sleep(delay)
+
+			continue
+		}
+
+		delay = 0
+
+		tlsConn, ok := conn.(Conn)
+
+		if !ok {
+			router.E("accept conn {@addr} is not tls conn", conn.RemoteAddr().String())
+			conn.Close()
+			continue
+		}
+
+		protocol := tlsConn.NegotiatedProtocol()
+
+		handler := router.handler(protocol)
+
+		if handler == nil {
+			router.W("drop conn {@addr} with unhandled protocol '{@proto}'", conn.RemoteAddr().String(), protocol)
+			conn.Close()
+			continue
+		}
+
+		go handler(tlsConn)
+	}
+}
+
+// Close stop Serve and close the underlying listener
+func (router *Router) Close() error {
+	router.Lock()
+	router.closed = true
+	router.Unlock()
+
+	return router.listener.Close()
+}
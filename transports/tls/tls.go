@@ -2,7 +2,8 @@ package tls
 
 import (
 	"crypto/tls"
-	"net"
+	"sync"
+	"time"
 
 	_ "github.com/libs4go/bcf4go/key/encoding" //
 	_ "github.com/libs4go/bcf4go/key/provider" //
@@ -63,25 +64,47 @@ func (transport *tlsTransport) Client(conn stf4go.Conn, raddr multiaddr.Multiadd
 		return nil, err
 	}
 
+	switch mode := getMode(options); mode {
+	case ModeIdentity:
+	case ModePKI:
+		tlsConfig, err := newPKIClientConfig(conn, raddr, options)
+
+		if err != nil {
+			return nil, err
+		}
+
+		session := tls.Client(wrapConn, tlsConfig)
+
+		if err := session.Handshake(); err != nil {
+			return nil, errors.Wrap(err, "tls handshake error")
+		}
+
+		return newTLSConn(session, conn, nil, nil), nil
+	default:
+		return nil, errors.Wrap(stf4go.ErrResource, "unknown tls mode %s", mode)
+	}
+
 	key, err := getKey(options)
 
 	if err != nil {
 		return nil, err
 	}
 
-	tlsConfig, remoteKey, err := newTLSConfig(key)
+	cert, err := getIdentityCertificate(key, options)
 
 	if err != nil {
 		return nil, err
 	}
 
+	tlsConfig, remote := newTLSConfig(cert, getPeerVerifiers(options), getALPN(options, []string{alpn}))
+
 	session := tls.Client(wrapConn, tlsConfig)
 
 	if err := session.Handshake(); err != nil {
 		return nil, errors.Wrap(err, "tls handshake error")
 	}
 
-	return newTLSConn(session, conn, key.PubKey(), remoteKey)
+	return newTLSConn(session, conn, stf4go.NewPeer(key.Provider().Name(), key.PubKey()), remote.peer), nil
 }
 
 func (transport *tlsTransport) Server(conn stf4go.Conn, laddr multiaddr.Multiaddr, options *stf4go.Options) (stf4go.Conn, error) {
@@ -92,46 +115,70 @@ func (transport *tlsTransport) Server(conn stf4go.Conn, laddr multiaddr.Multiadd
 		return nil, err
 	}
 
+	switch mode := getMode(options); mode {
+	case ModeIdentity:
+	case ModePKI:
+		tlsConfig, err := newPKIServerConfig(options)
+
+		if err != nil {
+			return nil, err
+		}
+
+		session := tls.Server(wrapConn, tlsConfig)
+
+		if err := session.Handshake(); err != nil {
+			return nil, errors.Wrap(err, "tls handshake error")
+		}
+
+		return newTLSConn(session, conn, nil, nil), nil
+	default:
+		return nil, errors.Wrap(stf4go.ErrResource, "unknown tls mode %s", mode)
+	}
+
 	key, err := getKey(options)
 
 	if err != nil {
 		return nil, err
 	}
 
-	tlsConfig, remoteKey, err := newTLSConfig(key)
+	cert, err := getIdentityCertificate(key, options)
 
 	if err != nil {
 		return nil, err
 	}
 
+	tlsConfig, remote := newTLSConfig(cert, getPeerVerifiers(options), getALPN(options, []string{alpn}))
+
 	session := tls.Server(wrapConn, tlsConfig)
 
 	if err := session.Handshake(); err != nil {
 		return nil, errors.Wrap(err, "tls handshake error")
 	}
 
-	return newTLSConn(session, conn, key.PubKey(), remoteKey)
+	return newTLSConn(session, conn, stf4go.NewPeer(key.Provider().Name(), key.PubKey()), remote.peer), nil
 }
 
 type tlsConn struct {
-	net.Conn
+	*tls.Conn
 	laddr      multiaddr.Multiaddr
 	raddr      multiaddr.Multiaddr
-	remoteKey  chan []byte
 	underlying stf4go.Conn
-	localKey   []byte
+	localPeer  *stf4go.Peer
+	remotePeer *stf4go.Peer
+	wlock      sync.Mutex
+	deadline   time.Time // the caller's write deadline, restored after close_notify
 }
 
-func newTLSConn(conn net.Conn, underlying stf4go.Conn, localKey []byte, remoteKey chan []byte) (*tlsConn, error) {
+func newTLSConn(conn *tls.Conn, underlying stf4go.Conn, localPeer *stf4go.Peer, remotePeer *stf4go.Peer) *tlsConn {
 
 	return &tlsConn{
 		Conn:       conn,
 		laddr:      underlying.LocalAddr().Encapsulate(tlsMultiAddr),
 		raddr:      underlying.RemoteAddr().Encapsulate(tlsMultiAddr),
-		remoteKey:  remoteKey,
 		underlying: underlying,
-		localKey:   localKey,
-	}, nil
+		localPeer:  localPeer,
+		remotePeer: remotePeer,
+	}
 }
 
 func (conn *tlsConn) LocalAddr() multiaddr.Multiaddr {
@@ -146,17 +193,62 @@ func (conn *tlsConn) Underlying() stf4go.Conn {
 	return conn.underlying
 }
 
-func (conn *tlsConn) Close() error {
-	close(conn.remoteKey)
-	return conn.Conn.Close()
+func (conn *tlsConn) SetDeadline(t time.Time) error {
+	conn.wlock.Lock()
+	defer conn.wlock.Unlock()
+
+	conn.deadline = t
+
+	return conn.Conn.SetDeadline(t)
+}
+
+func (conn *tlsConn) SetWriteDeadline(t time.Time) error {
+	conn.wlock.Lock()
+	defer conn.wlock.Unlock()
+
+	conn.deadline = t
+
+	return conn.Conn.SetWriteDeadline(t)
+}
+
+// CloseWrite send close_notify, then half-close the underlying conn if it supports half-close
+func (conn *tlsConn) CloseWrite() error {
+	if err := conn.Conn.CloseWrite(); err != nil {
+		return errors.Wrap(err, "send tls close_notify error")
+	}
+
+	if _, ok := conn.underlying.(stf4go.HalfCloser); !ok {
+		return nil
+	}
+
+	// crypto/tls expires the write deadline after close_notify, the layers below may still
+	// have to end their own streams within the caller's deadline
+	conn.wlock.Lock()
+	err := conn.underlying.SetWriteDeadline(conn.deadline)
+	conn.wlock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return stf4go.CloseWrite(conn.underlying)
+}
+
+// CloseRead tls has no read side shutdown, it is forwarded to the underlying conn
+func (conn *tlsConn) CloseRead() error {
+	return stf4go.CloseRead(conn.underlying)
+}
+
+func (conn *tlsConn) RemotePeer() *stf4go.Peer {
+	return conn.remotePeer
 }
 
-func (conn *tlsConn) RemoteKey() <-chan []byte {
-	return conn.remoteKey
+func (conn *tlsConn) LocalPeer() *stf4go.Peer {
+	return conn.localPeer
 }
 
-func (conn *tlsConn) LocalKey() []byte {
-	return conn.localKey
+func (conn *tlsConn) NegotiatedProtocol() string {
+	return conn.ConnectionState().NegotiatedProtocol
 }
 
 func init() {
@@ -166,6 +258,12 @@ func init() {
 // Conn .
 type Conn interface {
 	stf4go.Conn
-	RemoteKey() <-chan []byte
-	LocalKey() []byte
+	// RemotePeer the verified remote identity, nil in pki mode
+	RemotePeer() *stf4go.Peer
+	// LocalPeer the local identity, nil in pki mode
+	LocalPeer() *stf4go.Peer
+	// ConnectionState the tls session state, including the verified peer certificate chains in pki mode
+	ConnectionState() tls.ConnectionState
+	// NegotiatedProtocol the ALPN protocol agreed during the handshake, empty if none
+	NegotiatedProtocol() string
 }
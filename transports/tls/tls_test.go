@@ -1,10 +1,26 @@
 package tls
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/libs4go/bcf4go/key"
+	"github.com/libs4go/errors"
 	"github.com/libs4go/scf4go"
 	"github.com/libs4go/scf4go/reader/memory"
 	"github.com/libs4go/slf4go"
@@ -89,5 +105,724 @@ func TestListenConnect(t *testing.T) {
 
 	// require.NoError(t, err)
 
-	<-conn.(Conn).RemoteKey()
+	peer := conn.(Conn).RemotePeer()
+
+	require.NotNil(t, peer)
+
+	require.Equal(t, "did", peer.Provider)
+
+	require.Equal(t, peer, conn.(Conn).RemotePeer())
+
+	require.NoError(t, conn.Close())
+}
+
+func newTestCA(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "stf4go test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, caKey.Public(), caKey)
+
+	require.NoError(t, err)
+
+	ca, err := x509.ParseCertificate(der)
+
+	require.NoError(t, err)
+
+	return ca, caKey
+}
+
+func newTestCertificate(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, name string, usage x509.ExtKeyUsage) tls.Certificate {
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	require.NoError(t, err)
+
+	sn, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: sn,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, certKey.Public(), caKey)
+
+	require.NoError(t, err)
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  certKey,
+	}
+}
+
+func TestPKIListenConnect(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1815/tls/sni/example.com")
+
+	require.NoError(t, err)
+
+	ca, caKey := newTestCA(t)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	serverCert := newTestCertificate(t, ca, caKey, "example.com", x509.ExtKeyUsageServerAuth)
+	clientCert := newTestCertificate(t, ca, caKey, "client", x509.ExtKeyUsageClientAuth)
+
+	listener, err := stf4go.Listen(laddr,
+		WithMode(ModePKI),
+		WithCertificate(serverCert),
+		WithClientAuth(tls.RequireAndVerifyClientCert),
+		WithClientCAs(pool))
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	go func() {
+
+		conn, err := stf4go.Dial(context.Background(), laddr,
+			WithMode(ModePKI),
+			WithRootCAs(pool),
+			WithCertificate(clientCert))
+
+		require.NoError(t, err)
+
+		state := conn.(Conn).ConnectionState()
+
+		require.Equal(t, "example.com", state.ServerName)
+
+		require.Equal(t, "example.com", state.PeerCertificates[0].Subject.CommonName)
+
+		_, err = conn.Write([]byte("hello world"))
+
+		require.NoError(t, err)
+	}()
+
+	conn, err := listener.Accept()
+
+	require.NoError(t, err)
+
+	var buff [11]byte
+
+	_, err = io.ReadFull(conn, buff[:])
+
+	require.NoError(t, err)
+
+	require.Equal(t, "hello world", string(buff[:]))
+
+	require.Equal(t, "client", conn.(Conn).ConnectionState().PeerCertificates[0].Subject.CommonName)
+}
+
+func TestPKIHostnameVerification(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1816/tls")
+
+	require.NoError(t, err)
+
+	raddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1816/tls/sni/other.com")
+
+	require.NoError(t, err)
+
+	ca, caKey := newTestCA(t)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	listener, err := stf4go.Listen(laddr,
+		WithMode(ModePKI),
+		WithCertificate(newTestCertificate(t, ca, caKey, "example.com", x509.ExtKeyUsageServerAuth)))
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	go func() {
+		_, err := listener.Accept()
+
+		require.Error(t, err)
+	}()
+
+	_, err = stf4go.Dial(context.Background(), raddr, WithMode(ModePKI), WithRootCAs(pool))
+
+	require.Error(t, err)
+}
+
+func TestPeerVerifier(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1817/tls")
+
+	require.NoError(t, err)
+
+	serverKey, err := key.RandomKey("did")
+
+	require.NoError(t, err)
+
+	allowedKey, err := key.RandomKey("did")
+
+	require.NoError(t, err)
+
+	deniedKey, err := key.RandomKey("did")
+
+	require.NoError(t, err)
+
+	listener, err := stf4go.Listen(laddr,
+		WithKey(serverKey),
+		WithPeerVerifier(stf4go.AllowList(allowedKey.PubKey(), deniedKey.PubKey())),
+		WithPeerVerifier(stf4go.DenyList(deniedKey.PubKey())))
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	go func() {
+		_, err := stf4go.Dial(context.Background(), laddr, WithKey(allowedKey))
+
+		require.NoError(t, err)
+	}()
+
+	conn, err := listener.Accept()
+
+	require.NoError(t, err)
+
+	require.Equal(t, allowedKey.PubKey(), conn.(Conn).RemotePeer().PubKey)
+
+	require.Equal(t, allowedKey.Address(), conn.(Conn).RemotePeer().ID)
+
+	for _, k := range []key.Key{deniedKey, serverKey} {
+		go func(k key.Key) {
+			conn, err := stf4go.Dial(context.Background(), laddr, WithKey(k))
+
+			if err == nil {
+				// tls 1.3 client finishes before the server verifies its certificate
+				_, err = conn.Read(make([]byte, 1))
+			}
+
+			require.Error(t, err)
+		}(k)
+
+		_, err = listener.Accept()
+
+		require.True(t, errors.Is(err, stf4go.ErrUnauthorized))
+	}
+}
+
+func TestForgedIdentity(t *testing.T) {
+	attacker, err := key.RandomKey("did")
+
+	require.NoError(t, err)
+
+	victim, err := key.RandomKey("did")
+
+	require.NoError(t, err)
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	require.NoError(t, err)
+
+	certKeyPub, err := x509.MarshalPKIXPublicKey(certKey.Public())
+
+	require.NoError(t, err)
+
+	signature, err := key.SignWithKey(attacker, append([]byte(certificatePrefix), certKeyPub...))
+
+	require.NoError(t, err)
+
+	// the attacker signature with the victim key claimed
+	value, err := asn1.Marshal(signedKey{
+		Provider:  attacker.Provider().Name(),
+		PubKey:    victim.PubKey(),
+		Signature: signature,
+	})
+
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtraExtensions: []pkix.Extension{
+			{Id: extensionID, Value: value},
+		},
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, certKey.Public(), certKey)
+
+	require.NoError(t, err)
+
+	cert, err := keyToCertificate(victim, time.Hour)
+
+	require.NoError(t, err)
+
+	verified := false
+
+	config, remote := newTLSConfig(cert, []stf4go.PeerVerifier{func(provider string, pubKey []byte) error {
+		verified = true
+		return nil
+	}}, nil)
+
+	err = config.VerifyPeerCertificate([][]byte{certDER}, nil)
+
+	require.True(t, errors.Is(err, stf4go.ErrSign))
+
+	require.False(t, verified)
+
+	require.Nil(t, remote.peer)
+}
+
+func TestRouter(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1818/tls")
+
+	require.NoError(t, err)
+
+	serverKey, err := key.RandomKey("did")
+
+	require.NoError(t, err)
+
+	clientKey, err := key.RandomKey("did")
+
+	require.NoError(t, err)
+
+	listener, err := stf4go.Listen(laddr, WithKey(serverKey), WithALPN("echo/1", "upper/1"))
+
+	require.NoError(t, err)
+
+	router := NewRouter(listener)
+
+	defer router.Close()
+
+	router.Handle("echo/1", func(conn Conn) {
+		io.Copy(conn, conn)
+	})
+
+	router.Handle("upper/1", func(conn Conn) {
+		var buff [5]byte
+
+		if _, err := io.ReadFull(conn, buff[:]); err == nil {
+			conn.Write(bytes.ToUpper(buff[:]))
+		}
+	})
+
+	go router.Serve()
+
+	for _, proto := range []string{"echo/1", "upper/1"} {
+		conn, err := stf4go.Dial(context.Background(), laddr, WithKey(clientKey), WithALPN(proto))
+
+		require.NoError(t, err)
+
+		require.Equal(t, proto, conn.(Conn).NegotiatedProtocol())
+
+		_, err = conn.Write([]byte("hello"))
+
+		require.NoError(t, err)
+
+		var buff [5]byte
+
+		_, err = io.ReadFull(conn, buff[:])
+
+		require.NoError(t, err)
+
+		if proto == "echo/1" {
+			require.Equal(t, "hello", string(buff[:]))
+		} else {
+			require.Equal(t, "HELLO", string(buff[:]))
+		}
+
+		conn.Close()
+	}
+
+	// no default handler, the router drops unhandled conns
+	conn, err := stf4go.Dial(context.Background(), laddr, WithKey(clientKey))
+
+	if err == nil {
+		_, err = conn.Read(make([]byte, 1))
+	}
+
+	require.Error(t, err)
+
+	// failed handshakes keep the router serving without slowing it down
+	for i := 0; i < 10; i++ {
+		raw, err := net.Dial("tcp", "127.0.0.1:1818")
+
+		require.NoError(t, err)
+
+		_, err = raw.Write([]byte("garbage"))
+
+		require.NoError(t, err)
+
+		raw.Close()
+	}
+
+	start := time.Now()
+
+	conn, err = stf4go.Dial(context.Background(), laddr, WithKey(clientKey), WithALPN("echo/1"))
+
+	require.NoError(t, err)
+
+	require.True(t, time.Since(start) < time.Second)
+
+	conn.Close()
+}
+
+func TestRouterListenerError(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1870/tls")
+
+	require.NoError(t, err)
+
+	serverKey, err := key.RandomKey("did")
+
+	require.NoError(t, err)
+
+	listener, err := stf4go.Listen(laddr, WithKey(serverKey))
+
+	require.NoError(t, err)
+
+	router := NewRouter(listener)
+
+	served := make(chan error, 1)
+
+	go func() {
+		served <- router.Serve()
+	}()
+
+	// closed behind the router, the accept error is permanent
+	require.NoError(t, listener.Close())
+
+	select {
+	case err := <-served:
+		require.Error(t, err)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "router keeps retrying a dead listener")
+	}
+}
+
+func TestCertCache(t *testing.T) {
+	k, err := key.RandomKey("did")
+
+	require.NoError(t, err)
+
+	cache := newCertCache()
+
+	cert1, err := cache.get(k, time.Hour, time.Minute)
+
+	require.NoError(t, err)
+
+	cert2, err := cache.get(k, time.Hour, time.Minute)
+
+	require.NoError(t, err)
+
+	require.True(t, cert1 == cert2)
+
+	cert3, err := cache.get(k, 2*time.Hour, time.Minute)
+
+	require.NoError(t, err)
+
+	require.False(t, cert1 == cert3)
+
+	cache.certs[k.Provider().Name()+":"+hex.EncodeToString(k.PubKey())].created = time.Now().Add(-2 * time.Minute)
+
+	cert4, err := cache.get(k, 2*time.Hour, time.Minute)
+
+	require.NoError(t, err)
+
+	require.False(t, cert3 == cert4)
+
+	leaf, err := x509.ParseCertificate(cert4.Certificate[0])
+
+	require.NoError(t, err)
+
+	require.WithinDuration(t, time.Now().Add(2*time.Hour), leaf.NotAfter, time.Minute)
+
+	cert5, err := cache.get(k, time.Hour, 0)
+
+	require.NoError(t, err)
+
+	require.False(t, cert4 == cert5)
+
+	// rotation longer than validity is clamped, so expired certificates are never served
+	_, err = cache.get(k, time.Minute, time.Hour)
+
+	require.NoError(t, err)
+
+	index := k.Provider().Name() + ":" + hex.EncodeToString(k.PubKey())
+
+	require.True(t, cache.certs[index].rotation < time.Minute)
+
+	cache.certs[index].created = time.Now().Add(-time.Minute)
+
+	other, err := key.RandomKey("did")
+
+	require.NoError(t, err)
+
+	_, err = cache.get(other, time.Hour, time.Minute)
+
+	require.NoError(t, err)
+
+	require.Equal(t, 1, len(cache.certs))
+}
+
+func benchmarkHandshake(b *testing.B, rotation time.Duration) {
+	serverKey, err := key.RandomKey("did")
+
+	require.NoError(b, err)
+
+	clientKey, err := key.RandomKey("did")
+
+	require.NoError(b, err)
+
+	cache := newCertCache()
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		c1, c2 := net.Pipe()
+
+		go func() {
+			cert, err := cache.get(clientKey, certValidityPeriod, rotation)
+
+			require.NoError(b, err)
+
+			config, _ := newTLSConfig(cert, nil, []string{alpn})
+
+			session := tls.Client(c1, config)
+
+			require.NoError(b, session.Handshake())
+
+			c1.Close()
+		}()
+
+		cert, err := cache.get(serverKey, certValidityPeriod, rotation)
+
+		require.NoError(b, err)
+
+		config, _ := newTLSConfig(cert, nil, []string{alpn})
+
+		session := tls.Server(c2, config)
+
+		require.NoError(b, session.Handshake())
+
+		c2.Close()
+	}
+}
+
+func BenchmarkHandshake(b *testing.B) {
+	b.Run("uncached", func(b *testing.B) {
+		benchmarkHandshake(b, 0)
+	})
+
+	b.Run("cached", func(b *testing.B) {
+		benchmarkHandshake(b, certRotationPeriod)
+	})
+}
+
+func TestHalfClose(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1832/tls")
+
+	require.NoError(t, err)
+
+	serverKey, err := key.RandomKey("did")
+
+	require.NoError(t, err)
+
+	clientKey, err := key.RandomKey("did")
+
+	require.NoError(t, err)
+
+	listener, err := stf4go.Listen(laddr, WithKey(serverKey))
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+
+		require.NoError(t, err)
+
+		defer conn.Close()
+
+		// read until the client half-closed, then answer on the open direction
+		data, err := ioutil.ReadAll(conn)
+
+		require.NoError(t, err)
+
+		_, err = conn.Write(append([]byte("echo "), data...))
+
+		require.NoError(t, err)
+	}()
+
+	conn, err := stf4go.Dial(context.Background(), laddr, WithKey(clientKey))
+
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello"))
+
+	require.NoError(t, err)
+
+	require.NoError(t, stf4go.CloseWrite(conn))
+
+	data, err := ioutil.ReadAll(conn)
+
+	require.NoError(t, err)
+
+	require.Equal(t, "echo hello", string(data))
+}
+
+func TestSyscallConn(t *testing.T) {
+
+	for _, addr := range []string{"/ip4/127.0.0.1/tcp/1834/tls", "/ip4/127.0.0.1/udp/1835/kcp/tls"} {
+		laddr, err := multiaddr.NewMultiaddr(addr)
+
+		require.NoError(t, err)
+
+		k, err := key.RandomKey("did")
+
+		require.NoError(t, err)
+
+		listener, err := stf4go.Listen(laddr, WithKey(k))
+
+		require.NoError(t, err)
+
+		go func() {
+			conn, err := listener.Accept()
+
+			if err == nil {
+				conn.Close()
+			}
+		}()
+
+		conn, err := stf4go.Dial(context.Background(), laddr, WithKey(k))
+
+		require.NoError(t, err)
+
+		// the tls layer has no socket, the helper walks down to the native conn
+		_, ok := conn.(syscall.Conn)
+
+		require.False(t, ok)
+
+		raw, err := stf4go.SyscallConn(conn)
+
+		require.NoError(t, err)
+
+		var fd uintptr
+
+		require.NoError(t, raw.Control(func(s uintptr) {
+			fd = s
+		}))
+
+		require.NotZero(t, fd)
+
+		conn.Close()
+		listener.Close()
+	}
+}
+
+// deadlineConn records the write deadline the tls layer leaves on the underlying conn
+type deadlineConn struct {
+	stf4go.Conn
+	deadline time.Time
+}
+
+func (conn *deadlineConn) SetWriteDeadline(t time.Time) error {
+	conn.deadline = t
+
+	return conn.Conn.SetWriteDeadline(t)
+}
+
+func (conn *deadlineConn) CloseWrite() error {
+	return stf4go.CloseWrite(conn.Conn)
+}
+
+func (conn *deadlineConn) CloseRead() error {
+	return stf4go.CloseRead(conn.Conn)
+}
+
+func TestCloseWriteDeadline(t *testing.T) {
+
+	laddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1882")
+
+	require.NoError(t, err)
+
+	k, err := key.RandomKey("did")
+
+	require.NoError(t, err)
+
+	cert, err := newCertCache().get(k, certValidityPeriod, 0)
+
+	require.NoError(t, err)
+
+	listener, err := stf4go.Listen(laddr)
+
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+
+		require.NoError(t, err)
+
+		defer conn.Close()
+
+		wrapConn, err := stf4go.WrapConn(conn)
+
+		require.NoError(t, err)
+
+		config, _ := newTLSConfig(cert, nil, []string{alpn})
+
+		session := tls.Server(wrapConn, config)
+
+		require.NoError(t, session.Handshake())
+
+		ioutil.ReadAll(session)
+	}()
+
+	conn, err := stf4go.Dial(context.Background(), laddr)
+
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	underlying := &deadlineConn{Conn: conn}
+
+	wrapConn, err := stf4go.WrapConn(underlying)
+
+	require.NoError(t, err)
+
+	config, _ := newTLSConfig(cert, nil, []string{alpn})
+
+	session := tls.Client(wrapConn, config)
+
+	require.NoError(t, session.Handshake())
+
+	tc := newTLSConn(session, underlying, nil, nil)
+
+	deadline := time.Now().Add(time.Minute)
+
+	require.NoError(t, tc.SetWriteDeadline(deadline))
+
+	require.NoError(t, tc.CloseWrite())
+
+	// crypto/tls expired the deadline after close_notify, the caller's one is back
+	require.True(t, deadline.Equal(underlying.deadline))
 }
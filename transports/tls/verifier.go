@@ -0,0 +1,30 @@
+package tls
+
+import (
+	"github.com/libs4go/stf4go"
+)
+
+func getPeerVerifiers(options *stf4go.Options) []stf4go.PeerVerifier {
+	obj, ok := options.GetObj("tls", "verifiers")
+
+	if !ok {
+		return nil
+	}
+
+	verifiers, ok := obj.([]stf4go.PeerVerifier)
+
+	if !ok {
+		return nil
+	}
+
+	return verifiers
+}
+
+// WithPeerVerifier add identity mode peer authorization hook, all added verifiers must accept the peer
+func WithPeerVerifier(verifier stf4go.PeerVerifier) stf4go.Option {
+	return func(options *stf4go.Options) error {
+		options.SetObject(append(getPeerVerifiers(options), verifier), "tls", "verifiers")
+
+		return nil
+	}
+}